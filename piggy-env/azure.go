@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const azureKeyVaultDNSSuffix = ".vault.azure.net"
+const azureKeyVaultAPIVersion = "7.4"
+const azureKeyVaultScope = "https://vault.azure.net/.default"
+const azureDefaultAuthorityHost = "https://login.microsoftonline.com/"
+
+// Key Vault secret names contain only alphanumerics and dashes
+var azureSecretNameRegx = regexp.MustCompile(`^[0-9a-zA-Z-]{1,127}$`)
+
+// azureError an error response of Azure Key Vault API
+type azureError struct {
+	statusCode int
+	code       string
+	message    string
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("[%d] %s: %s", e.statusCode, e.code, e.message)
+}
+
+// azureWorkloadIdentityTokenSource exchanges the federated service account token for a Microsoft Entra access token
+type azureWorkloadIdentityTokenSource struct {
+	ctx       context.Context
+	clientID  string
+	tokenURL  string
+	tokenFile string
+}
+
+func (s *azureWorkloadIdentityTokenSource) Token() (*oauth2.Token, error) {
+	assertion, err := os.ReadFile(filepath.Clean(s.tokenFile))
+	if err != nil {
+		return nil, err
+	}
+	config := clientcredentials.Config{
+		ClientID: s.clientID,
+		TokenURL: s.tokenURL,
+		Scopes:   []string{azureKeyVaultScope},
+		EndpointParams: url.Values{
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		},
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+	return config.Token(s.ctx)
+}
+
+// newAzureTokenSource returns a token source from the env injected by Azure Workload Identity
+func newAzureTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if clientID == "" || tenantID == "" || tokenFile == "" {
+		return nil, &permanentError{err: errors.New("azure workload identity requires AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE")}
+	}
+	authorityHost := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authorityHost == "" {
+		authorityHost = azureDefaultAuthorityHost
+	}
+	return oauth2.ReuseTokenSource(nil, &azureWorkloadIdentityTokenSource{
+		ctx:       ctx,
+		clientID:  clientID,
+		tokenURL:  fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authorityHost, "/"), tenantID),
+		tokenFile: tokenFile,
+	}), nil
+}
+
+// azureKeyVaultURL returns the URL of a Key Vault name e.g. `my-vault`, or the vault URL as is
+func azureKeyVaultURL(vault string) string {
+	if strings.Contains(vault, "://") {
+		return strings.TrimSuffix(vault, "/")
+	}
+	return fmt.Sprintf("https://%s%s", vault, azureKeyVaultDNSSuffix)
+}
+
+// getAzureSecret returns the current value of a Key Vault secret
+func getAzureSecret(ctx context.Context, client *http.Client, vaultURL string, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/secrets/%s?api-version=%s", vaultURL, url.PathEscape(name), azureKeyVaultAPIVersion), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		azureErr := &azureError{statusCode: resp.StatusCode, message: string(body)}
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error.Message != "" {
+			azureErr.code = errResp.Error.Code
+			azureErr.message = errResp.Error.Message
+		}
+		return "", azureErr
+	}
+	var output struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &output); err != nil {
+		return "", err
+	}
+	return output.Value, nil
+}
+
+// readAzureSecrets reads a Key Vault secret for each piggy reference. Underscores are not allowed
+// in Key Vault secret names so they are replaced with dashes e.g. piggy:DB_PASS reads DB-PASS
+func readAzureSecrets(ctx context.Context, client *http.Client, vaultURL string, keys []string) (map[string]string, error) {
+	secrets := make(map[string]string, len(keys))
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		if !azureSecretNameRegx.MatchString(name) {
+			log.Debug().Msgf("Skip [%s], not a valid Key Vault secret name", key)
+			continue
+		}
+		value, err := getAzureSecret(ctx, client, vaultURL, name)
+		if err != nil {
+			var azureErr *azureError
+			if errors.As(err, &azureErr) && azureErr.statusCode == http.StatusNotFound {
+				continue
+			}
+			return nil, err
+		}
+		secrets[key] = value
+	}
+	return secrets, nil
+}
+
+func injectAzureSecret(references map[string]string, env *sanitizedEnv) error {
+	ctx := context.Background()
+	tokenSource, err := newAzureTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	vaultURL := azureKeyVaultURL(os.Getenv("PIGGY_AZURE_KEY_VAULT_NAME"))
+	secrets, err := readAzureSecrets(ctx, oauth2.NewClient(ctx, tokenSource), vaultURL, secretKeys(references))
+	if err != nil {
+		return err
+	}
+	doSanitize(references, env, secrets)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAzureKeyVaultURL verifies that a vault name is expanded to the vault URL.
+func TestAzureKeyVaultURL(t *testing.T) {
+	assert.Equal(t, "https://my-vault.vault.azure.net", azureKeyVaultURL("my-vault"))
+	assert.Equal(t, "https://my-vault.vault.azure.cn", azureKeyVaultURL("https://my-vault.vault.azure.cn/"))
+}
+
+// TestReadAzureSecrets verifies reading referenced secrets from a fake Azure Key Vault API.
+func TestReadAzureSecrets(t *testing.T) {
+	values := map[string]string{"DB-PASS": "secret"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/secrets/")
+		if name == "DENIED" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error": {"code": "Forbidden", "message": "Caller is not authorized"}}`))
+			return
+		}
+		value, ok := values[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": {"code": "SecretNotFound", "message": "Secret not found"}}`))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"value": "%s"}`, value)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	// Case 1: Missing and invalid names are skipped
+	secrets, err := readAzureSecrets(ctx, server.Client(), server.URL, []string{"DB_PASS", "MISSING", "db.pass"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"DB_PASS": "secret"}, secrets)
+
+	// Case 2: Access denied is not retried
+	_, err = readAzureSecrets(ctx, server.Client(), server.URL, []string{"DENIED"})
+	var azureErr *azureError
+	assert.ErrorAs(t, err, &azureErr)
+	assert.Equal(t, "[403] Forbidden: Caller is not authorized", azureErr.Error())
+	var permErr *permanentError
+	assert.ErrorAs(t, standaloneError(err), &permErr)
+	assert.False(t, errors.As(standaloneError(&azureError{statusCode: http.StatusTooManyRequests}), &permErr))
+}
+
+// TestAzureTokenSource verifies exchanging the federated token for an access token.
+func TestAzureTokenSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/my-tenant/oauth2/v2.0/token", r.URL.Path)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "federated-token", r.PostForm.Get("client_assertion"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("federated-token"), 0600))
+
+	// Case 1: Workload Identity is not configured
+	t.Setenv("AZURE_CLIENT_ID", "")
+	_, err := newAzureTokenSource(context.Background())
+	var permErr *permanentError
+	assert.ErrorAs(t, err, &permErr)
+
+	// Case 2: Exchange the federated token
+	t.Setenv("AZURE_CLIENT_ID", "my-client")
+	t.Setenv("AZURE_TENANT_ID", "my-tenant")
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+	t.Setenv("AZURE_AUTHORITY_HOST", server.URL)
+	ts, err := newAzureTokenSource(context.Background())
+	assert.NoError(t, err)
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// PrefixRDSIAMToken a reference generating an RDS IAM authentication token e.g. `piggy:rds-iam-token:mydb.abc.us-east-1.rds.amazonaws.com:5432:app`
+const PrefixRDSIAMToken = "rds-iam-token:"
+
+// PrefixSTS a reference generating temporary credentials of a role e.g. `piggy:sts:arn:aws:iam::123456789012:role/app`
+const PrefixSTS = "sts:"
+
+// the region of an RDS endpoint e.g. `mydb.abc.us-east-1.rds.amazonaws.com`
+var rdsRegionRegx = regexp.MustCompile(`\.([a-z]{2}(-[a-z]+)+-\d+)\.rds\.amazonaws\.com(\.cn)?$`)
+
+// role session names contain only alphanumerics and `+=,.@-`
+var stsSessionNameRegx = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// stsAssumer assumes roles
+type stsAssumer interface {
+	AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+}
+
+// credentialGenerator generates short-lived credentials with the AWS identity of the pod
+type credentialGenerator struct {
+	region      string
+	credentials aws.CredentialsProvider
+	sts         stsAssumer
+	sessionName string
+}
+
+// isGeneratedReference returns true if the secret key is generated by piggy-env instead of read from a secret store
+func isGeneratedReference(key string) bool {
+	return strings.HasPrefix(key, PrefixRDSIAMToken) || strings.HasPrefix(key, PrefixSTS)
+}
+
+// stsSessionName returns the role session name of the pod, which appears in CloudTrail
+func stsSessionName(podName string) string {
+	name := stsSessionNameRegx.ReplaceAllString("piggy-"+podName, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// rdsIAMToken generates an RDS IAM authentication token of a `host:port:user` reference
+func (g *credentialGenerator) rdsIAMToken(ctx context.Context, reference string) (string, error) {
+	host, rest, _ := strings.Cut(reference, ":")
+	port, user, _ := strings.Cut(rest, ":")
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil || host == "" || user == "" {
+		return "", &permanentError{err: fmt.Errorf("invalid rds-iam-token reference [%s], expecting host:port:user", reference)}
+	}
+	region := g.region
+	if match := rdsRegionRegx.FindStringSubmatch(host); match != nil {
+		region = match[1]
+	}
+	if region == "" {
+		return "", &permanentError{err: fmt.Errorf("unknown region of rds-iam-token reference [%s]", reference)}
+	}
+	return auth.BuildAuthToken(ctx, fmt.Sprintf("%s:%s", host, port), region, user, g.credentials)
+}
+
+// stsCredentials assumes the role and returns the temporary credentials as `{name}_ACCESS_KEY_ID`, `{name}_SECRET_ACCESS_KEY`,
+// `{name}_SESSION_TOKEN` and `{name}_CREDENTIAL_EXPIRATION` env e.g. `AWS=piggy:sts:...` sets the AWS SDK env
+func (g *credentialGenerator) stsCredentials(ctx context.Context, name string, roleArn string) ([]string, error) {
+	output, err := g.sts.AssumeRole(ctx, &sts.AssumeRoleInput{
+		RoleArn:         aws.String(roleArn),
+		RoleSessionName: aws.String(g.sessionName),
+	})
+	if awsErr(err) {
+		return nil, err
+	}
+	if output.Credentials == nil {
+		return nil, errors.New("assume role returned no credentials")
+	}
+	return []string{
+		fmt.Sprintf("%s_ACCESS_KEY_ID=%s", name, aws.ToString(output.Credentials.AccessKeyId)),
+		fmt.Sprintf("%s_SECRET_ACCESS_KEY=%s", name, aws.ToString(output.Credentials.SecretAccessKey)),
+		fmt.Sprintf("%s_SESSION_TOKEN=%s", name, aws.ToString(output.Credentials.SessionToken)),
+		fmt.Sprintf("%s_CREDENTIAL_EXPIRATION=%s", name, aws.ToTime(output.Credentials.Expiration).UTC().Format(time.RFC3339)),
+	}, nil
+}
+
+// filteredRDSIAMToken generates an RDS IAM authentication token of a reference and applies its filters e.g. `rds-iam-token:...|urlencode`
+func (g *credentialGenerator) filteredRDSIAMToken(ctx context.Context, r reference) (string, error) {
+	token, err := g.rdsIAMToken(ctx, strings.TrimPrefix(r.key, PrefixRDSIAMToken))
+	if err != nil {
+		return "", err
+	}
+	if token, err = r.filter(token); err != nil {
+		return "", &permanentError{err: err}
+	}
+	return token, nil
+}
+
+// expandRDSIAMTokens replaces the RDS IAM token references embedded in a value e.g. `postgres://app:${piggy:rds-iam-token:...}@...`.
+// Temporary STS credentials set several env, so they cannot be embedded
+func (g *credentialGenerator) expandRDSIAMTokens(ctx context.Context, value string) (string, error) {
+	var err error
+	expanded := expandReferences(value, func(key string) (string, bool) {
+		r := parseReference(key)
+		if !strings.HasPrefix(r.key, PrefixRDSIAMToken) || err != nil {
+			return "", false
+		}
+		var token string
+		token, err = g.filteredRDSIAMToken(ctx, r)
+		return token, err == nil
+	})
+	return expanded, err
+}
+
+// generate replaces the env referencing generated credentials. The env is changed only when all credentials are generated
+func (g *credentialGenerator) generate(ctx context.Context, env *sanitizedEnv) error {
+	result := make([]string, 0, len(env.Env))
+	for _, v := range env.Env {
+		name, value, _ := strings.Cut(v, "=")
+		spec, _ := strings.CutPrefix(value, PrefixPiggy)
+		r := parseReference(spec)
+		key := r.key
+		switch {
+		case !strings.HasPrefix(value, PrefixPiggy):
+			expanded, err := g.expandRDSIAMTokens(ctx, value)
+			if err != nil {
+				return err
+			}
+			result = append(result, fmt.Sprintf("%s=%s", name, expanded))
+		case strings.HasPrefix(key, PrefixRDSIAMToken):
+			token, err := g.filteredRDSIAMToken(ctx, r)
+			if err != nil {
+				return err
+			}
+			result = append(result, fmt.Sprintf("%s=%s", name, token))
+		case strings.HasPrefix(key, PrefixSTS):
+			credentials, err := g.stsCredentials(ctx, name, strings.TrimPrefix(key, PrefixSTS))
+			if err != nil {
+				return err
+			}
+			result = append(result, credentials...)
+		default:
+			result = append(result, v)
+		}
+	}
+	env.Env = result
+	return nil
+}
+
+// hasGeneratedReference returns true if a `NAME=value` env references generated credentials
+func hasGeneratedReference(v string) bool {
+	_, value, _ := strings.Cut(v, "=")
+	return slices.ContainsFunc(referenceKeys(value), func(key string) bool {
+		return isGeneratedReference(parseReference(key).key)
+	})
+}
+
+// generateCredentials generates the RDS IAM tokens and STS credentials referenced by the env with the AWS identity of the pod.
+// piggy-webhooks never generates them, so a pod can only generate credentials which its own role allows
+func generateCredentials(env *sanitizedEnv) error {
+	if !slices.ContainsFunc(env.Env, hasGeneratedReference) {
+		return nil
+	}
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(os.Getenv("PIGGY_AWS_REGION")))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	g := &credentialGenerator{
+		region:      cfg.Region,
+		credentials: cfg.Credentials,
+		sts:         sts.NewFromConfig(cfg),
+		sessionName: stsSessionName(hostname),
+	}
+	return standaloneError(g.generate(ctx, env))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSTSClient struct {
+	sessionName string
+}
+
+func (c *fakeSTSClient) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	c.sessionName = aws.ToString(params.RoleSessionName)
+	if aws.ToString(params.RoleArn) != "arn:aws:iam::123456789012:role/app" {
+		return nil, &smithy.GenericAPIError{Code: "AccessDenied"}
+	}
+	return &sts.AssumeRoleOutput{Credentials: &types.Credentials{
+		AccessKeyId:     aws.String("ASIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret-key"),
+		SessionToken:    aws.String("session-token"),
+		Expiration:      aws.Time(time.Date(2026, 1, 1, 1, 0, 0, 0, time.UTC)),
+	}}, nil
+}
+
+// TestStsSessionName verifies that the session name is valid for any pod name.
+func TestStsSessionName(t *testing.T) {
+	assert.Equal(t, "piggy-myapp-7d9f-abc", stsSessionName("myapp-7d9f-abc"))
+	assert.Equal(t, "piggy-a-b", stsSessionName("a/b"))
+	assert.Len(t, stsSessionName(strings.Repeat("a", 100)), 64)
+}
+
+// TestGenerateCredentials verifies that references to generated credentials are replaced in env.
+func TestGenerateCredentials(t *testing.T) {
+	stsClient := &fakeSTSClient{}
+	g := &credentialGenerator{
+		region:      "eu-west-1",
+		credentials: credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", ""),
+		sts:         stsClient,
+		sessionName: "piggy-myapp",
+	}
+	ctx := context.Background()
+
+	// Case 1: RDS IAM token and STS credentials
+	env := &sanitizedEnv{Env: []string{
+		"DB_HOST=mydb.abc.us-east-1.rds.amazonaws.com",
+		"DB_PASS=piggy:rds-iam-token:mydb.abc.us-east-1.rds.amazonaws.com:5432:app",
+		"AWS=piggy:sts:arn:aws:iam::123456789012:role/app",
+	}}
+	assert.NoError(t, g.generate(ctx, env))
+	assert.Len(t, env.Env, 6)
+	assert.Equal(t, "DB_HOST=mydb.abc.us-east-1.rds.amazonaws.com", env.Env[0])
+	name, token, _ := strings.Cut(env.Env[1], "=")
+	assert.Equal(t, "DB_PASS", name)
+	assert.True(t, strings.HasPrefix(token, "mydb.abc.us-east-1.rds.amazonaws.com:5432?"))
+	query, err := url.ParseQuery(token[strings.Index(token, "?")+1:])
+	assert.NoError(t, err)
+	assert.Equal(t, "connect", query.Get("Action"))
+	assert.Equal(t, "app", query.Get("DBUser"))
+	assert.Contains(t, query.Get("X-Amz-Credential"), "/us-east-1/rds-db/")
+	assert.Equal(t, []string{
+		"AWS_ACCESS_KEY_ID=ASIAEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY=secret-key",
+		"AWS_SESSION_TOKEN=session-token",
+		"AWS_CREDENTIAL_EXPIRATION=2026-01-01T01:00:00Z",
+	}, env.Env[2:])
+	assert.Equal(t, "piggy-myapp", stsClient.sessionName)
+
+	// Case 2: Region of a custom endpoint
+	env = &sanitizedEnv{Env: []string{"DB_PASS=piggy:rds-iam-token:db.example.com:3306:app"}}
+	assert.NoError(t, g.generate(ctx, env))
+	assert.Contains(t, env.Env[0], "%2Feu-west-1%2Frds-db%2F")
+
+	// Case 3: Invalid reference is not retried, env is unchanged
+	env = &sanitizedEnv{Env: []string{"AWS=piggy:sts:arn:aws:iam::123456789012:role/app", "DB_PASS=piggy:rds-iam-token:mydb:app"}}
+	err = g.generate(ctx, env)
+	var permErr *permanentError
+	assert.ErrorAs(t, err, &permErr)
+	assert.Equal(t, []string{"AWS=piggy:sts:arn:aws:iam::123456789012:role/app", "DB_PASS=piggy:rds-iam-token:mydb:app"}, env.Env)
+
+	// Case 4: Role cannot be assumed
+	env = &sanitizedEnv{Env: []string{"AWS=piggy:sts:arn:aws:iam::123456789012:role/other"}}
+	assert.ErrorAs(t, standaloneError(g.generate(ctx, env)), &permErr)
+
+	// Case 5: RDS IAM token embedded in a value
+	env = &sanitizedEnv{Env: []string{"DATABASE_URL=postgres://app:${piggy:rds-iam-token:db.example.com:5432:app}@db.example.com:5432/app"}}
+	assert.True(t, hasGeneratedReference(env.Env[0]))
+	assert.NoError(t, g.generate(ctx, env))
+	assert.True(t, strings.HasPrefix(env.Env[0], "DATABASE_URL=postgres://app:db.example.com:5432?Action=connect"))
+	assert.True(t, strings.HasSuffix(env.Env[0], "@db.example.com:5432/app"))
+
+	// Case 6: URL encoded RDS IAM token embedded in a value
+	env = &sanitizedEnv{Env: []string{"DATABASE_URL=postgres://app:${piggy:rds-iam-token:db.example.com:5432:app|urlencode}@db.example.com:5432/app"}}
+	assert.True(t, hasGeneratedReference(env.Env[0]))
+	assert.NoError(t, g.generate(ctx, env))
+	assert.True(t, strings.HasPrefix(env.Env[0], "DATABASE_URL=postgres://app:db.example.com%3A5432%3FAction%3Dconnect"))
+	assert.NotContains(t, strings.TrimSuffix(env.Env[0], "@db.example.com:5432/app"), "&")
+
+	// Case 7: No generated credentials
+	env = &sanitizedEnv{Env: []string{"DB_PASS=secret"}}
+	assert.NoError(t, generateCredentials(env))
+	assert.Equal(t, []string{"DB_PASS=secret"}, env.Env)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const gcpSecretManagerEndpoint = "https://secretmanager.googleapis.com"
+
+// gcpError an error response of Google Secret Manager API
+type gcpError struct {
+	statusCode int
+	message    string
+}
+
+func (e *gcpError) Error() string {
+	return fmt.Sprintf("[%d] %s", e.statusCode, e.message)
+}
+
+// newGCPCredentials returns credentials from PIGGY_GCP_SECRET_CREDENTIALS_FILE, or the application default credentials e.g. GKE Workload Identity
+func newGCPCredentials(ctx context.Context) (*google.Credentials, error) {
+	credentialsFile := os.Getenv("PIGGY_GCP_SECRET_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		return google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	}
+	b, err := os.ReadFile(filepath.Clean(credentialsFile))
+	if err != nil {
+		return nil, err
+	}
+	return google.CredentialsFromJSON(ctx, b, "https://www.googleapis.com/auth/cloud-platform")
+}
+
+// gcpSecretVersionName returns the resource name of a secret version. The secret is a secret ID in the project,
+// or a full resource name `projects/{project}/secrets/{secret}`. The version is a version number or an alias, default to `latest`
+func gcpSecretVersionName(secret string, project string, version string) (string, error) {
+	if version == "" {
+		version = "latest"
+	}
+	if !strings.HasPrefix(secret, "projects/") {
+		if project == "" {
+			return "", fmt.Errorf("GCP project of secret %s is not set", secret)
+		}
+		secret = fmt.Sprintf("projects/%s/secrets/%s", project, secret)
+	}
+	return fmt.Sprintf("%s/versions/%s", secret, version), nil
+}
+
+// accessGCPSecretVersion returns the payload of a secret version
+func accessGCPSecretVersion(ctx context.Context, client *http.Client, endpoint string, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/%s:access", strings.TrimSuffix(endpoint, "/"), name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		message := string(body)
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error.Message != "" {
+			message = errResp.Error.Message
+		}
+		return nil, &gcpError{statusCode: resp.StatusCode, message: message}
+	}
+	var output struct {
+		Payload struct {
+			Data       string `json:"data"`
+			DataCrc32c string `json:"dataCrc32c"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &output); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(output.Payload.Data)
+	if err != nil {
+		return nil, err
+	}
+	if output.Payload.DataCrc32c != "" {
+		if fmt.Sprint(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))) != output.Payload.DataCrc32c {
+			return nil, fmt.Errorf("secret %s payload checksum mismatch", name)
+		}
+	}
+	return data, nil
+}
+
+// readGCPSecret reads a JSON object secret from Google Secret Manager
+func readGCPSecret(ctx context.Context, client *http.Client, endpoint string, name string) (map[string]string, error) {
+	data, err := accessGCPSecretVersion(ctx, client, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object: %v", name, err)
+	}
+	return secrets, nil
+}
+
+func injectGCPSecret(references map[string]string, env *sanitizedEnv) error {
+	ctx := context.Background()
+	creds, err := newGCPCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	project := os.Getenv("PIGGY_GCP_SECRET_PROJECT")
+	if project == "" {
+		project = creds.ProjectID
+	}
+	name, err := gcpSecretVersionName(os.Getenv("PIGGY_GCP_SECRET_NAME"), project, os.Getenv("PIGGY_GCP_SECRET_VERSION"))
+	if err != nil {
+		return &permanentError{err: err}
+	}
+	secrets, err := readGCPSecret(ctx, oauth2.NewClient(ctx, creds.TokenSource), gcpSecretManagerEndpoint, name)
+	if err != nil {
+		return err
+	}
+	doSanitize(references, env, secrets)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGCPSecretVersionName verifies that a secret ID is expanded to a secret version resource name.
+func TestGCPSecretVersionName(t *testing.T) {
+	name, err := gcpSecretVersionName("my-secret", "my-project", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "projects/my-project/secrets/my-secret/versions/latest", name)
+	name, err = gcpSecretVersionName("projects/other/secrets/my-secret", "", "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "projects/other/secrets/my-secret/versions/prod", name)
+	_, err = gcpSecretVersionName("my-secret", "", "")
+	assert.Error(t, err)
+}
+
+// TestReadGCPSecret verifies reading a secret from a fake Google Secret Manager API.
+func TestReadGCPSecret(t *testing.T) {
+	payloads := map[string]string{
+		"/v1/projects/p/secrets/json/versions/latest:access":  `{"DB_PASS": "secret"}`,
+		"/v1/projects/p/secrets/plain/versions/latest:access": "secret",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := payloads[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": {"code": 404, "message": "Secret not found"}}`))
+			return
+		}
+		checksum := crc32.Checksum([]byte(data), crc32.MakeTable(crc32.Castagnoli))
+		_, _ = fmt.Fprintf(w, `{"payload": {"data": "%s", "dataCrc32c": "%d"}}`, base64.StdEncoding.EncodeToString([]byte(data)), checksum)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	// Case 1: JSON object
+	secrets, err := readGCPSecret(ctx, server.Client(), server.URL, "projects/p/secrets/json/versions/latest")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"DB_PASS": "secret"}, secrets)
+
+	// Case 2: Not a JSON object
+	_, err = readGCPSecret(ctx, server.Client(), server.URL, "projects/p/secrets/plain/versions/latest")
+	assert.ErrorContains(t, err, "not a JSON object")
+
+	// Case 3: Not found is not retried
+	_, err = readGCPSecret(ctx, server.Client(), server.URL, "projects/p/secrets/unknown/versions/latest")
+	var gcpErr *gcpError
+	assert.ErrorAs(t, err, &gcpErr)
+	assert.Equal(t, "[404] Secret not found", gcpErr.Error())
+	var permErr *permanentError
+	assert.ErrorAs(t, standaloneError(err), &permErr)
+	assert.False(t, errors.As(standaloneError(&gcpError{statusCode: http.StatusServiceUnavailable}), &permErr))
+}
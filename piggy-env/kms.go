@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/rs/zerolog/log"
+)
+
+// PrefixKMS a reference to an inline AWS KMS ciphertext e.g. `piggy:kms:AQICAHh...`
+const PrefixKMS = "kms:"
+
+// kmsDecrypter decrypts KMS ciphertexts
+type kmsDecrypter interface {
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// splitKMSReferences splits env into env referencing inline KMS ciphertexts and the others
+func splitKMSReferences(references map[string]string) (map[string]string, map[string]string) {
+	ciphertexts := make(map[string]string)
+	others := make(map[string]string, len(references))
+	for name, value := range references {
+		if slices.ContainsFunc(referenceKeys(value), func(key string) bool { return strings.HasPrefix(key, PrefixKMS) }) {
+			ciphertexts[name] = value
+		} else {
+			others[name] = value
+		}
+	}
+	return ciphertexts, others
+}
+
+// kmsEncryptionContext returns the encryption context of the pod service account, the same as piggy-webhooks uses in proxy mode
+func kmsEncryptionContext() (map[string]string, error) {
+	namespace := os.Getenv("PIGGY_POD_NAMESPACE")
+	serviceAccount := os.Getenv("PIGGY_SERVICE_ACCOUNT_NAME")
+	if namespace == "" || serviceAccount == "" {
+		return nil, &permanentError{err: errors.New("kms ciphertext requires PIGGY_POD_NAMESPACE and PIGGY_SERVICE_ACCOUNT_NAME")}
+	}
+	return map[string]string{
+		"piggysec.com/namespace":       namespace,
+		"piggysec.com/service-account": serviceAccount,
+	}, nil
+}
+
+// decryptKMSReferences decrypts the inline KMS ciphertext of each reference. Invalid ciphertexts are skipped
+func decryptKMSReferences(ctx context.Context, client kmsDecrypter, references map[string]string, encryptionContext map[string]string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	for _, key := range secretKeys(references) {
+		if !strings.HasPrefix(key, PrefixKMS) {
+			// a secret key embedded in the same value
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(key, PrefixKMS))
+		if err != nil || len(blob) == 0 {
+			log.Debug().Msgf("Skip [%s], not a base64 KMS ciphertext", key)
+			continue
+		}
+		output, err := client.Decrypt(ctx, &kms.DecryptInput{
+			CiphertextBlob:    blob,
+			EncryptionContext: encryptionContext,
+		})
+		if awsErr(err) {
+			return nil, err
+		}
+		secrets[key] = string(output.Plaintext)
+	}
+	return secrets, nil
+}
+
+// readKMSSecrets decrypts the inline KMS ciphertexts with the AWS role of the pod
+func readKMSSecrets(references map[string]string) (map[string]string, error) {
+	encryptionContext, err := kmsEncryptionContext()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(os.Getenv("PIGGY_AWS_REGION")))
+	if err != nil {
+		return nil, err
+	}
+	return decryptKMSReferences(ctx, kms.NewFromConfig(cfg), references, encryptionContext)
+}
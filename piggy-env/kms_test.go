@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"maps"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeKMSClient struct {
+	plaintexts        map[string]string
+	encryptionContext map[string]string
+}
+
+func (c *fakeKMSClient) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	plaintext, ok := c.plaintexts[string(params.CiphertextBlob)]
+	if !ok || !maps.Equal(params.EncryptionContext, c.encryptionContext) {
+		return nil, &smithy.GenericAPIError{Code: "InvalidCiphertextException"}
+	}
+	return &kms.DecryptOutput{Plaintext: []byte(plaintext)}, nil
+}
+
+// TestSplitKMSReferences verifies that env referencing KMS ciphertexts are told apart from other env.
+func TestSplitKMSReferences(t *testing.T) {
+	ciphertexts, others := splitKMSReferences(map[string]string{
+		"DB_PASS":   "piggy:DB_PASS",
+		"API_TOKEN": "piggy:kms:AQID",
+		"NORMAL":    "value",
+	})
+	assert.Equal(t, map[string]string{"API_TOKEN": "piggy:kms:AQID"}, ciphertexts)
+	assert.Equal(t, map[string]string{"DB_PASS": "piggy:DB_PASS", "NORMAL": "value"}, others)
+}
+
+// TestDecryptKMSReferences verifies decrypting inline ciphertexts with the encryption context of the service account.
+func TestDecryptKMSReferences(t *testing.T) {
+	token := "kms:" + base64.StdEncoding.EncodeToString([]byte("token-ciphertext"))
+	other := "kms:" + base64.StdEncoding.EncodeToString([]byte("other-ciphertext"))
+
+	// Case 1: Encryption context is not injected
+	t.Setenv("PIGGY_POD_NAMESPACE", "")
+	_, err := kmsEncryptionContext()
+	var permErr *permanentError
+	assert.ErrorAs(t, err, &permErr)
+
+	// Case 2: Decrypt the ciphertexts, invalid ones are skipped
+	t.Setenv("PIGGY_POD_NAMESPACE", "default")
+	t.Setenv("PIGGY_SERVICE_ACCOUNT_NAME", "myapp")
+	encryptionContext, err := kmsEncryptionContext()
+	assert.NoError(t, err)
+	client := &fakeKMSClient{
+		plaintexts: map[string]string{"token-ciphertext": "token"},
+		encryptionContext: map[string]string{
+			"piggysec.com/namespace":       "default",
+			"piggysec.com/service-account": "myapp",
+		},
+	}
+	secrets, err := decryptKMSReferences(context.Background(), client, map[string]string{
+		"API_TOKEN": "piggy:" + token,
+		"INVALID":   "piggy:kms:not base64",
+	}, encryptionContext)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{token: "token"}, secrets)
+	env := &sanitizedEnv{}
+	doSanitize(map[string]string{"API_TOKEN": "piggy:" + token}, env, secrets)
+	assert.Equal(t, []string{"API_TOKEN=token"}, env.Env)
+
+	// Case 3: Ciphertext of another service account is not retried
+	_, err = decryptKMSReferences(context.Background(), client, map[string]string{"OTHER": "piggy:" + other}, encryptionContext)
+	assert.ErrorAs(t, standaloneError(err), &permErr)
+}
@@ -5,16 +5,21 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -28,31 +33,72 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http/httpproxy"
 )
 
 const PrefixPiggy = "piggy:"
 
+// PrefixSRV a PIGGY_ADDRESS resolved by DNS SRV lookup e.g. `srv://_https._tcp.piggy-webhooks.piggy-webhooks.svc.cluster.local`
+const PrefixSRV = "srv://"
+
+const (
+	retryDelay          = 500 * time.Millisecond // wait before the first retry
+	maxRetryInterval    = 10 * time.Second       // longest wait between retries
+	maxRetryAfter       = time.Minute            // longest Retry-After honored
+	addressTimeout      = 10 * time.Second       // timeout of a request to each piggy-webhooks address
+	requestTimeout      = 30 * time.Second       // timeout of a request to all piggy-webhooks addresses
+	connectTimeout      = 5 * time.Second        // timeout of connecting to piggy-webhooks
+	tlsHandshakeTimeout = 5 * time.Second        // timeout of TLS handshake with piggy-webhooks
+)
+
 type sanitizedEnv struct {
 	Env []string `json:"env"`
 }
 
 var sanitizeEnvmap = map[string]bool{
-	"PIGGY_AWS_SECRET_NAME":            true,
-	"PIGGY_AWS_SSM_PARAMETER_PATH":     true,
-	"PIGGY_AWS_REGION":                 true,
-	"PIGGY_AWS_SECRET_VERSION":         true,
-	"PIGGY_POD_NAME":                   true,
-	"PIGGY_DEBUG":                      true,
-	"PIGGY_STANDALONE":                 true,
-	"PIGGY_ADDRESS":                    true,
-	"PIGGY_ALLOWED_SA":                 true,
-	"PIGGY_SKIP_VERIFY_TLS":            true,
-	"PIGGY_IGNORE_NO_ENV":              true,
-	"PIGGY_DEFAULT_SECRET_NAME_PREFIX": true, // use before secret
-	"PIGGY_DEFAULT_SECRET_NAME_SUFFIX": true, // use before secret
-	"PIGGY_DNS_RESOLVER":               true, // use before secret
-	"PIGGY_INITIAL_DELAY":              true, // use before secret
-	"PIGGY_NUMBER_OF_RETRY":            true, // use before secret
+	"PIGGY_AWS_SECRET_NAME":             true,
+	"PIGGY_AWS_SSM_PARAMETER_PATH":      true,
+	"PIGGY_AWS_SSM_PARAMETER_KEY":       true,
+	"PIGGY_AWS_SSM_PARAMETER_SEPARATOR": true,
+	"PIGGY_AWS_SSM_SPLIT_STRING_LIST":   true,
+	"PIGGY_AWS_REGION":                  true,
+	"PIGGY_GCP_SECRET_NAME":             true,
+	"PIGGY_GCP_SECRET_PROJECT":          true,
+	"PIGGY_GCP_SECRET_VERSION":          true,
+	"PIGGY_GCP_SECRET_CREDENTIALS_FILE": true,
+	"PIGGY_AZURE_KEY_VAULT_NAME":        true,
+	"PIGGY_AWS_SECRET_VERSION":          true,
+	"PIGGY_POD_NAME":                    true,
+	"PIGGY_POD_NAMESPACE":               true,
+	"PIGGY_SERVICE_ACCOUNT_NAME":        true,
+	"PIGGY_DEBUG":                       true,
+	"PIGGY_STANDALONE":                  true,
+	"PIGGY_ADDRESS":                     true,
+	"PIGGY_ADDRESS_ORDER":               true, // use before secret
+	"PIGGY_ADDRESS_TIMEOUT":             true, // use before secret
+	"PIGGY_ALLOWED_SA":                  true,
+	"PIGGY_SKIP_VERIFY_TLS":             true,
+	"PIGGY_IGNORE_NO_ENV":               true,
+	"PIGGY_DEFAULT_SECRET_NAME_PREFIX":  true, // use before secret
+	"PIGGY_DEFAULT_SECRET_NAME_SUFFIX":  true, // use before secret
+	"PIGGY_DNS_RESOLVER":                true, // use before secret
+	"PIGGY_DNS_SERVER":                  true, // use before secret
+	"PIGGY_IP_FAMILY":                   true, // use before secret
+	"PIGGY_CONNECT_TIMEOUT":             true, // use before secret
+	"PIGGY_TLS_HANDSHAKE_TIMEOUT":       true, // use before secret
+	"PIGGY_REQUEST_TIMEOUT":             true, // use before secret
+	"PIGGY_HTTP_PROXY":                  true, // use before secret
+	"PIGGY_NO_PROXY":                    true, // use before secret
+	"PIGGY_INITIAL_DELAY":               true, // use before secret
+	"PIGGY_NUMBER_OF_RETRY":             true, // use before secret
+	"PIGGY_FAILOVER":                    true, // use before secret
+	"PIGGY_RETRY_INITIAL_INTERVAL":      true, // use before secret
+	"PIGGY_RETRY_MAX_INTERVAL":          true, // use before secret
+	"PIGGY_RETRY_MAX_ELAPSED_TIME":      true, // use before secret
+	"PIGGY_CA_BUNDLE":                   true, // use before secret
+	"PIGGY_TLS_CLIENT_CERT_FILE":        true, // use before secret
+	"PIGGY_TLS_CLIENT_KEY_FILE":         true, // use before secret
+	"PIGGY_TOKEN_FILE":                  true, // use before secret
 }
 
 var golangNetwork = map[string]bool{
@@ -72,6 +118,9 @@ var golangNetwork = map[string]bool{
 
 var schemeRegx = regexp.MustCompile(`piggy:(.+)`)
 
+// embeddedRegx matches `${piggy:KEY}` references and `$${piggy:KEY}` escapes embedded in a value
+var embeddedRegx = regexp.MustCompile(`\$?\$\{piggy:([^}]+)\}`)
+
 func (e *sanitizedEnv) append(name string, value string) {
 	if _, ok := sanitizeEnvmap[name]; !ok {
 		e.Env = append(e.Env, fmt.Sprintf("%s=%s", name, value))
@@ -89,27 +138,176 @@ func awsErr(err error) bool {
 	return false
 }
 
+// referenceKeys returns the secret keys referenced by an env value, either a whole `piggy:KEY` value
+// or `${piggy:KEY}` references embedded in the value. An escaped `$${piggy:KEY}` is not a reference
+func referenceKeys(value string) []string {
+	if key, ok := strings.CutPrefix(value, PrefixPiggy); ok {
+		return []string{key}
+	}
+	var keys []string
+	for _, match := range embeddedRegx.FindAllStringSubmatch(value, -1) {
+		if !strings.HasPrefix(match[0], "$$") {
+			keys = append(keys, match[1])
+		}
+	}
+	return keys
+}
+
+// expandReferences replaces the references embedded in a value with the values found by lookup.
+// Escaped and unresolved references are kept
+func expandReferences(value string, lookup func(key string) (string, bool)) string {
+	return embeddedRegx.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match
+		}
+		if val, ok := lookup(strings.TrimSuffix(strings.TrimPrefix(match, "${"+PrefixPiggy), "}")); ok {
+			return val
+		}
+		return match
+	})
+}
+
+// hasUnresolvedReference returns true if a value is still a `piggy:KEY` reference or embeds a `${piggy:KEY}` reference
+func hasUnresolvedReference(value string) bool {
+	if strings.HasPrefix(strings.ToUpper(value), strings.ToUpper(PrefixPiggy)) {
+		return true
+	}
+	return len(referenceKeys(value)) > 0
+}
+
+// unescapeReferences turns escaped `$${piggy:KEY}` into literal `${piggy:KEY}`
+func unescapeReferences(value string) string {
+	return embeddedRegx.ReplaceAllStringFunc(value, func(match string) string {
+		return strings.TrimPrefix(match, "$")
+	})
+}
+
 func doSanitize(references map[string]string, env *sanitizedEnv, secrets map[string]string) {
+	sanitize(references, env, secrets, true)
+}
+
+// sanitize resolves the references found in secrets. If missing is allowed, missing optional keys
+// and keys with a default value are resolved too
+func sanitize(references map[string]string, env *sanitizedEnv, secrets map[string]string, missing bool) {
 	for refName, refValue := range references {
 		if strings.HasPrefix(refValue, PrefixPiggy) {
 			match := schemeRegx.FindAllStringSubmatch(refValue, -1)
 			if len(match) == 1 {
-				if val, ok := secrets[match[0][1]]; ok {
+				if val, ok := lookupReference(match[0][1], secrets, missing); ok {
 					env.append(refName, val)
+					appendIndexed(refName, match[0][1], env, secrets)
 					continue
 				}
 			}
+		} else {
+			refValue = expandReferences(refValue, func(key string) (string, bool) {
+				return lookupReference(key, secrets, missing)
+			})
 		}
 		env.append(refName, refValue)
 	}
 }
 
+// resolveReferences returns env with the references found in secrets resolved, and the others kept
+// for the secret store, including missing optional keys and keys with a default value
+func resolveReferences(references map[string]string, secrets map[string]string) map[string]string {
+	resolved := &sanitizedEnv{}
+	sanitize(references, resolved, secrets, false)
+	result := make(map[string]string, len(resolved.Env))
+	for _, v := range resolved.Env {
+		name, value, _ := strings.Cut(v, "=")
+		result[name] = value
+	}
+	return result
+}
+
+// appendIndexed appends the elements of a split StringList parameter as `NAME_0`, `NAME_1`, ...
+func appendIndexed(refName string, key string, env *sanitizedEnv, secrets map[string]string) {
+	if !strings.HasPrefix(key, PrefixSSM) {
+		return
+	}
+	if _, ok := secrets[ssmIndexedKey(key, 0)]; !ok {
+		r := parseReference(key)
+		if len(r.filters) > 0 {
+			return
+		}
+		// elements read from the secret store are keyed by the secret key
+		key = r.key
+	}
+	for i := 0; ; i++ {
+		val, ok := secrets[ssmIndexedKey(key, i)]
+		if !ok {
+			return
+		}
+		env.append(fmt.Sprintf("%s_%d", refName, i), val)
+	}
+}
+
+// standaloneError marks AWS, GCP and Azure errors which will not succeed on retry as permanent
+func standaloneError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		if code == "ResourceNotFoundException" || code == "ParameterNotFound" || code == "InvalidCiphertextException" || code == "IncorrectKeyException" || strings.HasPrefix(code, "AccessDenied") {
+			return &permanentError{err: err}
+		}
+	}
+	var gcpErr *gcpError
+	if errors.As(err, &gcpErr) && (gcpErr.statusCode == http.StatusNotFound || gcpErr.statusCode == http.StatusForbidden) {
+		return &permanentError{err: err}
+	}
+	var azureErr *azureError
+	if errors.As(err, &azureErr) && (azureErr.statusCode == http.StatusUnauthorized || azureErr.statusCode == http.StatusForbidden) {
+		return &permanentError{err: err}
+	}
+	return err
+}
+
 func inject(references map[string]string, env *sanitizedEnv) error {
+	secrets := make(map[string]string)
+	if ciphertexts, _ := splitKMSReferences(references); len(ciphertexts) > 0 {
+		plaintexts, err := readKMSSecrets(ciphertexts)
+		if err != nil {
+			return standaloneError(err)
+		}
+		maps.Copy(secrets, plaintexts)
+	}
+	if parameters, _ := splitSSMReferences(references); len(parameters) > 0 {
+		values, err := readSSMParameters(parameters)
+		if err != nil {
+			return standaloneError(err)
+		}
+		maps.Copy(secrets, values)
+	}
+	// resolve the ciphertexts and parameters first, so a value can embed them together with secret keys.
+	// Nothing is appended to env until the secret store is read, so a failed attempt does not leave them in env
+	references = resolveReferences(references, secrets)
+	unresolvedCiphertexts, references := splitKMSReferences(references)
+	unresolvedParameters, references := splitSSMReferences(references)
+	if !slices.ContainsFunc(secretKeys(references), func(key string) bool { return !isGeneratedReference(key) }) {
+		// no secret store is needed when the pod references KMS ciphertexts, SSM parameters or generated credentials only
+		doSanitize(references, env, nil)
+	} else if err := injectSecretStore(references, env); err != nil {
+		return err
+	}
+	doSanitize(unresolvedCiphertexts, env, nil)
+	doSanitize(unresolvedParameters, env, nil)
+	return nil
+}
+
+// injectSecretStore reads the secrets of the references from the secret store of the pod
+func injectSecretStore(references map[string]string, env *sanitizedEnv) error {
+	if os.Getenv("PIGGY_GCP_SECRET_NAME") != "" {
+		return standaloneError(injectGCPSecret(references, env))
+	}
+	if os.Getenv("PIGGY_AZURE_KEY_VAULT_NAME") != "" {
+		return standaloneError(injectAzureSecret(references, env))
+	}
 	ssmPath := os.Getenv("PIGGY_AWS_SSM_PARAMETER_PATH")
 	if ssmPath == "" {
-		return injectSecrets(references, env)
+		return standaloneError(injectSecrets(references, env))
 	}
-	return injectParameters(references, env)
+	return standaloneError(injectParameters(references, env))
 }
 
 func injectParameters(references map[string]string, env *sanitizedEnv) error {
@@ -123,9 +321,12 @@ func injectParameters(references map[string]string, env *sanitizedEnv) error {
 		return err
 	}
 	pm := ssm.NewFromConfig(cfg)
+	mode := os.Getenv("PIGGY_AWS_SSM_PARAMETER_KEY")
+	separator := os.Getenv("PIGGY_AWS_SSM_PARAMETER_SEPARATOR")
 	// Get parameter values
 	var nextToken *string
 	secrets := make(map[string]string)
+	names := make(map[string]string) // parameter name of each key
 	for {
 		input := &ssm.GetParametersByPathInput{
 			Path:           aws.String(ssmPath),
@@ -139,8 +340,18 @@ func injectParameters(references map[string]string, env *sanitizedEnv) error {
 			return err
 		}
 		for _, param := range output.Parameters {
-			name := filepath.Base(*param.Name)
-			secrets[name] = *param.Value
+			key, err := ssmParameterKey(ssmPath, *param.Name, mode, separator)
+			if err != nil {
+				return err
+			}
+			if other, ok := names[key]; ok {
+				if mode == "path" {
+					return &permanentError{err: fmt.Errorf("ssm parameters %s and %s map to the same key [%s]", other, *param.Name, key)}
+				}
+				log.Warn().Msgf("SSM parameter %s overwrites %s of the same key [%s]", *param.Name, other, key)
+			}
+			names[key] = *param.Name
+			secrets[key] = *param.Value
 		}
 		if output.NextToken == nil {
 			break
@@ -151,12 +362,28 @@ func injectParameters(references map[string]string, env *sanitizedEnv) error {
 	return nil
 }
 
+// ssmParameterKey returns the secret key of an SSM parameter under the path. The key is the basename of the parameter
+// by default, or the path relative to the parameter path joined with the separator e.g. `/app/db/password` under `/app` is `db_password`
+func ssmParameterKey(path string, name string, mode string, separator string) (string, error) {
+	switch mode {
+	case "", "basename":
+		return filepath.Base(name), nil
+	case "path":
+		if separator == "" {
+			separator = "_"
+		}
+		relative := strings.TrimPrefix(strings.TrimPrefix(name, strings.TrimSuffix(path, "/")), "/")
+		return strings.ReplaceAll(relative, "/", separator), nil
+	}
+	return "", &permanentError{err: fmt.Errorf("invalid ssm parameter key [%s], expecting basename or path", mode)}
+}
+
 func injectSecrets(references map[string]string, env *sanitizedEnv) error {
 	secretName := os.Getenv("PIGGY_AWS_SECRET_NAME")       // "exp/sample/test"
 	region := os.Getenv("PIGGY_AWS_REGION")                // "ap-southeast-1"
 	secretVersion := os.Getenv("PIGGY_AWS_SECRET_VERSION") // "AWS_CURRENT"
-	if secretName == "" {
-		secretVersion = "AWS_CURRENT"
+	if secretVersion == "" {
+		secretVersion = "AWSCURRENT"
 	}
 
 	// secretName := "exp/sample/test"
@@ -201,90 +428,522 @@ func injectSecrets(references map[string]string, env *sanitizedEnv) error {
 }
 
 type GetSecretPayload struct {
-	Resources string `json:"resources"`
-	Name      string `json:"name"`
-	UID       string `json:"uid"`
-	Signature string `json:"signature"`
+	Resources  string   `json:"resources"`
+	Name       string   `json:"name"`
+	UID        string   `json:"uid"`
+	Signature  string   `json:"signature"`
+	References []string `json:"references,omitempty"`
 }
 
-func requestSecrets(references map[string]string, env *sanitizedEnv, sig []byte) error {
-	address := os.Getenv("PIGGY_ADDRESS")
-	skipVerifyTLS := true
+// piggyReferences returns sorted secret keys referenced with `piggy:` or embedded `${piggy:}`
+func piggyReferences(references map[string]string) []string {
+	var keys []string
+	for _, refValue := range references {
+		for _, key := range referenceKeys(refValue) {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// newTLSConfig create a TLS config for connecting to piggy-webhooks.
+// The server is verified against PIGGY_CA_BUNDLE when supplied, and a client certificate
+// is presented when PIGGY_TLS_CLIENT_CERT_FILE and PIGGY_TLS_CLIENT_KEY_FILE are supplied
+func newTLSConfig() (*tls.Config, error) {
+	caBundle := os.Getenv("PIGGY_CA_BUNDLE")
+	skipVerifyTLS := caBundle == ""
 	if os.Getenv("PIGGY_SKIP_VERIFY_TLS") != "" {
 		skipVerifyTLS, _ = strconv.ParseBool(os.Getenv("PIGGY_SKIP_VERIFY_TLS"))
 	}
+	// #nosec G402 possible self-sign
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipVerifyTLS}
+	if caBundle != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caBundle)) {
+			return nil, errors.New("no certificate found in PIGGY_CA_BUNDLE")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certFile := os.Getenv("PIGGY_TLS_CLIENT_CERT_FILE")
+	keyFile := os.Getenv("PIGGY_TLS_CLIENT_KEY_FILE")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// retryAfterError when piggy-webhooks asks to retry later
+type retryAfterError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or HTTP date. The delay is limited to maxRetryAfter
+func parseRetryAfter(value string) time.Duration {
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	}
+	if delay < retryDelay {
+		return retryDelay
+	}
+	if delay > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return delay
+}
+
+// permanentError when retrying will not succeed e.g. unauthorized or secret not found
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// backoff computes exponential waits with jitter between retries
+type backoff struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	maxElapsedTime  time.Duration // 0 retries without time limit
+	interval        time.Duration
+	start           time.Time
+	now             func() time.Time
+	jitter          func(time.Duration) time.Duration
+}
+
+// envDuration reads a duration from the env or returns the default value
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Info().Msgf("Invalid %s value. [%s]", name, value)
+		return defaultValue
+	}
+	return d
+}
+
+// newBackoff creates a backoff from PIGGY_RETRY_INITIAL_INTERVAL, PIGGY_RETRY_MAX_INTERVAL and PIGGY_RETRY_MAX_ELAPSED_TIME
+func newBackoff() *backoff {
+	b := &backoff{
+		initialInterval: envDuration("PIGGY_RETRY_INITIAL_INTERVAL", retryDelay),
+		maxInterval:     envDuration("PIGGY_RETRY_MAX_INTERVAL", maxRetryInterval),
+		maxElapsedTime:  envDuration("PIGGY_RETRY_MAX_ELAPSED_TIME", 0),
+		now:             time.Now,
+		jitter: func(d time.Duration) time.Duration {
+			if d <= 0 {
+				return 0
+			}
+			// #nosec G404 jitter does not need a secure random number
+			return rand.N(d)
+		},
+	}
+	if b.maxInterval < b.initialInterval {
+		b.maxInterval = b.initialInterval
+	}
+	b.interval = b.initialInterval
+	b.start = b.now()
+	return b
+}
+
+// next returns how long to wait before retrying after the error, or false if it should give up.
+// The wait doubles on each retry and is randomized between half and the full interval.
+// A Retry-After asked by piggy-webhooks is honored if it is longer
+func (b *backoff) next(err error) (time.Duration, bool) {
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		return 0, false
+	}
+	wait := b.interval/2 + b.jitter(b.interval/2)
+	b.interval = min(b.interval*2, b.maxInterval)
+	var retryErr *retryAfterError
+	if errors.As(err, &retryErr) && retryErr.retryAfter > wait {
+		wait = retryErr.retryAfter
+	}
+	if b.maxElapsedTime > 0 && b.now().Add(wait).Sub(b.start) > b.maxElapsedTime {
+		return 0, false
+	}
+	return wait, true
+}
+
+var sleep = time.Sleep
+
+// retry calls fn until it succeeds, fails permanently, runs out of attempts or exceeds the max elapsed time.
+// Returns the error of each attempt and the last error, nil if it succeeded
+func retry(numberOfRetry int, b *backoff, fn func() error) ([]string, error) {
+	var results []string
+	var err error
+	if numberOfRetry < 1 {
+		// a request must be attempted, otherwise no secrets would be read without an error
+		err = &permanentError{err: fmt.Errorf("invalid number of retry %d, expecting integer > 0", numberOfRetry)}
+		return []string{err.Error()}, err
+	}
+	for i := 0; i < numberOfRetry; i++ {
+		log.Debug().Msgf("Retry %d/%d", (i + 1), numberOfRetry)
+		if err = fn(); err == nil {
+			return results, nil
+		}
+		results = append(results, fmt.Sprintf("Retry %d/%d [error=%s]", (i+1), numberOfRetry, err.Error()))
+		if i+1 == numberOfRetry {
+			break
+		}
+		wait, ok := b.next(err)
+		if !ok {
+			log.Debug().Msgf("Giving up retrying [error=%s]", err.Error())
+			break
+		}
+		sleep(wait)
+	}
+	return results, err
+}
+
+// envNumberOfRetry returns PIGGY_NUMBER_OF_RETRY, or the default value if it is not set or invalid
+func envNumberOfRetry(defaultValue int) int {
+	if os.Getenv("PIGGY_NUMBER_OF_RETRY") == "" {
+		return defaultValue
+	}
+	i64, err := strconv.ParseInt(os.Getenv("PIGGY_NUMBER_OF_RETRY"), 10, 0)
+	if err != nil || i64 < 1 {
+		log.Info().Msgf("Invalid PIGGY_NUMBER_OF_RETRY value. Expecting integer > 0, using %d", defaultValue)
+		return defaultValue
+	}
+	return int(i64)
+}
+
+// secretSource reads secrets in a mode
+type secretSource struct {
+	mode  string
+	fetch func() error
+}
+
+// canFailover whether to read secrets from the next source after the error.
+// piggy-env does not fail over after piggy-webhooks rejects the request, so failover can not bypass its authorization
+func canFailover(source secretSource, err error) bool {
+	var permErr *permanentError
+	return source.mode != "proxy" || !errors.As(err, &permErr)
+}
+
+// readSecrets reads secrets from the first source, then from the next sources after failing over.
+// Returns the mode supplying the secrets, or an empty string and the error of each attempt
+func readSecrets(numberOfRetry int, sources []secretSource) (string, []string) {
+	var retryResults []string
+	for i, source := range sources {
+		if i > 0 {
+			log.Warn().Msgf("Failing over to %s mode", source.mode)
+		}
+		log.Debug().Msgf("Running in %s mode", source.mode)
+		results, err := retry(numberOfRetry, newBackoff(), source.fetch)
+		if err == nil {
+			return source.mode, nil
+		}
+		for _, result := range results {
+			retryResults = append(retryResults, fmt.Sprintf("[%s] %s", source.mode, result))
+		}
+		if !canFailover(source, err) {
+			break
+		}
+	}
+	return "", retryResults
+}
+
+// newResolver returns a DNS resolver using PIGGY_DNS_RESOLVER network and PIGGY_DNS_SERVER address, or the default resolver
+func newResolver() *net.Resolver {
+	dnsResolver := os.Getenv("PIGGY_DNS_RESOLVER")
+	if _, ok := golangNetwork[dnsResolver]; !ok {
+		dnsResolver = ""
+	}
+	dnsServer := os.Getenv("PIGGY_DNS_SERVER")
+	if dnsServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			// default DNS port
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+	}
+	if dnsResolver == "" && dnsServer == "" {
+		return net.DefaultResolver
+	}
+	log.Info().Msgf("Using DNS Resolver %s %s", dnsResolver, dnsServer)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if dnsResolver != "" {
+				network = dnsResolver
+			}
+			if dnsServer != "" {
+				address = dnsServer
+			}
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// sortIPs orders addresses of the preferred IP family `ipv4` or `ipv6` first
+func sortIPs(ips []net.IPAddr, prefer string) {
+	isPreferred := func(ip net.IPAddr) bool {
+		return (ip.IP.To4() != nil) == (prefer == "ipv4")
+	}
+	slices.SortStableFunc(ips, func(a, b net.IPAddr) int {
+		if isPreferred(a) == isPreferred(b) {
+			return 0
+		} else if isPreferred(a) {
+			return -1
+		}
+		return 1
+	})
+}
+
+// newDialContext returns a dial function using PIGGY_IP_FAMILY. `ipv4` and `ipv6` dial only the IP family,
+// `prefer-ipv4` and `prefer-ipv6` dial addresses of the IP family first
+func newDialContext(dialer *net.Dialer, resolver *net.Resolver, ipFamily string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch ipFamily {
+	case "ipv4", "ipv6":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp"+strings.TrimPrefix(ipFamily, "ipv"), addr)
+		}
+	case "prefer-ipv4", "prefer-ipv6":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			sortIPs(ips, strings.TrimPrefix(ipFamily, "prefer-"))
+			for _, ip := range ips {
+				var conn net.Conn
+				if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		}
+	}
+	return dialer.DialContext
+}
+
+// newProxy returns a proxy function using PIGGY_HTTP_PROXY and PIGGY_NO_PROXY, or no proxy
+func newProxy() func(*http.Request) (*url.URL, error) {
+	proxy := os.Getenv("PIGGY_HTTP_PROXY")
+	if proxy == "" {
+		return nil
+	}
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  proxy,
+		HTTPSProxy: proxy,
+		NoProxy:    os.Getenv("PIGGY_NO_PROXY"),
+	}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
+
+// newTransport creates a transport to piggy-webhooks with PIGGY_CONNECT_TIMEOUT, PIGGY_TLS_HANDSHAKE_TIMEOUT,
+// PIGGY_IP_FAMILY and the proxy
+func newTransport(tlsConfig *tls.Config, resolver *net.Resolver) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:  envDuration("PIGGY_CONNECT_TIMEOUT", connectTimeout),
+		Resolver: resolver,
+	}
+	return &http.Transport{
+		Proxy:               newProxy(),
+		DialContext:         newDialContext(dialer, resolver, os.Getenv("PIGGY_IP_FAMILY")),
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: envDuration("PIGGY_TLS_HANDSHAKE_TIMEOUT", tlsHandshakeTimeout),
+	}
+}
 
-	log.Debug().Msgf("Address: %s", address)
+// piggyAddress a piggy-webhooks address. The server certificate is verified against serverName if it is set
+type piggyAddress struct {
+	url        string
+	serverName string
+}
 
+// piggyAddresses returns piggy-webhooks addresses from a comma separated list of URLs or `srv://` names.
+// A `srv://` name is resolved by DNS SRV lookup into https addresses sorted by priority and weight. SRV targets are
+// verified against the service name e.g. `piggy-webhooks.piggy-webhooks.svc.cluster.local` of
+// `srv://_https._tcp.piggy-webhooks.piggy-webhooks.svc.cluster.local`, as the webhook certificate is issued for the service.
+// The addresses are shuffled if order is `random`
+func piggyAddresses(ctx context.Context, value string, order string, lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)) []piggyAddress {
+	var addresses []piggyAddress
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		name, isSRV := strings.CutPrefix(address, PrefixSRV)
+		if !isSRV {
+			addresses = append(addresses, piggyAddress{url: address})
+			continue
+		}
+		_, records, err := lookupSRV(ctx, "", "", name)
+		if err != nil {
+			log.Error().Msgf("Error while resolving %s [%v]", address, err)
+			continue
+		}
+		serverName := srvServiceName(name)
+		for _, record := range records {
+			host := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+			addresses = append(addresses, piggyAddress{url: "https://" + host, serverName: serverName})
+		}
+	}
+	if order == "random" {
+		// #nosec G404 shuffling addresses does not need a secure random number
+		rand.Shuffle(len(addresses), func(i, j int) {
+			addresses[i], addresses[j] = addresses[j], addresses[i]
+		})
+	}
+	return addresses
+}
+
+// srvServiceName returns the domain name of a SRV name without the `_service._proto.` labels
+func srvServiceName(name string) string {
+	for strings.HasPrefix(name, "_") {
+		_, rest, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = rest
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// newClient creates an HTTP client to a piggy-webhooks address verified against serverName if it is set
+func newClient(tlsConfig *tls.Config, resolver *net.Resolver, serverName string) *http.Client {
+	if serverName != "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = serverName
+	}
+	return &http.Client{Transport: newTransport(tlsConfig, resolver)}
+}
+
+func requestSecrets(references map[string]string, env *sanitizedEnv, sig []byte) error {
 	var serviceToken string
-	b, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
+	// a projected token bound to piggy-webhooks audience, or the pod default token
+	tokenFile := os.Getenv("PIGGY_TOKEN_FILE")
+	if tokenFile == "" {
+		tokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	b, err := os.ReadFile(filepath.Clean(tokenFile))
 	if err != nil {
 		return fmt.Errorf("failed to get token %v", err)
 	}
 	serviceToken = string(b)
 
 	payload := GetSecretPayload{
-		Name:      os.Getenv("PIGGY_POD_NAME"),
-		Resources: "pods",
-		UID:       os.Getenv("PIGGY_UID"),
-		Signature: fmt.Sprintf("%x", sig),
+		Name:       os.Getenv("PIGGY_POD_NAME"),
+		Resources:  "pods",
+		UID:        os.Getenv("PIGGY_UID"),
+		Signature:  fmt.Sprintf("%x", sig),
+		References: piggyReferences(references),
 	}
 	b, err = json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("invalid payload %v", err)
 	}
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/secret", address), bytes.NewBuffer(b))
-	req.Header.Add("X-Token", serviceToken)
+	tlsConfig, err := newTLSConfig()
 	if err != nil {
-		return fmt.Errorf("error while creating request %v", err)
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	tr := &http.Transport{
-		// #nosec G402 possible self-sign
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: skipVerifyTLS},
+	resolver := newResolver()
+	timeout := envDuration("PIGGY_ADDRESS_TIMEOUT", addressTimeout)
+	ctx := context.Background()
+	if d := envDuration("PIGGY_REQUEST_TIMEOUT", requestTimeout); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
 	}
-	client := &http.Client{Transport: tr}
-	dnsResolver := os.Getenv("PIGGY_DNS_RESOLVER")
-	if _, ok := golangNetwork[dnsResolver]; ok {
-		log.Info().Msgf("Using DNS Resolver %s", dnsResolver)
-		dialer := &net.Dialer{
-			Resolver: &net.Resolver{
-				PreferGo: true,
-				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-					d := net.Dialer{}
-					return d.DialContext(ctx, dnsResolver, address)
-				},
-			},
-		}
-		client.Transport.(*http.Transport).DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			c, err := tls.DialWithDialer(dialer, network, addr, client.Transport.(*http.Transport).TLSClientConfig)
-			if err != nil {
-				return nil, err
-			}
-			return c, c.Handshake()
+
+	addresses := piggyAddresses(ctx, os.Getenv("PIGGY_ADDRESS"), os.Getenv("PIGGY_ADDRESS_ORDER"), resolver.LookupSRV)
+	if len(addresses) == 0 {
+		return fmt.Errorf("no piggy-webhooks address")
+	}
+	var secrets map[string]string
+	for _, address := range addresses {
+		log.Debug().Msgf("Address: %s", address.url)
+		client := newClient(tlsConfig, resolver, address.serverName)
+		if secrets, err = requestAddress(ctx, client, address.url, timeout, serviceToken, b); err == nil {
+			break
 		}
+		var permErr *permanentError
+		var retryErr *retryAfterError
+		if errors.As(err, &permErr) || errors.As(err, &retryErr) {
+			return err
+		}
+		log.Info().Msgf("Request to %s failed [%v]", address.url, err)
+	}
+	if err != nil {
+		return err
 	}
+	doSanitize(references, env, secrets)
+	return nil
+}
 
+// requestAddress requests secrets from a piggy-webhooks address
+func requestAddress(ctx context.Context, client *http.Client, address string, timeout time.Duration, serviceToken string, payload []byte) (map[string]string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/secret", address), bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error while creating request %v", err)
+	}
+	req.Header.Add("X-Token", serviceToken)
+	req.Header.Set("Content-Type", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error while requesting secret %v", err)
+		return nil, fmt.Errorf("error while requesting secret %v", err)
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("error while reading secret %v", err)
+		return nil, fmt.Errorf("error while reading secret %v", err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &retryAfterError{
+			err:        fmt.Errorf("error while requesting secret %v", string(body)),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error while requesting secret %v", string(body))
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return nil, &permanentError{err: fmt.Errorf("error while requesting secret %v", string(body))}
+	default:
+		return nil, fmt.Errorf("error while requesting secret %v", string(body))
 	}
 	var secrets map[string]string
 	if err := json.Unmarshal(body, &secrets); err != nil {
-		return fmt.Errorf("error while translating secret %v", err)
+		return nil, fmt.Errorf("error while translating secret %v", err)
 	}
-	doSanitize(references, env, secrets)
-	return nil
+	return secrets, nil
 }
 
 func install(src, dst string) error {
@@ -408,14 +1067,7 @@ func main() {
 			log.Info().Msgf("Invalid PIGGY_INITIAL_DELAY value. [%s]", err)
 		}
 	}
-	if os.Getenv("PIGGY_NUMBER_OF_RETRY") != "" {
-		var i64 int64
-		var err error
-		if i64, err = strconv.ParseInt(os.Getenv("PIGGY_NUMBER_OF_RETRY"), 10, 0); err != nil || i64 < 1 {
-			log.Info().Msgf("Invalid PIGGY_NUMBER_OF_RETRY value. Expecting integer > 0")
-		}
-		numberOfRetry = int(i64)
-	}
+	numberOfRetry = envNumberOfRetry(numberOfRetry)
 
 	// start the piggy
 	osEnv := make(map[string]string, len(os.Environ()))
@@ -434,39 +1086,36 @@ func main() {
 	if os.Getenv("PIGGY_IGNORE_NO_ENV") != "" {
 		ignoreNoEnv, _ = strconv.ParseBool(os.Getenv("PIGGY_IGNORE_NO_ENV"))
 	}
-	retryResults := make([]string, numberOfRetry)
-	success := false
+	failover, _ := strconv.ParseBool(os.Getenv("PIGGY_FAILOVER"))
+	standaloneSource := secretSource{mode: "standalone", fetch: func() error {
+		return inject(osEnv, &sanitized)
+	}}
+	proxySource := secretSource{mode: "proxy", fetch: func() error {
+		sig := strings.TrimSpace(strings.Join(cmdArgs, " "))
+		sum := sha256.Sum256([]byte(sig))
+		return requestSecrets(osEnv, &sanitized, sum[:])
+	}}
+	sources := []secretSource{proxySource}
 	if standalone {
-		log.Debug().Msgf("Running in standalone mode")
-		for i := 0; !success && i < numberOfRetry; i++ {
-			log.Debug().Msgf("Retry %d/%d", (i + 1), numberOfRetry)
-			if e := inject(osEnv, &sanitized); e != nil {
-				retryResults[i] = fmt.Sprintf("Retry %d/%d [error=%s]", (i + 1), numberOfRetry, e.Error())
-				time.Sleep(500 * time.Millisecond)
-			} else {
-				log.Info().Msg("Request secrets was successful")
-				break
-			}
+		sources = []secretSource{standaloneSource}
+	}
+	if failover {
+		if standalone && os.Getenv("PIGGY_ADDRESS") != "" {
+			sources = append(sources, proxySource)
+		} else if !standalone && (os.Getenv("PIGGY_AWS_SECRET_NAME") != "" || os.Getenv("PIGGY_AWS_SSM_PARAMETER_PATH") != "" || os.Getenv("PIGGY_GCP_SECRET_NAME") != "" || os.Getenv("PIGGY_AZURE_KEY_VAULT_NAME") != "") {
+			sources = append(sources, standaloneSource)
 		}
-	} else {
-		log.Debug().Msgf("Running in proxy mode")
-		sig := strings.TrimSpace(strings.Join(cmdArgs, " "))
-		h := sha256.New()
-		_, err := h.Write([]byte(sig))
+	}
+	mode, retryResults := readSecrets(numberOfRetry, sources)
+	success := mode != ""
+	if success {
+		log.Info().Msgf("Request secrets was successful in %s mode", mode)
+		results, err := retry(numberOfRetry, newBackoff(), func() error {
+			return generateCredentials(&sanitized)
+		})
 		if err != nil {
-			log.Error().Msgf("%v", err)
-		}
-		sum := h.Sum(nil)
-		for i := 0; !success && i < numberOfRetry; i++ {
-			log.Debug().Msgf("Retry %d/%d", (i + 1), numberOfRetry)
-			if e := requestSecrets(osEnv, &sanitized, sum); e != nil {
-				retryResults[i] = fmt.Sprintf("Retry %d/%d [error=%s]", (i + 1), numberOfRetry, e.Error())
-				time.Sleep(500 * time.Millisecond)
-			} else {
-				success = true
-				log.Info().Msg("Request secrets was successful")
-				break
-			}
+			success = false
+			retryResults = append(retryResults, results...)
 		}
 	}
 	if !success {
@@ -480,11 +1129,14 @@ func main() {
 	if !ignoreNoEnv {
 		for _, v := range sanitized.Env {
 			split := strings.SplitN(v, "=", 2)
-			if strings.HasPrefix(strings.ToUpper(split[1]), strings.ToUpper(PrefixPiggy)) {
+			if hasUnresolvedReference(split[1]) {
 				log.Fatal().Msgf("[%s] not found", split[0])
 			}
 		}
 	}
+	for i, v := range sanitized.Env {
+		sanitized.Env[i] = unescapeReferences(v)
+	}
 	entrypointCmd := cmdArgs
 	cmd, err := exec.LookPath(entrypointCmd[0])
 	if err != nil {
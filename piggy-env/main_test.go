@@ -1,8 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/smithy-go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -40,8 +52,546 @@ func TestDoSanitize(t *testing.T) {
 	assert.Contains(t, env.Env, "NORMAL=value")
 }
 
+// TestDoSanitize_Embedded checks expanding references embedded in values and keeping escaped references.
+func TestDoSanitize_Embedded(t *testing.T) {
+	references := map[string]string{
+		"DATABASE_URL": "postgres://${piggy:db-user}:${piggy:db-pass}@db:5432/app",
+		"LITERAL":      "$${piggy:db-pass}",
+		"MISSING":      "key=${piggy:missing}",
+	}
+	secrets := map[string]string{
+		"db-user": "app",
+		"db-pass": "secret123",
+	}
+	assert.Equal(t, []string{"db-pass", "db-user", "missing"}, piggyReferences(references))
+
+	env := &sanitizedEnv{}
+	doSanitize(references, env, secrets)
+	assert.ElementsMatch(t, []string{
+		"DATABASE_URL=postgres://app:secret123@db:5432/app",
+		"LITERAL=$${piggy:db-pass}",
+		"MISSING=key=${piggy:missing}",
+	}, env.Env)
+
+	assert.False(t, hasUnresolvedReference("postgres://app:secret123@db:5432/app"))
+	assert.False(t, hasUnresolvedReference("$${piggy:db-pass}"))
+	assert.True(t, hasUnresolvedReference("key=${piggy:missing}"))
+	assert.True(t, hasUnresolvedReference("PIGGY:db-pass"))
+	assert.Equal(t, "LITERAL=${piggy:db-pass} and $x", unescapeReferences("LITERAL=$${piggy:db-pass} and $x"))
+
+	// Case 2: Resolve some references, leaving the others to the secret store
+	resolved := resolveReferences(map[string]string{
+		"DATABASE_URL": "postgres://${piggy:kms:AQID}:${piggy:db-pass}@db:5432/app",
+		"API_KEY":      "piggy:kms:AQID",
+	}, map[string]string{"kms:AQID": "app"})
+	assert.Equal(t, map[string]string{
+		"DATABASE_URL": "postgres://app:${piggy:db-pass}@db:5432/app",
+		"API_KEY":      "app",
+	}, resolved)
+}
+
+// TestPiggyReferences verifies that references are unique and sorted so they match the signed keys.
+func TestPiggyReferences(t *testing.T) {
+	references := map[string]string{
+		"DB_PASS":   "piggy:db-pass",
+		"DB_PASS_2": "piggy:db-pass",
+		"API_KEY":   "piggy:api-key",
+		"NORMAL":    "value",
+	}
+	assert.Equal(t, []string{"api-key", "db-pass"}, piggyReferences(references))
+	assert.Nil(t, piggyReferences(map[string]string{"NORMAL": "value"}))
+}
+
+// TestSSMParameterKey verifies mapping SSM parameter names to secret keys.
+func TestSSMParameterKey(t *testing.T) {
+	key, err := ssmParameterKey("/app", "/app/db/password", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "password", key)
+	key, err = ssmParameterKey("/app", "/app/db/password", "path", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "db_password", key)
+	key, err = ssmParameterKey("/app/", "/app/db/password", "path", ".")
+	assert.NoError(t, err)
+	assert.Equal(t, "db.password", key)
+	_, err = ssmParameterKey("/app", "/app/db/password", "relative", "")
+	var permErr *permanentError
+	assert.ErrorAs(t, err, &permErr)
+}
+
 // TestAwsErr ensures that a nil error returns false for being an AWS API error.
 func TestAwsErr(t *testing.T) {
 	assert.False(t, awsErr(nil))
 	// We can't easily mock smithy.APIError without more imports, but nil case is fine
 }
+
+// TestNewTLSConfig verifies that the server is verified only when a CA bundle is supplied.
+func TestNewTLSConfig(t *testing.T) {
+	// Case 1: No CA bundle, skip verify by default
+	tlsConfig, err := newTLSConfig()
+	assert.NoError(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.RootCAs)
+
+	// Case 2: CA bundle is supplied, verify the server
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	t.Setenv("PIGGY_CA_BUNDLE", string(caBundle))
+	tlsConfig, err = newTLSConfig()
+	assert.NoError(t, err)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get(srv.URL)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+
+	// Case 3: Invalid CA bundle
+	t.Setenv("PIGGY_CA_BUNDLE", "invalid")
+	_, err = newTLSConfig()
+	assert.Error(t, err)
+
+	// Case 4: Missing client certificate
+	t.Setenv("PIGGY_CA_BUNDLE", "")
+	t.Setenv("PIGGY_TLS_CLIENT_CERT_FILE", "/non-existent/tls.crt")
+	t.Setenv("PIGGY_TLS_CLIENT_KEY_FILE", "/non-existent/tls.key")
+	_, err = newTLSConfig()
+	assert.Error(t, err)
+}
+
+// TestParseRetryAfter verifies that Retry-After is honored within limits.
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 2*time.Second, parseRetryAfter("2"))
+	assert.Equal(t, retryDelay, parseRetryAfter("0"))
+	assert.Equal(t, retryDelay, parseRetryAfter("invalid"))
+	assert.Equal(t, maxRetryAfter, parseRetryAfter("3600"))
+	date := time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	assert.InDelta(t, 10*time.Second, parseRetryAfter(date), float64(2*time.Second))
+}
+
+// TestRequestSecrets_TooManyRequests verifies that a 429 response asks to retry after the Retry-After header.
+func TestRequestSecrets_TooManyRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("token"), 0600))
+	t.Setenv("PIGGY_ADDRESS", server.URL)
+	t.Setenv("PIGGY_TOKEN_FILE", tokenFile)
+
+	err := requestSecrets(map[string]string{}, &sanitizedEnv{}, nil)
+	assert.Error(t, err)
+	var retryErr *retryAfterError
+	assert.ErrorAs(t, err, &retryErr)
+	assert.Equal(t, 3*time.Second, retryErr.retryAfter)
+}
+
+// TestRequestSecrets_Permanent verifies that authorization and not found responses are not retried.
+func TestRequestSecrets_Permanent(t *testing.T) {
+	status := http.StatusForbidden
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("token"), 0600))
+	t.Setenv("PIGGY_ADDRESS", server.URL)
+	t.Setenv("PIGGY_TOKEN_FILE", tokenFile)
+
+	var permErr *permanentError
+	for _, status = range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		err := requestSecrets(map[string]string{}, &sanitizedEnv{}, nil)
+		assert.ErrorAs(t, err, &permErr, status)
+	}
+	for _, status = range []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		err := requestSecrets(map[string]string{}, &sanitizedEnv{}, nil)
+		assert.Error(t, err)
+		assert.False(t, errors.As(err, &permErr), status)
+	}
+}
+
+// TestStandaloneError verifies that missing secrets and denied access are not retried.
+func TestStandaloneError(t *testing.T) {
+	var permErr *permanentError
+	for _, code := range []string{"ResourceNotFoundException", "ParameterNotFound", "AccessDeniedException"} {
+		err := standaloneError(&smithy.GenericAPIError{Code: code})
+		assert.ErrorAs(t, err, &permErr, code)
+	}
+	err := standaloneError(&smithy.GenericAPIError{Code: "ThrottlingException"})
+	assert.False(t, errors.As(err, &permErr))
+	assert.Nil(t, standaloneError(nil))
+}
+
+func newTestBackoff(initial, max, maxElapsed time.Duration) (*backoff, *time.Time) {
+	now := time.Unix(0, 0)
+	b := &backoff{
+		initialInterval: initial,
+		maxInterval:     max,
+		maxElapsedTime:  maxElapsed,
+		interval:        initial,
+		start:           now,
+		now:             func() time.Time { return now },
+		jitter:          func(d time.Duration) time.Duration { return d },
+	}
+	return b, &now
+}
+
+// TestBackoff verifies that the wait doubles up to the max interval and honors Retry-After.
+func TestBackoff(t *testing.T) {
+	b, _ := newTestBackoff(time.Second, 5*time.Second, 0)
+	var waits []time.Duration
+	for i := 0; i < 5; i++ {
+		wait, ok := b.next(errors.New("connection refused"))
+		assert.True(t, ok)
+		waits = append(waits, wait)
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, waits)
+
+	// Retry-After is longer than the backoff
+	wait, ok := b.next(&retryAfterError{err: errors.New("too many requests"), retryAfter: 30 * time.Second})
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	// Permanent errors are not retried
+	_, ok = b.next(&permanentError{err: errors.New("forbidden")})
+	assert.False(t, ok)
+
+	// Jitter keeps at least half of the interval
+	b, _ = newTestBackoff(time.Second, 5*time.Second, 0)
+	b.jitter = func(d time.Duration) time.Duration { return 0 }
+	wait, _ = b.next(errors.New("connection refused"))
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Give up after the max elapsed time
+	b, now := newTestBackoff(time.Second, 5*time.Second, 10*time.Second)
+	_, ok = b.next(errors.New("connection refused"))
+	assert.True(t, ok)
+	*now = now.Add(9 * time.Second)
+	_, ok = b.next(errors.New("connection refused"))
+	assert.False(t, ok)
+}
+
+// TestNewBackoff verifies that the backoff is configured from the env.
+func TestNewBackoff(t *testing.T) {
+	b := newBackoff()
+	assert.Equal(t, retryDelay, b.initialInterval)
+	assert.Equal(t, maxRetryInterval, b.maxInterval)
+	assert.Equal(t, time.Duration(0), b.maxElapsedTime)
+
+	t.Setenv("PIGGY_RETRY_INITIAL_INTERVAL", "2s")
+	t.Setenv("PIGGY_RETRY_MAX_INTERVAL", "1s")
+	t.Setenv("PIGGY_RETRY_MAX_ELAPSED_TIME", "invalid")
+	b = newBackoff()
+	assert.Equal(t, 2*time.Second, b.initialInterval)
+	assert.Equal(t, 2*time.Second, b.maxInterval)
+	assert.Equal(t, time.Duration(0), b.maxElapsedTime)
+}
+
+// TestRetry verifies that retry stops on success, permanent errors and the number of retry.
+func TestRetry(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	// Case 1: Succeed on the third attempt
+	b, _ := newTestBackoff(time.Second, 5*time.Second, 0)
+	calls := 0
+	results, err := retry(5, b, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, slept)
+
+	// Case 2: Permanent error is not retried
+	b, _ = newTestBackoff(time.Second, 5*time.Second, 0)
+	calls, slept = 0, nil
+	results, err = retry(5, b, func() error {
+		calls++
+		return &permanentError{err: errors.New("forbidden")}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, []string{"Retry 1/5 [error=forbidden]"}, results)
+	assert.Empty(t, slept)
+
+	// Case 3: No wait after the last attempt
+	b, _ = newTestBackoff(time.Second, 5*time.Second, 0)
+	calls, slept = 0, nil
+	results, err = retry(3, b, func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	assert.EqualError(t, err, "connection refused")
+	assert.Equal(t, 3, calls)
+	assert.Len(t, results, 3)
+	assert.Len(t, slept, 2)
+
+	// Case 4: No attempt is an error
+	calls = 0
+	_, err = retry(0, b, func() error {
+		calls++
+		return nil
+	})
+	var permErr *permanentError
+	assert.ErrorAs(t, err, &permErr)
+	assert.Zero(t, calls)
+}
+
+// TestEnvNumberOfRetry verifies that an invalid PIGGY_NUMBER_OF_RETRY keeps the default, so secrets are still requested.
+func TestEnvNumberOfRetry(t *testing.T) {
+	assert.Equal(t, 1, envNumberOfRetry(1))
+	t.Setenv("PIGGY_NUMBER_OF_RETRY", "3")
+	assert.Equal(t, 3, envNumberOfRetry(1))
+	for _, value := range []string{"0", "-1", "abc"} {
+		t.Setenv("PIGGY_NUMBER_OF_RETRY", value)
+		assert.Equal(t, 1, envNumberOfRetry(1), value)
+	}
+
+	// PIGGY_NUMBER_OF_RETRY=0 still requests secrets
+	t.Setenv("PIGGY_NUMBER_OF_RETRY", "0")
+	called := false
+	mode, results := readSecrets(envNumberOfRetry(1), []secretSource{{mode: "proxy", fetch: func() error {
+		called = true
+		return nil
+	}}})
+	assert.True(t, called)
+	assert.Equal(t, "proxy", mode)
+	assert.Empty(t, results)
+
+	// readSecrets fails without an attempt
+	mode, results = readSecrets(0, []secretSource{{mode: "proxy", fetch: func() error { return nil }}})
+	assert.Equal(t, "", mode)
+	assert.Len(t, results, 1)
+}
+
+// TestReadSecrets verifies that secrets are read from the next source only when failing over is safe.
+func TestReadSecrets(t *testing.T) {
+	sleep = func(d time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+	failing := func(mode string, err error) secretSource {
+		return secretSource{mode: mode, fetch: func() error { return err }}
+	}
+	succeeding := func(mode string) secretSource {
+		return secretSource{mode: mode, fetch: func() error { return nil }}
+	}
+
+	// Case 1: The first source succeeds
+	mode, results := readSecrets(2, []secretSource{succeeding("proxy"), succeeding("standalone")})
+	assert.Equal(t, "proxy", mode)
+	assert.Empty(t, results)
+
+	// Case 2: piggy-webhooks is unreachable, fail over to standalone
+	mode, results = readSecrets(2, []secretSource{failing("proxy", errors.New("connection refused")), succeeding("standalone")})
+	assert.Equal(t, "standalone", mode)
+	assert.Empty(t, results)
+
+	// Case 3: piggy-webhooks rejects the request, do not fail over
+	mode, results = readSecrets(2, []secretSource{failing("proxy", &permanentError{err: errors.New("forbidden")}), succeeding("standalone")})
+	assert.Equal(t, "", mode)
+	assert.Equal(t, []string{"[proxy] Retry 1/2 [error=forbidden]"}, results)
+
+	// Case 4: Standalone fails over to proxy
+	mode, _ = readSecrets(2, []secretSource{failing("standalone", &permanentError{err: errors.New("access denied")}), succeeding("proxy")})
+	assert.Equal(t, "proxy", mode)
+
+	// Case 5: All sources fail
+	mode, results = readSecrets(1, []secretSource{failing("standalone", errors.New("timeout")), failing("proxy", errors.New("connection refused"))})
+	assert.Equal(t, "", mode)
+	assert.Equal(t, []string{"[standalone] Retry 1/1 [error=timeout]", "[proxy] Retry 1/1 [error=connection refused]"}, results)
+}
+
+// TestPiggyAddresses verifies that addresses are read from a list and DNS SRV records.
+func TestPiggyAddresses(t *testing.T) {
+	lookupSRV := func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_https._tcp.piggy.svc" {
+			return "", nil, errors.New("no such host")
+		}
+		return "", []*net.SRV{
+			{Target: "piggy-0.piggy.svc.", Port: 443},
+			{Target: "piggy-1.piggy.svc.", Port: 8443},
+		}, nil
+	}
+	ctx := context.Background()
+	assert.Equal(t, []piggyAddress{{url: "https://piggy"}}, piggyAddresses(ctx, "https://piggy", "", lookupSRV))
+	assert.Equal(t, []piggyAddress{{url: "https://a"}, {url: "https://b"}}, piggyAddresses(ctx, "https://a, https://b,", "", lookupSRV))
+	assert.Equal(t, []piggyAddress{
+		{url: "https://a"},
+		{url: "https://piggy-0.piggy.svc:443", serverName: "piggy.svc"},
+		{url: "https://piggy-1.piggy.svc:8443", serverName: "piggy.svc"},
+	}, piggyAddresses(ctx, "https://a,srv://_https._tcp.piggy.svc,srv://unknown", "", lookupSRV))
+	assert.ElementsMatch(t, []piggyAddress{{url: "https://a"}, {url: "https://b"}, {url: "https://c"}},
+		piggyAddresses(ctx, "https://a,https://b,https://c", "random", lookupSRV))
+	assert.Empty(t, piggyAddresses(ctx, "", "", lookupSRV))
+}
+
+// TestSRVServiceName verifies that the service and protocol labels are removed from SRV names.
+func TestSRVServiceName(t *testing.T) {
+	assert.Equal(t, "piggy-webhooks.piggy-webhooks.svc.cluster.local", srvServiceName("_https._tcp.piggy-webhooks.piggy-webhooks.svc.cluster.local."))
+	assert.Equal(t, "piggy.svc", srvServiceName("piggy.svc"))
+}
+
+// TestPiggyAddresses_VerifiedSRV verifies that SRV targets, which are not names of the server certificate,
+// are verified against the service name when PIGGY_CA_BUNDLE is supplied.
+func TestPiggyAddresses_VerifiedSRV(t *testing.T) {
+	// the test server certificate is issued for example.com and 127.0.0.1, but not localhost
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"DB_PASS": "secret"}`))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	lookupSRV := func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		p, _ := strconv.Atoi(port)
+		return "", []*net.SRV{{Target: "localhost.", Port: uint16(p)}}, nil
+	}
+	t.Setenv("PIGGY_CA_BUNDLE", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	tlsConfig, err := newTLSConfig()
+	assert.NoError(t, err)
+	ctx := context.Background()
+	addresses := piggyAddresses(ctx, "srv://_https._tcp.example.com", "", lookupSRV)
+	assert.Len(t, addresses, 1)
+	address := addresses[0]
+
+	// Case 1: The target is verified against the service name
+	secrets, err := requestAddress(ctx, newClient(tlsConfig, net.DefaultResolver, address.serverName), address.url, 0, "token", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"DB_PASS": "secret"}, secrets)
+
+	// Case 2: The target itself is not a name of the certificate
+	_, err = requestAddress(ctx, newClient(tlsConfig, net.DefaultResolver, ""), address.url, 0, "token", nil)
+	assert.ErrorContains(t, err, "certificate")
+}
+
+// TestRequestSecrets_MultipleAddresses verifies that the next address is requested only when an address is unavailable.
+func TestRequestSecrets_MultipleAddresses(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+	requested := 0
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested++
+		_, _ = w.Write([]byte(`{"DB_PASS": "secret"}`))
+	}))
+	defer healthy.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("token"), 0600))
+	t.Setenv("PIGGY_TOKEN_FILE", tokenFile)
+	t.Setenv("PIGGY_ADDRESS_TIMEOUT", "100ms")
+	references := map[string]string{"DB_PASS": "piggy:DB_PASS"}
+
+	// Case 1: Unavailable, slow and unreachable addresses are skipped
+	t.Setenv("PIGGY_ADDRESS", strings.Join([]string{closed.URL, unavailable.URL, slow.URL, healthy.URL}, ","))
+	env := &sanitizedEnv{}
+	assert.NoError(t, requestSecrets(references, env, nil))
+	assert.Equal(t, []string{"DB_PASS=secret"}, env.Env)
+	assert.Equal(t, 1, requested)
+
+	// Case 2: A rejected request is not sent to the next address
+	t.Setenv("PIGGY_ADDRESS", strings.Join([]string{forbidden.URL, healthy.URL}, ","))
+	var permErr *permanentError
+	assert.ErrorAs(t, requestSecrets(references, &sanitizedEnv{}, nil), &permErr)
+	assert.Equal(t, 1, requested)
+
+	// Case 3: All addresses are unavailable
+	t.Setenv("PIGGY_ADDRESS", strings.Join([]string{closed.URL, unavailable.URL}, ","))
+	assert.Error(t, requestSecrets(references, &sanitizedEnv{}, nil))
+
+	// Case 4: No address
+	t.Setenv("PIGGY_ADDRESS", "")
+	assert.Error(t, requestSecrets(references, &sanitizedEnv{}, nil))
+}
+
+// TestSortIPs verifies that addresses of the preferred IP family are dialed first.
+func TestSortIPs(t *testing.T) {
+	ips := []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("fd00::1")}, {IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("fd00::2")}}
+	sortIPs(ips, "ipv6")
+	assert.Equal(t, "fd00::1", ips[0].IP.String())
+	assert.Equal(t, "fd00::2", ips[1].IP.String())
+	assert.Equal(t, "10.0.0.1", ips[2].IP.String())
+	sortIPs(ips, "ipv4")
+	assert.Equal(t, "10.0.0.1", ips[0].IP.String())
+	assert.Equal(t, "10.0.0.2", ips[1].IP.String())
+}
+
+// TestNewResolver verifies that the default resolver is used unless the DNS network or server is set.
+func TestNewResolver(t *testing.T) {
+	assert.Equal(t, net.DefaultResolver, newResolver())
+	t.Setenv("PIGGY_DNS_RESOLVER", "invalid")
+	assert.Equal(t, net.DefaultResolver, newResolver())
+	t.Setenv("PIGGY_DNS_SERVER", "10.0.0.10")
+	assert.NotEqual(t, net.DefaultResolver, newResolver())
+}
+
+// TestNewTransport verifies that the transport is configured from the env.
+func TestNewTransport(t *testing.T) {
+	tr := newTransport(nil, net.DefaultResolver)
+	assert.Nil(t, tr.Proxy)
+	assert.Equal(t, tlsHandshakeTimeout, tr.TLSHandshakeTimeout)
+
+	t.Setenv("PIGGY_TLS_HANDSHAKE_TIMEOUT", "2s")
+	t.Setenv("PIGGY_HTTP_PROXY", "http://proxy:3128")
+	t.Setenv("PIGGY_NO_PROXY", "piggy-webhooks.svc")
+	tr = newTransport(nil, net.DefaultResolver)
+	assert.Equal(t, 2*time.Second, tr.TLSHandshakeTimeout)
+	req, _ := http.NewRequest(http.MethodPost, "https://piggy.example.com/secret", nil)
+	proxy, err := tr.Proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy:3128", proxy.String())
+	req, _ = http.NewRequest(http.MethodPost, "https://piggy-webhooks.svc/secret", nil)
+	proxy, err = tr.Proxy(req)
+	assert.NoError(t, err)
+	assert.Nil(t, proxy)
+}
+
+// TestRequestSecrets_HTTPProxy verifies that secrets are requested through PIGGY_HTTP_PROXY.
+func TestRequestSecrets_HTTPProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		_, _ = w.Write([]byte(`{"DB_PASS": "secret"}`))
+	}))
+	defer proxy.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("token"), 0600))
+	t.Setenv("PIGGY_TOKEN_FILE", tokenFile)
+	t.Setenv("PIGGY_ADDRESS", "http://piggy-webhooks.invalid")
+	t.Setenv("PIGGY_HTTP_PROXY", proxy.URL)
+
+	env := &sanitizedEnv{}
+	assert.NoError(t, requestSecrets(map[string]string{"DB_PASS": "piggy:DB_PASS"}, env, nil))
+	assert.Equal(t, []string{"DB_PASS=secret"}, env.Env)
+	assert.Equal(t, "http://piggy-webhooks.invalid/secret", proxied)
+}
+
+// TestRequestSecrets_RequestTimeout verifies that PIGGY_REQUEST_TIMEOUT limits the request to all addresses.
+func TestRequestSecrets_RequestTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer slow.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("token"), 0600))
+	t.Setenv("PIGGY_TOKEN_FILE", tokenFile)
+	t.Setenv("PIGGY_ADDRESS", strings.Join([]string{slow.URL, slow.URL, slow.URL}, ","))
+	t.Setenv("PIGGY_REQUEST_TIMEOUT", "100ms")
+
+	start := time.Now()
+	assert.Error(t, requestSecrets(map[string]string{}, &sanitizedEnv{}, nil))
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// reference a piggy reference `KEY[|FILTER[:ARG]]...[?|:-DEFAULT]` e.g. `CONFIG|jsonpath:$.db.host:-localhost`,
+// the same as piggy-webhooks parses
+type reference struct {
+	key          string
+	filters      []string
+	optional     bool // set to empty if the key is missing
+	hasDefault   bool // set to defaultValue if the key is missing
+	defaultValue string
+}
+
+// parseReference parses the modifiers of a reference. A reference without modifiers is the secret key
+func parseReference(s string) reference {
+	var r reference
+	spec, defaultValue, hasDefault := strings.Cut(s, ":-")
+	if hasDefault {
+		r.hasDefault = true
+		r.defaultValue = defaultValue
+	} else if trimmed, ok := strings.CutSuffix(spec, "?"); ok {
+		r.optional = true
+		spec = trimmed
+	}
+	filters := strings.Split(spec, "|")
+	r.key = filters[0]
+	r.filters = filters[1:]
+	return r
+}
+
+// filter applies the filters of the reference to the value of the key
+func (r reference) filter(value string) (string, error) {
+	for _, filter := range r.filters {
+		var err error
+		if value, err = applyFilter(filter, value); err != nil {
+			return "", fmt.Errorf("filter [%s] of [%s]: %v", filter, r.key, err)
+		}
+	}
+	return value, nil
+}
+
+// applyFilter applies a `base64decode`, `base64encode`, `urlencode` or `jsonpath:EXPR` filter
+func applyFilter(filter string, value string) (string, error) {
+	name, arg, _ := strings.Cut(filter, ":")
+	switch name {
+	case "base64decode":
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		return string(decoded), err
+	case "base64encode":
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	case "urlencode":
+		return url.QueryEscape(value), nil
+	case "jsonpath":
+		return jsonPath(value, arg)
+	}
+	return "", fmt.Errorf("unknown filter %s", name)
+}
+
+// jsonPath returns the value at a path of a JSON document. Supports `$`, `.name`, `['name']` and `[index]`.
+// A string is returned as it is, other values as JSON
+func jsonPath(document string, path string) (string, error) {
+	var value any
+	decoder := json.NewDecoder(strings.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return "", fmt.Errorf("invalid jsonpath [%s], expecting $", path)
+	}
+	for rest != "" {
+		name, index := "", -1
+		switch {
+		case strings.HasPrefix(rest, "."):
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			name, rest = rest[1:end], rest[end:]
+		case strings.HasPrefix(rest, "['"), strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest[2:], rest[1:2]+"]")
+			if end < 0 {
+				return "", fmt.Errorf("invalid jsonpath [%s]", path)
+			}
+			name, rest = rest[2:2+end], rest[2+end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			i, err := strconv.Atoi(rest[1:max(end, 1)])
+			if end < 0 || err != nil || i < 0 {
+				return "", fmt.Errorf("invalid jsonpath [%s]", path)
+			}
+			index, rest = i, rest[end+1:]
+		default:
+			return "", fmt.Errorf("invalid jsonpath [%s]", path)
+		}
+		if index >= 0 {
+			list, ok := value.([]any)
+			if !ok || index >= len(list) {
+				return "", fmt.Errorf("jsonpath [%s] not found", path)
+			}
+			value = list[index]
+		} else {
+			object, ok := value.(map[string]any)
+			if !ok || name == "" {
+				return "", fmt.Errorf("jsonpath [%s] not found", path)
+			}
+			if value, ok = object[name]; !ok {
+				return "", fmt.Errorf("jsonpath [%s] not found", path)
+			}
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+// secretKeys returns sorted secret keys of the references without their modifiers
+func secretKeys(references map[string]string) []string {
+	var keys []string
+	for _, s := range piggyReferences(references) {
+		key := parseReference(s).key
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// lookupReference returns the value of a reference from secrets resolved by piggy-webhooks, keyed by the reference,
+// or from secrets read from the secret store, keyed by the secret key and then filtered. If missing is allowed, a missing key
+// or a failed filter resolves to the default value, or empty if optional. Generated references are never missing here
+func lookupReference(s string, secrets map[string]string, missing bool) (string, bool) {
+	if value, ok := secrets[s]; ok {
+		return value, true
+	}
+	r := parseReference(s)
+	if value, ok := secrets[r.key]; ok {
+		filtered, err := r.filter(value)
+		if err == nil {
+			return filtered, true
+		}
+		log.Error().Msgf("Unable to resolve [%s]: %v", s, err)
+	}
+	if !missing || isGeneratedReference(r.key) {
+		return "", false
+	}
+	if r.hasDefault {
+		return r.defaultValue, true
+	}
+	return "", r.optional
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseReference verifies parsing the optional, default and filter modifiers of references.
+func TestParseReference(t *testing.T) {
+	assert.Equal(t, reference{key: "DB_PASS", filters: []string{}}, parseReference("DB_PASS"))
+	assert.Equal(t, reference{key: "DB_PASS", filters: []string{}, optional: true}, parseReference("DB_PASS?"))
+	assert.Equal(t, reference{key: "DB_HOST", filters: []string{}, hasDefault: true, defaultValue: "localhost:5432"}, parseReference("DB_HOST:-localhost:5432"))
+	assert.Equal(t, reference{key: "CONFIG", filters: []string{"base64decode", "jsonpath:$.db.host"}, hasDefault: true, defaultValue: "db"}, parseReference("CONFIG|base64decode|jsonpath:$.db.host:-db"))
+	assert.Equal(t, reference{key: "ssm:/shared/api-key:3", filters: []string{}}, parseReference("ssm:/shared/api-key:3"))
+	assert.Equal(t, []string{"CONFIG", "DB_PASS"}, secretKeys(map[string]string{
+		"DB_HOST": "piggy:CONFIG|jsonpath:$.db.host",
+		"DB_URL":  "postgres://${piggy:CONFIG|jsonpath:$.db.user}:${piggy:DB_PASS?}@db",
+	}))
+}
+
+// TestJSONPath verifies selecting values of JSON documents.
+func TestJSONPath(t *testing.T) {
+	document := `{"db": {"host": "db", "port": 5432, "replicas": ["r1", "r2"], "tls": {"enabled": true}}, "a.b": "dotted"}`
+	for path, expected := range map[string]string{
+		"$.db.host":        "db",
+		"$.db.port":        "5432",
+		"$.db.replicas[1]": "r2",
+		"$['a.b']":         "dotted",
+		`$["db"].tls`:      `{"enabled":true}`,
+	} {
+		value, err := jsonPath(document, path)
+		assert.NoError(t, err, path)
+		assert.Equal(t, expected, value, path)
+	}
+	for _, path := range []string{"db.host", "$.db.missing", "$.db.replicas[2]", "$.db[0]"} {
+		_, err := jsonPath(document, path)
+		assert.Error(t, err, path)
+	}
+}
+
+// TestLookupReference verifies resolving references with modifiers from secrets of the secret store and of piggy-webhooks.
+func TestLookupReference(t *testing.T) {
+	secrets := map[string]string{
+		"CERT":                      base64.StdEncoding.EncodeToString([]byte("-----BEGIN CERTIFICATE-----")),
+		"CONFIG":                    `{"db": {"host": "db"}}`,
+		"PASS|urlencode":            "p%40ss", // resolved by piggy-webhooks
+		"CONFIG|jsonpath:$.db.port": "5432",
+	}
+	for spec, expected := range map[string]string{
+		"CERT|base64decode":               "-----BEGIN CERTIFICATE-----",
+		"CONFIG|jsonpath:$.db.host":       "db",
+		"CONFIG|jsonpath:$.db.port":       "5432",
+		"PASS|urlencode":                  "p%40ss",
+		"MISSING?":                        "",
+		"MISSING:-fallback":               "fallback",
+		"CONFIG|jsonpath:$.db.user:-app":  "app",
+		"CONFIG|base64decode?":            "",
+		"CONFIG|jsonpath:$.db.host:-none": "db",
+	} {
+		value, ok := lookupReference(spec, secrets, true)
+		assert.True(t, ok, spec)
+		assert.Equal(t, expected, value, spec)
+	}
+	for _, spec := range []string{"MISSING", "CONFIG|jsonpath:$.db.user", "rds-iam-token:db:5432:app?"} {
+		_, ok := lookupReference(spec, secrets, true)
+		assert.False(t, ok, spec)
+	}
+	// the default is not applied before the secret store is read
+	_, ok := lookupReference("MISSING:-fallback", secrets, false)
+	assert.False(t, ok)
+}
+
+// TestDoSanitize_Modifiers verifies that optional and default references are resolved, so they are not reported as not found.
+func TestDoSanitize_Modifiers(t *testing.T) {
+	references := map[string]string{
+		"DB_HOST": "piggy:CONFIG|jsonpath:$.db.host",
+		"DB_URL":  "postgres://app:${piggy:DB_PASS?}@${piggy:DB_HOST:-localhost}/app",
+		"TOKEN":   "piggy:TOKEN?",
+		"HOSTS":   "piggy:ssm:/shared/hosts?",
+	}
+	secrets := map[string]string{
+		"CONFIG":               `{"db": {"host": "db"}}`,
+		"ssm:/shared/hosts":    "a,b",
+		"ssm:/shared/hosts[0]": "a",
+		"ssm:/shared/hosts[1]": "b",
+	}
+	resolved := resolveReferences(references, secrets)
+	assert.Equal(t, "postgres://app:${piggy:DB_PASS?}@${piggy:DB_HOST:-localhost}/app", resolved["DB_URL"])
+	assert.Equal(t, "piggy:TOKEN?", resolved["TOKEN"])
+
+	env := &sanitizedEnv{}
+	doSanitize(references, env, secrets)
+	assert.ElementsMatch(t, []string{
+		"DB_HOST=db",
+		"DB_URL=postgres://app:@localhost/app",
+		"TOKEN=",
+		"HOSTS=a,b",
+		"HOSTS_0=a",
+		"HOSTS_1=b",
+	}, env.Env)
+	for _, v := range env.Env {
+		assert.False(t, hasUnresolvedReference(v), v)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/rs/zerolog/log"
+)
+
+// PrefixSSM a reference to an SSM parameter, optionally of a version or label e.g. `piggy:ssm:/shared/api-key:3`
+const PrefixSSM = "ssm:"
+
+// maxSSMGetParameters the maximum number of names of a GetParameters request
+const maxSSMGetParameters = 10
+
+// ssmParameterGetter reads SSM parameters by names
+type ssmParameterGetter interface {
+	GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
+}
+
+// splitSSMReferences splits env into env referencing SSM parameters and the others
+func splitSSMReferences(references map[string]string) (map[string]string, map[string]string) {
+	parameters := make(map[string]string)
+	others := make(map[string]string, len(references))
+	for name, value := range references {
+		if slices.ContainsFunc(referenceKeys(value), func(key string) bool { return strings.HasPrefix(key, PrefixSSM) }) {
+			parameters[name] = value
+		} else {
+			others[name] = value
+		}
+	}
+	return parameters, others
+}
+
+// ssmIndexedKey returns the secret key of an element of a StringList parameter reference, the same as piggy-webhooks returns
+func ssmIndexedKey(reference string, index int) string {
+	return fmt.Sprintf("%s[%d]", reference, index)
+}
+
+// ssmReference returns the reference of a parameter read by GetParameters
+func ssmReference(param types.Parameter) string {
+	selector := aws.ToString(param.Selector)
+	if selector != "" && !strings.HasPrefix(selector, ":") {
+		selector = ":" + selector
+	}
+	return PrefixSSM + aws.ToString(param.Name) + selector
+}
+
+// getSSMParameters reads the SSM parameters of the references in batches. StringList parameters are also split into indexed keys
+func getSSMParameters(ctx context.Context, client ssmParameterGetter, references map[string]string, splitStringList bool) (map[string]string, error) {
+	var names []string
+	for _, key := range secretKeys(references) {
+		if !strings.HasPrefix(key, PrefixSSM) {
+			// a secret key embedded in the same value
+			continue
+		}
+		names = append(names, strings.TrimPrefix(key, PrefixSSM))
+	}
+	secrets := make(map[string]string)
+	for batch := range slices.Chunk(names, maxSSMGetParameters) {
+		output, err := client.GetParameters(ctx, &ssm.GetParametersInput{
+			Names:          batch,
+			WithDecryption: aws.Bool(true),
+		})
+		if awsErr(err) {
+			return nil, err
+		}
+		if len(output.InvalidParameters) > 0 {
+			log.Debug().Msgf("SSM parameters not found %v", output.InvalidParameters)
+		}
+		for _, param := range output.Parameters {
+			reference := ssmReference(param)
+			secrets[reference] = aws.ToString(param.Value)
+			if splitStringList && param.Type == types.ParameterTypeStringList {
+				for i, value := range strings.Split(aws.ToString(param.Value), ",") {
+					secrets[ssmIndexedKey(reference, i)] = value
+				}
+			}
+		}
+	}
+	return secrets, nil
+}
+
+// readSSMParameters reads the SSM parameters with the AWS role of the pod
+func readSSMParameters(references map[string]string) (map[string]string, error) {
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(os.Getenv("PIGGY_AWS_REGION")))
+	if err != nil {
+		return nil, err
+	}
+	splitStringList, _ := strconv.ParseBool(os.Getenv("PIGGY_AWS_SSM_SPLIT_STRING_LIST"))
+	return getSSMParameters(ctx, ssm.NewFromConfig(cfg), references, splitStringList)
+}
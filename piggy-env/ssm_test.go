@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSSMClient struct {
+	parameters map[string]types.Parameter
+	requests   int
+}
+
+func (c *fakeSSMClient) GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+	c.requests++
+	if len(params.Names) > maxSSMGetParameters {
+		return nil, fmt.Errorf("too many names %d", len(params.Names))
+	}
+	output := &ssm.GetParametersOutput{}
+	for _, name := range params.Names {
+		param, ok := c.parameters[name]
+		if !ok {
+			output.InvalidParameters = append(output.InvalidParameters, name)
+			continue
+		}
+		if _, selector, ok := strings.Cut(name, ":"); ok {
+			param.Selector = aws.String(":" + selector)
+		}
+		output.Parameters = append(output.Parameters, param)
+	}
+	return output, nil
+}
+
+// TestSplitSSMReferences verifies that env referencing SSM parameters are told apart from other env.
+func TestSplitSSMReferences(t *testing.T) {
+	parameters, others := splitSSMReferences(map[string]string{
+		"DB_PASS": "piggy:DB_PASS",
+		"API_KEY": "piggy:ssm:/shared/api-key:3",
+		"NORMAL":  "value",
+	})
+	assert.Equal(t, map[string]string{"API_KEY": "piggy:ssm:/shared/api-key:3"}, parameters)
+	assert.Equal(t, map[string]string{"DB_PASS": "piggy:DB_PASS", "NORMAL": "value"}, others)
+}
+
+// TestGetSSMParameters verifies reading parameters of versions and labels in batches and splitting StringList parameters.
+func TestGetSSMParameters(t *testing.T) {
+	client := &fakeSSMClient{parameters: map[string]types.Parameter{
+		"/shared/api-key:3":    {Name: aws.String("/shared/api-key"), Value: aws.String("v3"), Type: types.ParameterTypeSecureString},
+		"/shared/api-key:prod": {Name: aws.String("/shared/api-key"), Value: aws.String("v4"), Type: types.ParameterTypeSecureString},
+		"/shared/hosts":        {Name: aws.String("/shared/hosts"), Value: aws.String("a,b"), Type: types.ParameterTypeStringList},
+	}}
+	references := map[string]string{
+		"API_KEY_V3":   "piggy:ssm:/shared/api-key:3",
+		"API_KEY_PROD": "piggy:ssm:/shared/api-key:prod",
+		"HOSTS":        "piggy:ssm:/shared/hosts",
+		"MISSING":      "piggy:ssm:/shared/missing",
+	}
+	for i := range 10 {
+		name := fmt.Sprintf("/shared/p%d", i)
+		client.parameters[name] = types.Parameter{Name: aws.String(name), Value: aws.String(name), Type: types.ParameterTypeString}
+		references[fmt.Sprintf("P%d", i)] = "piggy:ssm:" + name
+	}
+
+	// Case 1: StringList parameters are not split by default
+	secrets, err := getSSMParameters(context.Background(), client, references, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, client.requests)
+	assert.Equal(t, "v3", secrets["ssm:/shared/api-key:3"])
+	assert.Equal(t, "v4", secrets["ssm:/shared/api-key:prod"])
+	assert.Equal(t, "a,b", secrets["ssm:/shared/hosts"])
+	assert.NotContains(t, secrets, "ssm:/shared/hosts[0]")
+	assert.NotContains(t, secrets, "ssm:/shared/missing")
+
+	// Case 2: Split StringList parameters into indexed env
+	secrets, err = getSSMParameters(context.Background(), client, references, true)
+	assert.NoError(t, err)
+	env := &sanitizedEnv{}
+	doSanitize(map[string]string{"HOSTS": "piggy:ssm:/shared/hosts", "MISSING": "piggy:ssm:/shared/missing"}, env, secrets)
+	assert.ElementsMatch(t, []string{"HOSTS=a,b", "HOSTS_0=a", "HOSTS_1=b", "MISSING=piggy:ssm:/shared/missing"}, env.Env)
+}
@@ -0,0 +1,348 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// SecretCertKey the serving certificate key in the secret
+	SecretCertKey = "tls.crt"
+	// SecretPrivateKeyKey the serving private key key in the secret
+	SecretPrivateKeyKey = "tls.key"
+	// SecretCACertKey the CA bundle key in the secret
+	SecretCACertKey = "ca.crt"
+	// SecretCAPrivateKeyKey the CA private key key in the secret
+	SecretCAPrivateKeyKey = "ca.key"
+)
+
+// Config a self-managed certificate configuration
+type Config struct {
+	Namespace     string        // namespace of piggy-webhooks and the certificate secret
+	SecretName    string        // name of the secret storing the certificates
+	ServiceName   string        // name of the piggy-webhooks service
+	WebhookName   string        // name of the MutatingWebhookConfiguration to keep caBundle up to date
+	Validity      time.Duration // validity of the serving certificate. CA is valid for 10 times longer
+	RotateBefore  time.Duration // rotate the certificate when it expires within this duration
+	CheckInterval time.Duration // interval for checking the certificate expiry
+}
+
+// Manager generates, stores and rotates a self-signed webhook certificate
+type Manager struct {
+	config    Config
+	k8sClient kubernetes.Interface
+	context   context.Context
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	caBundle  []byte
+}
+
+type keyPair struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// NewManager create a self-managed certificate manager
+func NewManager(ctx context.Context, k8sClient kubernetes.Interface, config Config) (*Manager, error) {
+	if config.Namespace == "" || config.SecretName == "" || config.ServiceName == "" {
+		return nil, errors.New("namespace, secret name and service name are required")
+	}
+	if config.Validity <= 0 {
+		return nil, errors.New("certificate validity must be greater than 0")
+	}
+	if config.RotateBefore >= config.Validity {
+		return nil, fmt.Errorf("rotate before %s must be less than validity %s", config.RotateBefore, config.Validity)
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = time.Hour
+	}
+	return &Manager{
+		config:    config,
+		k8sClient: k8sClient,
+		context:   ctx,
+	}, nil
+}
+
+// GetCertificate returns the current serving certificate. Use as tls.Config.GetCertificate
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("certificate is not ready")
+	}
+	return m.cert, nil
+}
+
+// CABundle returns the current PEM encoded CA bundle
+func (m *Manager) CABundle() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.caBundle
+}
+
+// Start checks the certificate periodically until context is done
+func (m *Manager) Start() {
+	ticker := time.NewTicker(m.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.context.Done():
+			return
+		case <-ticker.C:
+			if err := m.Reconcile(); err != nil {
+				log.Error().Msgf("Error reconciling webhook certificate: %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile makes sure the certificate secret holds a valid certificate,
+// loads it for serving and updates caBundle of the MutatingWebhookConfiguration
+func (m *Manager) Reconcile() error {
+	var secret *corev1.Secret
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		secret, err = m.ensureSecret()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(secret.Data[SecretCertKey], secret.Data[SecretPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %v", err)
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.caBundle = secret.Data[SecretCACertKey]
+	m.mu.Unlock()
+	if m.config.WebhookName == "" {
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		return m.patchCABundle(secret.Data[SecretCACertKey])
+	})
+}
+
+func (m *Manager) ensureSecret() (*corev1.Secret, error) {
+	secrets := m.k8sClient.CoreV1().Secrets(m.config.Namespace)
+	secret, err := secrets.Get(m.context, m.config.SecretName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		data, err := m.generate(nil)
+		if err != nil {
+			return nil, err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.config.SecretName,
+				Namespace: m.config.Namespace,
+			},
+			Data: data,
+		}
+		created, err := secrets.Create(m.context, secret, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			// other replica has created it, read it again
+			return secrets.Get(m.context, m.config.SecretName, metav1.GetOptions{})
+		} else if err != nil {
+			return nil, fmt.Errorf("error creating certificate secret: %v", err)
+		}
+		log.Info().Msgf("Webhook certificate has been generated in secret %s/%s", m.config.Namespace, m.config.SecretName)
+		return created, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting certificate secret: %v", err)
+	}
+	data, err := m.generate(secret.Data)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return secret, nil
+	}
+	secret.Data = data
+	updated, err := secrets.Update(m.context, secret, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("Webhook certificate has been rotated in secret %s/%s", m.config.Namespace, m.config.SecretName)
+	return updated, nil
+}
+
+// generate returns new secret data or nil when the existing data is still valid
+func (m *Manager) generate(data map[string][]byte) (map[string][]byte, error) {
+	now := time.Now()
+	caBundle := data[SecretCACertKey]
+	ca, err := parseKeyPair(caBundle, data[SecretCAPrivateKeyKey])
+	if err != nil || ca.cert.NotAfter.Before(now.Add(m.config.RotateBefore)) {
+		if ca != nil {
+			log.Info().Msgf("Webhook CA certificate expires at %s, rotating", ca.cert.NotAfter)
+		}
+		ca, err = m.newCA(now)
+		if err != nil {
+			return nil, err
+		}
+		// keep the previous CA in bundle until it expires, so in-flight clients still trust the old certificate
+		caBundle = append(append([]byte{}, ca.certPEM...), validCerts(caBundle, now)...)
+	}
+	serving, err := parseKeyPair(data[SecretCertKey], data[SecretPrivateKeyKey])
+	if err == nil && serving.cert.NotAfter.After(now.Add(m.config.RotateBefore)) && serving.cert.CheckSignatureFrom(ca.cert) == nil {
+		return nil, nil
+	}
+	serving, err = m.newServing(now, ca)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		SecretCertKey:         serving.certPEM,
+		SecretPrivateKeyKey:   serving.keyPEM,
+		SecretCACertKey:       caBundle,
+		SecretCAPrivateKeyKey: ca.keyPEM,
+	}, nil
+}
+
+func (m *Manager) newCA(now time.Time) (*keyPair, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("%s-ca", m.config.ServiceName)},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * m.config.Validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return newKeyPair(template, nil)
+}
+
+func (m *Manager) newServing(now time.Time, ca *keyPair) (*keyPair, error) {
+	svc := m.config.ServiceName
+	ns := m.config.Namespace
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: fmt.Sprintf("%s.%s.svc", svc, ns)},
+		DNSNames:    []string{svc, fmt.Sprintf("%s.%s", svc, ns), fmt.Sprintf("%s.%s.svc", svc, ns), fmt.Sprintf("%s.%s.svc.cluster.local", svc, ns)},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(m.config.Validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return newKeyPair(template, ca)
+}
+
+func (m *Manager) patchCABundle(caBundle []byte) error {
+	webhooks := m.k8sClient.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := webhooks.Get(m.context, m.config.WebhookName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting mutating webhook configuration: %v", err)
+	}
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			config.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if _, err := webhooks.Update(m.context, config, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.Info().Msgf("CA bundle of mutating webhook configuration %s has been updated", m.config.WebhookName)
+	return nil
+}
+
+// newKeyPair create a certificate from template. The certificate is self-signed when parent is nil
+func newKeyPair(template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}, nil
+}
+
+// parseKeyPair parse the first certificate in certPEM and its private key
+func parseKeyPair(certPEM []byte, keyPEM []byte) (*keyPair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("no private key found")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(certBlock),
+		keyPEM:  keyPEM,
+	}, nil
+}
+
+// validCerts returns PEM encoded certificates which are not expired
+func validCerts(bundle []byte, now time.Time) []byte {
+	var valid []byte
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return valid
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || cert.NotAfter.Before(now) {
+			continue
+		}
+		valid = append(valid, pem.EncodeToMemory(block)...)
+	}
+}
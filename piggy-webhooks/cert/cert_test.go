@@ -0,0 +1,153 @@
+package cert
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestConfig() Config {
+	return Config{
+		Namespace:    "piggy",
+		SecretName:   "piggy-webhooks-webhook-tls",
+		ServiceName:  "piggy-webhooks",
+		WebhookName:  "piggy-webhooks",
+		Validity:     24 * time.Hour,
+		RotateBefore: time.Hour,
+	}
+}
+
+func newWebhookConfig() *admissionregistrationv1.MutatingWebhookConfiguration {
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "piggy-webhooks"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "piggy-webhooks.piggy.svc"},
+		},
+	}
+}
+
+func setupTest(objects ...runtime.Object) (*fake.Clientset, *Manager) {
+	client := fake.NewClientset(objects...)
+	m, _ := NewManager(context.Background(), client, newTestConfig())
+	return client, m
+}
+
+func parseCert(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	assert.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	return cert
+}
+
+// TestNewManager_InvalidConfig verifies that incomplete configurations are rejected.
+func TestNewManager_InvalidConfig(t *testing.T) {
+	client := fake.NewClientset()
+	config := newTestConfig()
+	config.Namespace = ""
+	_, err := NewManager(context.Background(), client, config)
+	assert.Error(t, err)
+
+	config = newTestConfig()
+	config.RotateBefore = config.Validity
+	_, err = NewManager(context.Background(), client, config)
+	assert.Error(t, err)
+}
+
+// TestReconcile_GenerateCertificate verifies that a certificate is generated, stored and its CA is patched to the webhook.
+func TestReconcile_GenerateCertificate(t *testing.T) {
+	client, m := setupTest(newWebhookConfig())
+	_, err := m.GetCertificate(nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, m.Reconcile())
+
+	secret, err := client.CoreV1().Secrets("piggy").Get(context.Background(), "piggy-webhooks-webhook-tls", metav1.GetOptions{})
+	assert.NoError(t, err)
+	serving := parseCert(t, secret.Data[SecretCertKey])
+	ca := parseCert(t, secret.Data[SecretCACertKey])
+	assert.NoError(t, serving.CheckSignatureFrom(ca))
+	assert.NoError(t, serving.VerifyHostname("piggy-webhooks.piggy.svc"))
+
+	webhook, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "piggy-webhooks", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data[SecretCACertKey], webhook.Webhooks[0].ClientConfig.CABundle)
+
+	cert, err := m.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, cert)
+}
+
+// TestReconcile_KeepValidCertificate verifies that a valid certificate is not regenerated.
+func TestReconcile_KeepValidCertificate(t *testing.T) {
+	client, m := setupTest(newWebhookConfig())
+	assert.NoError(t, m.Reconcile())
+	before, _ := client.CoreV1().Secrets("piggy").Get(context.Background(), "piggy-webhooks-webhook-tls", metav1.GetOptions{})
+
+	assert.NoError(t, m.Reconcile())
+	after, _ := client.CoreV1().Secrets("piggy").Get(context.Background(), "piggy-webhooks-webhook-tls", metav1.GetOptions{})
+	assert.Equal(t, before.Data, after.Data)
+}
+
+// TestReconcile_RotateCertificate verifies that an expiring serving certificate is re-issued from the same CA.
+func TestReconcile_RotateCertificate(t *testing.T) {
+	client, m := setupTest(newWebhookConfig())
+	assert.NoError(t, m.Reconcile())
+	before, _ := client.CoreV1().Secrets("piggy").Get(context.Background(), "piggy-webhooks-webhook-tls", metav1.GetOptions{})
+
+	// anything expiring within 2 days is rotated, the serving certificate is valid for 1 day only
+	m.config.RotateBefore = 48 * time.Hour
+	assert.NoError(t, m.Reconcile())
+	after, _ := client.CoreV1().Secrets("piggy").Get(context.Background(), "piggy-webhooks-webhook-tls", metav1.GetOptions{})
+	assert.NotEqual(t, before.Data[SecretCertKey], after.Data[SecretCertKey])
+	assert.Equal(t, before.Data[SecretCACertKey], after.Data[SecretCACertKey])
+	assert.NoError(t, parseCert(t, after.Data[SecretCertKey]).CheckSignatureFrom(parseCert(t, after.Data[SecretCACertKey])))
+}
+
+// TestReconcile_RotateCA verifies that the previous CA is kept in the bundle after the CA is rotated.
+func TestReconcile_RotateCA(t *testing.T) {
+	client, m := setupTest(newWebhookConfig())
+	assert.NoError(t, m.Reconcile())
+	before, _ := client.CoreV1().Secrets("piggy").Get(context.Background(), "piggy-webhooks-webhook-tls", metav1.GetOptions{})
+
+	// the CA is valid for 10 days
+	m.config.RotateBefore = 20 * 24 * time.Hour
+	assert.NoError(t, m.Reconcile())
+	after, _ := client.CoreV1().Secrets("piggy").Get(context.Background(), "piggy-webhooks-webhook-tls", metav1.GetOptions{})
+	assert.NotEqual(t, before.Data[SecretCAPrivateKeyKey], after.Data[SecretCAPrivateKeyKey])
+	assert.Contains(t, string(after.Data[SecretCACertKey]), string(before.Data[SecretCACertKey]))
+
+	webhook, _ := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "piggy-webhooks", metav1.GetOptions{})
+	assert.Equal(t, after.Data[SecretCACertKey], webhook.Webhooks[0].ClientConfig.CABundle)
+}
+
+// TestReconcile_InvalidSecret verifies that a secret with broken data is regenerated.
+func TestReconcile_InvalidSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "piggy-webhooks-webhook-tls", Namespace: "piggy"},
+		Data: map[string][]byte{
+			SecretCertKey: []byte("invalid"),
+		},
+	}
+	client, m := setupTest(secret, newWebhookConfig())
+	assert.NoError(t, m.Reconcile())
+	after, _ := client.CoreV1().Secrets("piggy").Get(context.Background(), "piggy-webhooks-webhook-tls", metav1.GetOptions{})
+	assert.NotNil(t, parseCert(t, after.Data[SecretCertKey]))
+}
+
+// TestReconcile_MissingWebhook verifies that an error is returned when the webhook configuration does not exist.
+func TestReconcile_MissingWebhook(t *testing.T) {
+	_, m := setupTest()
+	err := m.Reconcile()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error getting mutating webhook configuration")
+}
@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// HealthHandler always returns OK while the process is running
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// ReadyHandler returns OK when ready is true, otherwise returns service unavailable
+func ReadyHandler(ready *atomic.Bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ready.Load() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+}
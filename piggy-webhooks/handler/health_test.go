@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHealthHandler verifies that the liveness endpoint always returns OK.
+func TestHealthHandler(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+	rr := httptest.NewRecorder()
+	HealthHandler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// TestReadyHandler verifies that the readiness endpoint follows the ready flag.
+func TestReadyHandler(t *testing.T) {
+	ready := &atomic.Bool{}
+	handler := ReadyHandler(ready)
+
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	ready.Store(true)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -2,9 +2,13 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/KongZ/piggy/piggy-webhooks/service"
 	"github.com/rs/zerolog/log"
@@ -42,21 +46,36 @@ func doServeSecretFunc(w http.ResponseWriter, r *http.Request, secretFunc getSec
 
 	// Step 2: Parse the request.
 	var payload service.GetSecretPayload
+	// an empty name is allowed since the pod name is read from a bound token
 	if err := json.Unmarshal(body, &payload); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, service.Info{}, fmt.Errorf("could not deserialize request: %v", err)
-	} else if payload.Name == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, service.Info{}, fmt.Errorf("malformed payload: request is nil")
 	}
 	payload.Token = serviceToken
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		payload.RemoteIP = host
+	}
 	// Serve request
 	env, info, err := secretFunc(&payload)
 	if err != nil {
-		if err == service.ErrorAuthorized {
+		var rateLimitErr *service.RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return nil, info, err
+		}
+		if errors.Is(err, service.ErrorAuthorized) || errors.Is(err, service.ErrorReplay) || errors.Is(err, service.ErrorIntegrity) {
 			w.WriteHeader(http.StatusForbidden)
 			return nil, info, err
 		}
+		if errors.Is(err, service.ErrorNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return nil, info, err
+		}
+		if errors.Is(err, service.ErrorUnavailable) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return nil, info, err
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, info, fmt.Errorf("could not get secret: %v", err)
 	}
@@ -2,13 +2,22 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/KongZ/piggy/piggy-webhooks/service"
 	"github.com/stretchr/testify/assert"
+	authv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 // TestSecretHandler_Success verifies that the secret handler correctly processes
@@ -101,7 +110,49 @@ func TestSecretHandler_Errors(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusForbidden, rr.Code)
 
-	// Case 5: Generic Error
+	// Case 5: Replay
+	secretFuncReplay := func(payload *service.GetSecretPayload) (*service.SanitizedEnv, service.Info, error) {
+		return nil, service.Info{}, service.ErrorReplay
+	}
+	handler = SecretHandler(secretFuncReplay)
+	req, _ = http.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"name":"pod"}`))
+	req.Header.Set("Content-Type", JSONContentType)
+	req.Header.Set("X-Token", "valid-token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Case 6: Rate limited
+	secretFuncRateLimited := func(payload *service.GetSecretPayload) (*service.SanitizedEnv, service.Info, error) {
+		return nil, service.Info{}, &service.RateLimitError{Key: "default", RetryAfter: 1500 * time.Millisecond}
+	}
+	handler = SecretHandler(secretFuncRateLimited)
+	req, _ = http.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"name":"pod"}`))
+	req.Header.Set("Content-Type", JSONContentType)
+	req.Header.Set("X-Token", "valid-token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+
+	// Case 7: Classified errors
+	for err, code := range map[error]int{
+		service.ErrorIntegrity:   http.StatusForbidden,
+		service.ErrorNotFound:    http.StatusNotFound,
+		service.ErrorUnavailable: http.StatusServiceUnavailable,
+	} {
+		handler = SecretHandler(func(payload *service.GetSecretPayload) (*service.SanitizedEnv, service.Info, error) {
+			return nil, service.Info{}, fmt.Errorf("%w: detail", err)
+		})
+		req, _ = http.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"name":"pod"}`))
+		req.Header.Set("Content-Type", JSONContentType)
+		req.Header.Set("X-Token", "valid-token")
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, code, rr.Code, err.Error())
+	}
+
+	// Case 8: Generic Error
 	secretFuncError := func(payload *service.GetSecretPayload) (*service.SanitizedEnv, service.Info, error) {
 		return nil, service.Info{}, assert.AnError
 	}
@@ -113,8 +164,10 @@ func TestSecretHandler_Errors(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	// Case 6: Empty Name
-	handler = SecretHandler(nil)
+	// Case 9: Empty Name without a bound pod is rejected by the service
+	handler = SecretHandler(func(payload *service.GetSecretPayload) (*service.SanitizedEnv, service.Info, error) {
+		return nil, service.Info{}, fmt.Errorf("malformed payload: pod name is not supplied by payload or token")
+	})
 	req, _ = http.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"name":""}`))
 	req.Header.Set("Content-Type", JSONContentType)
 	req.Header.Set("X-Token", "valid-token")
@@ -122,3 +175,69 @@ func TestSecretHandler_Errors(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 }
+
+// TestSecretHandler_BoundTokenWithoutName verifies that a request with a bound token only
+// is passed to the service, which reads the pod name from the token.
+func TestSecretHandler_BoundTokenWithoutName(t *testing.T) {
+	handler := SecretHandler(func(payload *service.GetSecretPayload) (*service.SanitizedEnv, service.Info, error) {
+		assert.Empty(t, payload.Name)
+		assert.Equal(t, "bound-token", payload.Token)
+		assert.Equal(t, "10.0.0.1", payload.RemoteIP)
+		return &service.SanitizedEnv{"DB_PASS": "secret-value"}, service.Info{Name: "test-pod"}, nil
+	})
+	req, _ := http.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"uid":"test-uid"}`))
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("Content-Type", JSONContentType)
+	req.Header.Set("X-Token", "bound-token")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"DB_PASS":"secret-value"}`, rr.Body.String())
+}
+
+// TestSecretHandler_Unauthorized verifies that tokens which are not authenticated, or do not belong to the requested pod,
+// are rejected with 403 by the secret service.
+func TestSecretHandler_Unauthorized(t *testing.T) {
+	ns, name, sa := "default", "test-pod", "test-sa"
+	tests := []struct {
+		name          string
+		username      string
+		authenticated bool
+		extra         map[string]authv1.ExtraValue
+	}{
+		{name: "not authenticated", username: "system:serviceaccount:default:test-sa"},
+		{name: "bound pod name mismatch", username: "system:serviceaccount:default:test-sa", authenticated: true,
+			extra: map[string]authv1.ExtraValue{"authentication.kubernetes.io/pod-name": {"other-pod"}}},
+		{name: "bound pod uid mismatch", username: "system:serviceaccount:default:test-sa", authenticated: true,
+			extra: map[string]authv1.ExtraValue{"authentication.kubernetes.io/pod-uid": {"old-uid"}}},
+		{name: "bound node mismatch", username: "system:serviceaccount:default:test-sa", authenticated: true,
+			extra: map[string]authv1.ExtraValue{"authentication.kubernetes.io/node-name": {"node-b"}}},
+		{name: "service account mismatch", username: "system:serviceaccount:default:other-sa", authenticated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, UID: "new-uid"},
+				Spec:       corev1.PodSpec{ServiceAccountName: sa, NodeName: "node-a"},
+			}
+			client := fake.NewClientset(pod)
+			client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				tr := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview)
+				return true, &authv1.TokenReview{
+					Status: authv1.TokenReviewStatus{
+						Authenticated: tt.authenticated,
+						Audiences:     tr.Spec.Audiences,
+						User:          authv1.UserInfo{Username: tt.username, Extra: tt.extra},
+					},
+				}, nil
+			})
+			handler := SecretHandler(service.NewService(context.Background(), client).GetSecret)
+			req, _ := http.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"name":"test-pod"}`))
+			req.Header.Set("Content-Type", JSONContentType)
+			req.Header.Set("X-Token", "valid-token")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusForbidden, rr.Code)
+		})
+	}
+}
@@ -3,16 +3,23 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/KongZ/piggy/piggy-webhooks/cert"
 	"github.com/KongZ/piggy/piggy-webhooks/handler"
 	"github.com/KongZ/piggy/piggy-webhooks/mutate"
 	"github.com/KongZ/piggy/piggy-webhooks/service"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	kubernetesConfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 
@@ -32,6 +39,38 @@ func newClient() (kubernetes.Interface, error) {
 	return k8sClient, nil
 }
 
+func newPolicyCache(ctx context.Context) (*service.PolicyCache, error) {
+	kubeConfig, err := kubernetesConfig.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	return service.NewPolicyCache(ctx, client)
+}
+
+func newCertManager(ctx context.Context, k8s kubernetes.Interface) (*cert.Manager, error) {
+	validity, err := time.ParseDuration(service.GetEnv("CERT_VALIDITY", "8760h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CERT_VALIDITY: %v", err)
+	}
+	rotateBefore, err := time.ParseDuration(service.GetEnv("CERT_ROTATE_BEFORE", "720h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CERT_ROTATE_BEFORE: %v", err)
+	}
+	serviceName := service.GetEnv("SERVICE_NAME", "piggy-webhooks")
+	return cert.NewManager(ctx, k8s, cert.Config{
+		Namespace:    service.GetEnv("POD_NAMESPACE", ""),
+		SecretName:   service.GetEnv("CERT_SECRET_NAME", serviceName+"-webhook-tls"),
+		ServiceName:  serviceName,
+		WebhookName:  service.GetEnv("WEBHOOK_CONFIG_NAME", serviceName),
+		Validity:     validity,
+		RotateBefore: rotateBefore,
+	})
+}
+
 func main() {
 	var err error
 	debug, _ := strconv.ParseBool(service.GetEnv("DEBUG", "false"))
@@ -39,9 +78,17 @@ func main() {
 	if debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
-	certPath := service.GetEnv("TLS_CERT_FILE", "")
-	keyPath := service.GetEnv("TLS_PRIVATE_KEY_FILE", "")
-	listenAddress := service.GetEnv("LISTEN_ADDRESS", ":8080")
+	selfManagedCert := service.GetEnvBool("SELF_MANAGED_CERT", false)
+	shutdownDelay, err := time.ParseDuration(service.GetEnv("SHUTDOWN_DELAY", "0s"))
+	if err != nil {
+		log.Fatal().Msgf("invalid SHUTDOWN_DELAY: %s", err)
+	}
+	shutdownTimeout, err := time.ParseDuration(service.GetEnv("SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil {
+		log.Fatal().Msgf("invalid SHUTDOWN_TIMEOUT: %s", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 	k8s, err := newClient()
 	if err != nil {
 		log.Fatal().Msgf("error creating client: %s", err)
@@ -50,53 +97,104 @@ func main() {
 	if err != nil {
 		log.Fatal().Msgf("error creating webhook: %s", err)
 	}
-	mux := http.NewServeMux()
-	mux.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-	}))
-	mux.Handle("/mutate", handler.AdmitHandler(mut.ApplyPiggy))
+	mutateListener := listenerConfig("MUTATE", selfManagedCert)
+	secretListener := listenerConfig("SECRET", selfManagedCert)
+	healthListener := listenerConfig("HEALTH", selfManagedCert)
+	listeners, err := groupListeners(mutateListener, secretListener, healthListener)
+	if err != nil {
+		log.Fatal().Msgf("error creating listeners: %s", err)
+	}
+	ready := &atomic.Bool{}
+	healthListener.mux.Handle("/healthz", handler.HealthHandler())
+	healthListener.mux.Handle("/readyz", handler.ReadyHandler(ready))
+	mutateListener.mux.Handle("/mutate", handler.AdmitHandler(mut.ApplyPiggy))
 	svc := service.NewService(context.Background(), k8s)
-	mux.Handle("/secret", handler.SecretHandler(svc.GetSecret))
-	ch := make(chan struct{})
-	enabledTLS := !(certPath == "" && keyPath == "")
-	server := http.Server{
-		Addr:              listenAddress,
-		Handler:           mux,
-		ReadHeaderTimeout: 2 * time.Second,
-	}
-	if enabledTLS {
-		tlscfg := &tls.Config{
-			MinVersion:               tls.VersionTLS12,
-			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			},
+	if service.GetEnvBool("ACCESS_POLICY_ENABLED", false) {
+		policies, err := newPolicyCache(ctx)
+		if err != nil {
+			log.Fatal().Msgf("error watching access policies: %s", err)
 		}
-		server.TLSConfig = tlscfg
-	}
-	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, syscall.SIGTERM)
-		<-sigint
-		// We received an interrupt signal, shut down.
-		if err := server.Shutdown(context.Background()); err != nil {
-			// Error from closing listeners, or context timeout:
-			log.Error().Msgf("HTTP server Shutdown: %v", err)
+		svc.SetPolicyLister(policies)
+	}
+	secretListener.mux.Handle("/secret", handler.SecretHandler(svc.GetSecret))
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	var caBundle func() []byte
+	if caPath := service.GetEnv("TLS_CA_FILE", ""); caPath != "" {
+		caBundle = func() []byte {
+			b, err := os.ReadFile(filepath.Clean(caPath))
+			if err != nil {
+				log.Error().Msgf("error reading CA bundle: %s", err)
+			}
+			return b
 		}
-		close(ch)
-	}()
-	if enabledTLS {
-		log.Info().Msgf("Listening on https://%s", listenAddress)
-		err = server.ListenAndServeTLS(certPath, keyPath)
-	} else {
-		log.Info().Msgf("Listening on http://%s", listenAddress)
-		err = server.ListenAndServe()
 	}
-	if err != nil {
-		log.Fatal().Msgf("Error serving webhooks: %s", err)
+	if selfManagedCert {
+		certManager, err := newCertManager(ctx, k8s)
+		if err != nil {
+			log.Fatal().Msgf("error creating certificate manager: %s", err)
+		}
+		if err := certManager.Reconcile(); err != nil {
+			log.Fatal().Msgf("error reconciling webhook certificate: %s", err)
+		}
+		go certManager.Start()
+		getCertificate = certManager.GetCertificate
+		caBundle = certManager.CABundle
+	}
+	if keyPath := service.GetEnv("SIGNATURE_KEY_FILE", ""); keyPath != "" {
+		key, err := os.ReadFile(filepath.Clean(keyPath))
+		if err != nil {
+			log.Fatal().Msgf("error reading signature key: %s", err)
+		}
+		signer, err := service.NewSigner(key)
+		if err != nil {
+			log.Fatal().Msgf("error creating signer: %s", err)
+		}
+		mut.SetSigner(signer)
+		svc.SetSigner(signer)
+	}
+	if service.GetEnvBool("INJECT_CA_BUNDLE", false) {
+		if caBundle == nil {
+			log.Fatal().Msg("INJECT_CA_BUNDLE requires TLS_CA_FILE or SELF_MANAGED_CERT")
+		}
+		mut.SetCABundle(caBundle)
+	}
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		if _, err := l.newServer(getCertificate); err != nil {
+			log.Fatal().Msgf("error creating %s server: %s", l.name, err)
+		}
+	}
+	ready.Store(true)
+	for _, l := range listeners {
+		go func(l *listener) {
+			errCh <- l.serve()
+		}(l)
+	}
+	select {
+	case <-ctx.Done():
+	case err := <-errCh:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Msgf("Error serving webhooks: %s", err)
+		}
+	}
+	// We received an interrupt signal, stop receiving new traffic then drain in-flight requests.
+	ready.Store(false)
+	log.Info().Msgf("Shutting down, draining requests within %s", shutdownTimeout)
+	time.Sleep(shutdownDelay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			if err := l.server.Shutdown(shutdownCtx); err != nil {
+				// Error from closing listeners, or context timeout:
+				log.Error().Msgf("HTTP server %s Shutdown: %v", l.name, err)
+				_ = l.server.Close()
+			}
+		}(l)
 	}
+	wg.Wait()
+	log.Info().Msg("Server stopped")
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestListenerConfig verifies that listener settings fall back to the shared settings.
+func TestListenerConfig(t *testing.T) {
+	t.Setenv("LISTEN_ADDRESS", ":8443")
+	t.Setenv("TLS_CERT_FILE", "/certs/tls.crt")
+	t.Setenv("TLS_PRIVATE_KEY_FILE", "/certs/tls.key")
+	t.Setenv("HEALTH_LISTEN_ADDRESS", ":8081")
+	t.Setenv("HEALTH_TLS_ENABLED", "false")
+
+	mutate := listenerConfig("MUTATE", false)
+	assert.Equal(t, ":8443", mutate.address)
+	assert.Equal(t, "/certs/tls.crt", mutate.certPath)
+	assert.True(t, mutate.tls)
+
+	health := listenerConfig("HEALTH", false)
+	assert.Equal(t, ":8081", health.address)
+	assert.False(t, health.tls)
+}
+
+// TestGroupListeners verifies that endpoints on the same address share a listener.
+func TestGroupListeners(t *testing.T) {
+	mutate := &listener{name: "MUTATE", address: ":8443", tls: true}
+	secret := &listener{name: "SECRET", address: ":8443", tls: true}
+	health := &listener{name: "HEALTH", address: ":8081"}
+	listeners, err := groupListeners(mutate, secret, health)
+	assert.NoError(t, err)
+	assert.Len(t, listeners, 2)
+	assert.Same(t, mutate.mux, secret.mux)
+	assert.NotSame(t, mutate.mux, health.mux)
+
+	// Same address with different TLS settings
+	_, err = groupListeners(&listener{name: "MUTATE", address: ":8443", tls: true}, &listener{name: "SECRET", address: ":8443"})
+	assert.Error(t, err)
+}
+
+// TestNewServer_ClientCA verifies that client certificates are required when a client CA is configured.
+func TestNewServer_ClientCA(t *testing.T) {
+	l := &listener{name: "SECRET", address: ":8444", tls: true, clientCA: "/non-existent/ca.crt"}
+	_, err := groupListeners(l)
+	assert.NoError(t, err)
+	_, err = l.newServer(nil)
+	assert.Error(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	_ = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	l.clientCA = caFile
+	server, err := l.newServer(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, server.TLSConfig.ClientAuth)
+	assert.NotNil(t, server.TLSConfig.ClientCAs)
+
+	// Client CA without TLS
+	l.tls = false
+	_, err = l.newServer(nil)
+	assert.Error(t, err)
+}
@@ -28,6 +28,8 @@ type Mutating struct {
 	registry  *ImageRegistry
 	k8sClient kubernetes.Interface
 	context   context.Context
+	caBundle  func() []byte
+	signer    *service.Signer
 }
 
 // IsKubeNamespace checks if the given namespace is a Kubernetes-owned namespace.
@@ -44,6 +46,16 @@ func NewMutating(ctx context.Context, k8sClient kubernetes.Interface) (*Mutating
 	return mutating, nil
 }
 
+// SetCABundle set a function returning the CA bundle of piggy-webhooks. The CA bundle is injected to piggy-env to verify piggy-webhooks
+func (m *Mutating) SetCABundle(caBundle func() []byte) {
+	m.caBundle = caBundle
+}
+
+// SetSigner sign piggy-uid entries with the signer. piggy-webhooks verifies them with the same key
+func (m *Mutating) SetSigner(signer *service.Signer) {
+	m.signer = signer
+}
+
 // generateUID get an uid
 func (m *Mutating) generateUID() string {
 	return strings.ReplaceAll(uuid.New().String(), "-", "")
@@ -58,19 +70,63 @@ func (m *Mutating) mergeConfig(config *service.PiggyConfig, annotations map[stri
 	config.PiggyResourceMemoryLimit, _ = resource.ParseQuantity(service.GetStringValue(annotations, service.ConfigPiggyEnvResourceMemoryLimit, "64Mi"))
 	config.PiggyPspAllowPrivilegeEscalation = service.GetBoolValue(annotations, service.ConfigPiggyPSPAllowPrivilegeEscalation, false)
 	config.PiggyAddress = service.GetStringValue(annotations, service.ConfigPiggyAddress, "")
+	config.PiggyAddressOrder = service.GetStringValue(annotations, service.ConfigPiggyAddressOrder, "")
+	config.PiggyAddressTimeout = service.GetStringValue(annotations, service.ConfigPiggyAddressTimeout, "")
+	config.PiggySkipVerifyTLS = service.GetStringValue(annotations, service.ConfigPiggySkipVerifyTLS, "")
+	config.PiggyTLSClientSecret = service.GetStringValue(annotations, service.ConfigPiggyTLSClientSecret, "")
+	// audience is controlled by piggy-webhooks only
+	config.PiggyTokenAudience = service.GetStringValue(service.EmptyMap, service.ConfigPiggyTokenAudience, service.DefaultPiggyTokenAudience)
+	config.PiggyTokenExpiration = service.GetIntValue(annotations, service.ConfigPiggyTokenExpiration, 600)
+	if config.PiggyTokenExpiration < 600 {
+		// the minimum expiration of a projected service account token
+		config.PiggyTokenExpiration = 600
+	}
+	if m.caBundle != nil {
+		config.PiggyCABundle = string(m.caBundle())
+	}
 	config.PiggyIgnoreNoEnv = service.GetBoolValue(annotations, service.ConfigPiggyIgnoreNoEnv, false)
 	config.PiggyEnforceIntegrity = service.GetBoolValue(annotations, service.ConfigPiggyEnforceIntegrity, true)
 	config.AWSSecretName = service.GetStringValue(annotations, service.AWSSecretName, "")
 	config.AWSSSMParameterPath = service.GetStringValue(annotations, service.AWSSSMParameterPath, "")
+	config.AWSSSMParameterKey = service.GetStringValue(annotations, service.AWSSSMParameterKey, "")
+	config.AWSSSMParameterSeparator = service.GetStringValue(annotations, service.AWSSSMParameterSeparator, "")
+	config.AWSSSMSplitStringList = service.GetBoolValue(annotations, service.AWSSSMSplitStringList, false)
 	config.AWSRegion = service.GetStringValue(annotations, service.ConfigAWSRegion, "")
+	config.GCPSecretName = service.GetStringValue(annotations, service.GCPSecretName, "")
+	config.GCPSecretProject = service.GetStringValue(annotations, service.GCPSecretProject, "")
+	config.GCPSecretVersion = service.GetStringValue(annotations, service.GCPSecretVersion, "")
+	// the credentials file of piggy-webhooks is not a path in the pod
+	config.GCPSecretCredentialsFile = annotations[service.Namespace+service.ConfigGCPSecretCredentialsFile]
+	config.AzureKeyVaultName = service.GetStringValue(annotations, service.AzureKeyVaultName, "")
+	config.K8sSecretName = service.GetStringValue(annotations, service.K8sSecretName, "")
+	config.SOPSConfigMap = service.GetStringValue(annotations, service.SOPSConfigMap, "")
+	config.SOPSFile = service.GetStringValue(annotations, service.SOPSFile, "")
 	config.Debug = service.GetBoolValue(annotations, service.ConfigDebug, false)
 	config.ImagePullSecret = service.GetStringValue(annotations, service.ConfigImagePullSecret, "")
 	config.ImagePullSecretNamespace = service.GetStringValue(annotations, service.ConfigImagePullSecretNamespace, "")
 	config.ImageSkipVerifyRegistry = service.GetBoolValue(annotations, service.ConfigImageSkipVerifyRegistry, true)
 	config.Standalone = service.GetBoolValue(annotations, service.ConfigStandalone, false)
+	config.PiggyFailover = service.GetBoolValue(annotations, service.ConfigPiggyFailover, false)
+	if config.K8sSecretName != "" || config.SOPSConfigMap != "" || config.SOPSFile != "" {
+		// the pod cannot read the Kubernetes Secret or decrypt the SOPS document, only piggy-webhooks can
+		config.Standalone = false
+		config.PiggyFailover = false
+	}
+	config.PiggyDefaultSecretNamePrefix = service.GetStringValue(annotations, service.ConfigPiggyDefaultSecretNamePrefix, "")
+	config.PiggyDefaultSecretNameSuffix = service.GetStringValue(annotations, service.ConfigPiggyDefaultSecretNameSuffix, "")
 	config.PiggyDNSResolver = service.GetStringValue(annotations, service.ConfigPiggyDNSResolver, "")
+	config.PiggyDNSServer = service.GetStringValue(annotations, service.ConfigPiggyDNSServer, "")
+	config.PiggyIPFamily = service.GetStringValue(annotations, service.ConfigPiggyIPFamily, "")
+	config.PiggyConnectTimeout = service.GetStringValue(annotations, service.ConfigPiggyConnectTimeout, "")
+	config.PiggyTLSHandshakeTimeout = service.GetStringValue(annotations, service.ConfigPiggyTLSHandshakeTimeout, "")
+	config.PiggyRequestTimeout = service.GetStringValue(annotations, service.ConfigPiggyRequestTimeout, "")
+	config.PiggyHTTPProxy = service.GetStringValue(annotations, service.ConfigPiggyHTTPProxy, "")
+	config.PiggyNoProxy = service.GetStringValue(annotations, service.ConfigPiggyNoProxy, "")
 	config.PiggyInitialDelay = service.GetStringValue(annotations, service.ConfigPiggyInitialDelay, "")
 	config.PiggyNumberOfRetry = service.GetIntValue(annotations, service.ConfigPiggyNumberOfRetry, 0)
+	config.PiggyRetryInitialInterval = service.GetStringValue(annotations, service.ConfigPiggyRetryInitialInterval, "")
+	config.PiggyRetryMaxInterval = service.GetStringValue(annotations, service.ConfigPiggyRetryMaxInterval, "")
+	config.PiggyRetryMaxElapsedTime = service.GetStringValue(annotations, service.ConfigPiggyRetryMaxElapsedTime, "")
 	return config
 }
 
@@ -122,7 +178,7 @@ func (m *Mutating) LookForValueFrom(env corev1.EnvVar, ns string) (*corev1.EnvVa
 			return nil, err
 		}
 		value := data[env.ValueFrom.ConfigMapKeyRef.Key]
-		if strings.HasPrefix(value, service.PrefixPiggy) {
+		if len(service.ReferenceKeys(value)) > 0 {
 			fromCM := corev1.EnvVar{
 				Name:  env.Name,
 				Value: value,
@@ -139,7 +195,7 @@ func (m *Mutating) LookForValueFrom(env corev1.EnvVar, ns string) (*corev1.EnvVa
 			return nil, err
 		}
 		value := string(data[env.ValueFrom.SecretKeyRef.Key])
-		if strings.HasPrefix(value, service.PrefixPiggy) {
+		if len(service.ReferenceKeys(value)) > 0 {
 			fromSecret := corev1.EnvVar{
 				Name:  env.Name,
 				Value: value,
@@ -165,7 +221,7 @@ func (m *Mutating) LookForEnvFrom(envFrom []corev1.EnvFromSource, ns string) ([]
 				}
 			}
 			for key, value := range data {
-				if strings.HasPrefix(value, service.PrefixPiggy) {
+				if len(service.ReferenceKeys(value)) > 0 {
 					fromCM := corev1.EnvVar{
 						Name:  key,
 						Value: value,
@@ -185,7 +241,7 @@ func (m *Mutating) LookForEnvFrom(envFrom []corev1.EnvFromSource, ns string) ([]
 			}
 			for key, v := range data {
 				value := string(v)
-				if strings.HasPrefix(value, service.PrefixPiggy) {
+				if len(service.ReferenceKeys(value)) > 0 {
 					fromSecret := corev1.EnvVar{
 						Name:  key,
 						Value: value,
@@ -318,6 +318,40 @@ func TestMergeConfig(t *testing.T) {
 	assert.Equal(t, "http://env-address", config.PiggyAddress)
 }
 
+// TestMergeConfig_K8sSecret verifies that a Kubernetes Secret is always requested from piggy-webhooks.
+func TestMergeConfig_K8sSecret(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	config := &service.PiggyConfig{}
+	m.mergeConfig(config, map[string]string{
+		service.Namespace + service.K8sSecretName:       "myapp",
+		service.Namespace + service.ConfigStandalone:    "true",
+		service.Namespace + service.ConfigPiggyFailover: "true",
+		service.Namespace + service.ConfigPiggyAddress:  "https://piggy-webhooks.piggy-webhooks.svc",
+	})
+	assert.Equal(t, "myapp", config.K8sSecretName)
+	assert.False(t, config.Standalone)
+	assert.False(t, config.PiggyFailover)
+	assert.True(t, isProxyMode(config))
+}
+
+// TestMergeConfig_SOPS verifies that a SOPS document is always decrypted by piggy-webhooks.
+func TestMergeConfig_SOPS(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	for _, name := range []string{service.SOPSConfigMap, service.SOPSFile} {
+		config := &service.PiggyConfig{}
+		m.mergeConfig(config, map[string]string{
+			service.Namespace + name:                        "myapp",
+			service.Namespace + service.ConfigStandalone:    "true",
+			service.Namespace + service.ConfigPiggyFailover: "true",
+			service.Namespace + service.ConfigPiggyAddress:  "https://piggy-webhooks.piggy-webhooks.svc",
+		})
+		assert.Equal(t, "myapp", config.SOPSConfigMap+config.SOPSFile)
+		assert.False(t, config.Standalone)
+		assert.False(t, config.PiggyFailover)
+		assert.True(t, isProxyMode(config))
+	}
+}
+
 // TestMutateCommand_Error checks that mutation continues even if image config fetching fails (it logs error).
 func TestMutateCommand_Error(t *testing.T) {
 	ctx := context.Background()
@@ -374,14 +408,26 @@ func TestMutateContainer_FullConfig(t *testing.T) {
 	}
 
 	config := &service.PiggyConfig{
-		AWSSecretName:         "my-secret",
-		AWSRegion:             "us-east-1",
-		PiggyAddress:          "http://piggy",
-		PiggyIgnoreNoEnv:      true,
-		PiggyDNSResolver:      "1.1.1.1",
-		PiggyInitialDelay:     "5s",
-		PiggyNumberOfRetry:    3,
-		PiggyEnforceIntegrity: true,
+		AWSSecretName:             "my-secret",
+		AWSRegion:                 "us-east-1",
+		PiggyAddress:              "http://piggy",
+		PiggyIgnoreNoEnv:          true,
+		PiggyDNSResolver:          "1.1.1.1",
+		PiggyInitialDelay:         "5s",
+		PiggyNumberOfRetry:        3,
+		PiggyEnforceIntegrity:     true,
+		PiggyRetryInitialInterval: "1s",
+		PiggyRetryMaxInterval:     "invalid",
+		PiggyRetryMaxElapsedTime:  "2m",
+		PiggyAddressOrder:         "random",
+		PiggyAddressTimeout:       "3s",
+		PiggyDNSServer:            "10.0.0.10:53",
+		PiggyIPFamily:             "prefer-ipv6",
+		PiggyConnectTimeout:       "1s",
+		PiggyTLSHandshakeTimeout:  "2s",
+		PiggyRequestTimeout:       "20s",
+		PiggyHTTPProxy:            "http://proxy:3128",
+		PiggyNoProxy:              ".svc",
 	}
 
 	pod := &corev1.Pod{
@@ -407,6 +453,20 @@ func TestMutateContainer_FullConfig(t *testing.T) {
 	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_DNS_RESOLVER", Value: "1.1.1.1"})
 	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_INITIAL_DELAY", Value: "5s"})
 	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_NUMBER_OF_RETRY", Value: "3"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_RETRY_INITIAL_INTERVAL", Value: "1s"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_RETRY_MAX_ELAPSED_TIME", Value: "2m"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_ADDRESS_ORDER", Value: "random"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_ADDRESS_TIMEOUT", Value: "3s"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_DNS_SERVER", Value: "10.0.0.10:53"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_IP_FAMILY", Value: "prefer-ipv6"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_CONNECT_TIMEOUT", Value: "1s"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_TLS_HANDSHAKE_TIMEOUT", Value: "2s"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_REQUEST_TIMEOUT", Value: "20s"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_HTTP_PROXY", Value: "http://proxy:3128"})
+	assert.Contains(t, env, corev1.EnvVar{Name: "PIGGY_NO_PROXY", Value: ".svc"})
+	for _, e := range env {
+		assert.NotEqual(t, "PIGGY_RETRY_MAX_INTERVAL", e.Name)
+	}
 }
 
 // TestMutateContainer_EnvFromError verifies that mutation fails if EnvFrom lookup errors out.
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -14,7 +15,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 )
 
-type Signature map[string]string
+type Signature = service.Signature
 
 func getSecurityContext(config *service.PiggyConfig, podSecurityContext *corev1.PodSecurityContext) *corev1.SecurityContext {
 	sc := &corev1.SecurityContext{
@@ -26,6 +27,34 @@ func getSecurityContext(config *service.PiggyConfig, podSecurityContext *corev1.
 	return sc
 }
 
+// isProxyMode piggy-env requests secrets from piggy-webhooks, or fails over to piggy-webhooks in standalone mode
+func isProxyMode(config *service.PiggyConfig) bool {
+	return config.PiggyAddress != "" && (!config.Standalone || config.PiggyFailover)
+}
+
+// failoverSecretName returns the secret name piggy-env reads when failing over to standalone mode.
+// piggy-webhooks falls back to the default secret name of the service account, so piggy-env needs to know it
+func failoverSecretName(config *service.PiggyConfig, pod *corev1.Pod) string {
+	if !config.PiggyFailover || config.Standalone || config.AWSSecretName != "" || config.AWSSSMParameterPath != "" || config.GCPSecretName != "" || config.AzureKeyVaultName != "" {
+		return config.AWSSecretName
+	}
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	return fmt.Sprintf("%s%s/%s%s", config.PiggyDefaultSecretNamePrefix, pod.Namespace, serviceAccount, config.PiggyDefaultSecretNameSuffix)
+}
+
+// usePiggyTLSClientSecret piggy-env presents a client certificate only in proxy mode
+func usePiggyTLSClientSecret(config *service.PiggyConfig) bool {
+	return isProxyMode(config) && config.PiggyTLSClientSecret != ""
+}
+
+// usePiggyToken piggy-env sends a projected service account token only in proxy mode
+func usePiggyToken(config *service.PiggyConfig) bool {
+	return isProxyMode(config) && config.PiggyTokenAudience != ""
+}
+
 func (m *Mutating) mutateCommand(config *service.PiggyConfig, container *corev1.Container, pod *corev1.Pod) ([]string, bool, error) {
 	// check if already mutated
 	if len(container.Command) == 1 && container.Command[0] == "/piggy/piggy-env" {
@@ -62,14 +91,15 @@ func (m *Mutating) mutateCommand(config *service.PiggyConfig, container *corev1.
 	return entry, true, nil
 }
 
-func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, container *corev1.Container, pod *corev1.Pod) (string, bool, error) {
+// mutateContainer returns the piggy-uid data of the container and whether the container was mutated
+func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, container *corev1.Container, pod *corev1.Pod) (service.SignatureEntry, bool, error) {
 	mutate := false
 	mutated := false
 	var envVars []corev1.EnvVar
 	if len(container.EnvFrom) > 0 {
 		envFrom, err := m.LookForEnvFrom(container.EnvFrom, pod.Namespace)
 		if err != nil {
-			return "", false, fmt.Errorf("unable to read envFrom: %v", err)
+			return service.SignatureEntry{}, false, fmt.Errorf("unable to read envFrom: %v", err)
 		}
 		envVars = append(envVars, envFrom...)
 	}
@@ -77,7 +107,7 @@ func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, cont
 		if env.ValueFrom != nil {
 			valueFrom, err := m.LookForValueFrom(env, pod.Namespace)
 			if err != nil {
-				return "", false, fmt.Errorf("unable to read valueFrom: %v", err)
+				return service.SignatureEntry{}, false, fmt.Errorf("unable to read valueFrom: %v", err)
 			}
 			if valueFrom != nil {
 				envVars = append(envVars, *valueFrom)
@@ -86,21 +116,26 @@ func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, cont
 			envVars = append(envVars, env)
 		}
 	}
+	// secret keys referenced by the container
+	var keys []string
 	for _, env := range envVars {
-		if strings.HasPrefix(env.Value, service.PrefixPiggy) {
+		for _, key := range service.ReferenceKeys(env.Value) {
 			mutate = true
-			break
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
 		}
 	}
 	if !mutate {
 		log.Debug().Str("namespace", pod.Namespace).Msgf("Skip mutating '%s' container ...", container.Name)
-		return "", false, nil
+		return service.SignatureEntry{}, false, nil
 	}
+	slices.Sort(keys)
 	// env vars to inject
 	envs := []corev1.EnvVar{
 		{
 			Name:  "PIGGY_AWS_SECRET_NAME",
-			Value: config.AWSSecretName,
+			Value: failoverSecretName(config, pod),
 		},
 		{
 			Name:  "PIGGY_AWS_REGION",
@@ -111,12 +146,52 @@ func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, cont
 			Value: config.AWSSSMParameterPath,
 		},
 	}
+	for _, env := range []corev1.EnvVar{
+		{Name: "PIGGY_AWS_SSM_PARAMETER_KEY", Value: config.AWSSSMParameterKey},
+		{Name: "PIGGY_AWS_SSM_PARAMETER_SEPARATOR", Value: config.AWSSSMParameterSeparator},
+	} {
+		if env.Value != "" {
+			envs = append(envs, env)
+		}
+	}
+	if config.AWSSSMSplitStringList {
+		envs = append(envs, corev1.EnvVar{Name: "PIGGY_AWS_SSM_SPLIT_STRING_LIST", Value: "true"})
+	}
+	if config.GCPSecretName != "" {
+		envs = append(envs, corev1.EnvVar{Name: "PIGGY_GCP_SECRET_NAME", Value: config.GCPSecretName})
+		for _, env := range []corev1.EnvVar{
+			{Name: "PIGGY_GCP_SECRET_PROJECT", Value: config.GCPSecretProject},
+			{Name: "PIGGY_GCP_SECRET_VERSION", Value: config.GCPSecretVersion},
+			{Name: "PIGGY_GCP_SECRET_CREDENTIALS_FILE", Value: config.GCPSecretCredentialsFile},
+		} {
+			if env.Value != "" {
+				envs = append(envs, env)
+			}
+		}
+	}
+	if config.AzureKeyVaultName != "" {
+		envs = append(envs, corev1.EnvVar{Name: "PIGGY_AZURE_KEY_VAULT_NAME", Value: config.AzureKeyVaultName})
+	}
+	if slices.ContainsFunc(keys, func(key string) bool { return strings.HasPrefix(key, service.PrefixKMS) }) {
+		// piggy-env decrypts inline KMS ciphertexts with the encryption context of the pod service account in standalone mode
+		envs = append(envs, corev1.EnvVar{
+			Name:      "PIGGY_POD_NAMESPACE",
+			ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}},
+		}, corev1.EnvVar{
+			Name:      "PIGGY_SERVICE_ACCOUNT_NAME",
+			ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.serviceAccountName"}},
+		})
+	}
 	if config.Debug {
 		envs = append(envs, corev1.EnvVar{Name: "PIGGY_DEBUG", Value: "true"})
 	}
 	if config.Standalone {
 		envs = append(envs, corev1.EnvVar{Name: "PIGGY_STANDALONE", Value: "true"})
-	} else if config.PiggyAddress != "" {
+	}
+	if config.PiggyFailover {
+		envs = append(envs, corev1.EnvVar{Name: "PIGGY_FAILOVER", Value: "true"})
+	}
+	if isProxyMode(config) {
 		envs = append(envs, corev1.EnvVar{
 			Name:  "PIGGY_ADDRESS",
 			Value: config.PiggyAddress,
@@ -131,6 +206,49 @@ func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, cont
 			Name:  "PIGGY_UID",
 			Value: uid,
 		})
+		switch config.PiggyIPFamily {
+		case "ipv4", "ipv6", "prefer-ipv4", "prefer-ipv6":
+			envs = append(envs, corev1.EnvVar{Name: "PIGGY_IP_FAMILY", Value: config.PiggyIPFamily})
+		}
+		for _, env := range []corev1.EnvVar{
+			{Name: "PIGGY_CONNECT_TIMEOUT", Value: config.PiggyConnectTimeout},
+			{Name: "PIGGY_TLS_HANDSHAKE_TIMEOUT", Value: config.PiggyTLSHandshakeTimeout},
+			{Name: "PIGGY_REQUEST_TIMEOUT", Value: config.PiggyRequestTimeout},
+		} {
+			if _, err := time.ParseDuration(env.Value); err == nil {
+				envs = append(envs, env)
+			}
+		}
+		if config.PiggyHTTPProxy != "" {
+			envs = append(envs, corev1.EnvVar{Name: "PIGGY_HTTP_PROXY", Value: config.PiggyHTTPProxy})
+		}
+		if config.PiggyNoProxy != "" {
+			envs = append(envs, corev1.EnvVar{Name: "PIGGY_NO_PROXY", Value: config.PiggyNoProxy})
+		}
+		if config.PiggyAddressOrder == "random" {
+			envs = append(envs, corev1.EnvVar{Name: "PIGGY_ADDRESS_ORDER", Value: config.PiggyAddressOrder})
+		}
+		if _, err := time.ParseDuration(config.PiggyAddressTimeout); err == nil {
+			envs = append(envs, corev1.EnvVar{Name: "PIGGY_ADDRESS_TIMEOUT", Value: config.PiggyAddressTimeout})
+		}
+		if usePiggyToken(config) {
+			envs = append(envs, corev1.EnvVar{Name: "PIGGY_TOKEN_FILE", Value: service.PiggyTokenMountPath + "token"})
+		}
+		if config.PiggySkipVerifyTLS != "" {
+			envs = append(envs, corev1.EnvVar{Name: "PIGGY_SKIP_VERIFY_TLS", Value: config.PiggySkipVerifyTLS})
+		}
+		if config.PiggyCABundle != "" {
+			envs = append(envs, corev1.EnvVar{Name: "PIGGY_CA_BUNDLE", Value: config.PiggyCABundle})
+		}
+		if config.PiggyTLSClientSecret != "" {
+			envs = append(envs, corev1.EnvVar{
+				Name:  "PIGGY_TLS_CLIENT_CERT_FILE",
+				Value: "/piggy-tls/" + corev1.TLSCertKey,
+			}, corev1.EnvVar{
+				Name:  "PIGGY_TLS_CLIENT_KEY_FILE",
+				Value: "/piggy-tls/" + corev1.TLSPrivateKeyKey,
+			})
+		}
 	}
 	if config.PiggyIgnoreNoEnv {
 		envs = append(envs, corev1.EnvVar{Name: "PIGGY_IGNORE_NO_ENV", Value: "true"})
@@ -138,6 +256,9 @@ func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, cont
 	if config.PiggyDNSResolver != "" {
 		envs = append(envs, corev1.EnvVar{Name: "PIGGY_DNS_RESOLVER", Value: config.PiggyDNSResolver})
 	}
+	if config.PiggyDNSServer != "" {
+		envs = append(envs, corev1.EnvVar{Name: "PIGGY_DNS_SERVER", Value: config.PiggyDNSServer})
+	}
 	if config.PiggyInitialDelay != "" {
 		if _, err := time.ParseDuration(config.PiggyInitialDelay); err == nil {
 			envs = append(envs, corev1.EnvVar{Name: "PIGGY_INITIAL_DELAY", Value: config.PiggyInitialDelay})
@@ -147,6 +268,15 @@ func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, cont
 		val := strconv.FormatInt(int64(config.PiggyNumberOfRetry), 10)
 		envs = append(envs, corev1.EnvVar{Name: "PIGGY_NUMBER_OF_RETRY", Value: val})
 	}
+	for _, env := range []corev1.EnvVar{
+		{Name: "PIGGY_RETRY_INITIAL_INTERVAL", Value: config.PiggyRetryInitialInterval},
+		{Name: "PIGGY_RETRY_MAX_INTERVAL", Value: config.PiggyRetryMaxInterval},
+		{Name: "PIGGY_RETRY_MAX_ELAPSED_TIME", Value: config.PiggyRetryMaxElapsedTime},
+	} {
+		if _, err := time.ParseDuration(env.Value); err == nil {
+			envs = append(envs, env)
+		}
+	}
 
 	for _, env := range envs {
 		found := false
@@ -181,6 +311,40 @@ func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, cont
 		})
 		mutated = true
 	}
+	if usePiggyToken(config) {
+		foundTokenVolumeMount := false
+		for _, vm := range container.VolumeMounts {
+			if vm.Name == service.VolumeNamePiggyToken {
+				foundTokenVolumeMount = true
+				break
+			}
+		}
+		if !foundTokenVolumeMount {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      service.VolumeNamePiggyToken,
+				MountPath: service.PiggyTokenMountPath,
+				ReadOnly:  true,
+			})
+			mutated = true
+		}
+	}
+	if usePiggyTLSClientSecret(config) {
+		foundTLSVolumeMount := false
+		for _, vm := range container.VolumeMounts {
+			if vm.Name == service.VolumeNamePiggyTLS {
+				foundTLSVolumeMount = true
+				break
+			}
+		}
+		if !foundTLSVolumeMount {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      service.VolumeNamePiggyTLS,
+				MountPath: "/piggy-tls/",
+				ReadOnly:  true,
+			})
+			mutated = true
+		}
+	}
 	log.Debug().Str("namespace", pod.Namespace).Msgf("Modifying command '%s' containers ...", container.Name)
 	var args []string
 	var err error
@@ -198,14 +362,39 @@ func (m *Mutating) mutateContainer(uid string, config *service.PiggyConfig, cont
 	if err != nil {
 		log.Error().Msgf("%v", err)
 	}
-	return fmt.Sprintf("%x", h.Sum(nil)), mutated, nil
+	entry := service.SignatureEntry{Signature: fmt.Sprintf("%x", h.Sum(nil)), Keys: keys}
+	if m.signer != nil && isProxyMode(config) {
+		entry.Container = container.Name
+		digest, err := m.registry.GetImageDigest(m.context, config, pod.Namespace, *container, pod.Spec)
+		if err != nil {
+			if !service.GetBoolValue(service.EmptyMap, service.ConfigPiggyAllowUnpinnedImage, false) {
+				return entry, mutated, fmt.Errorf("unable to resolve '%s' container image digest: %v", container.Name, err)
+			}
+			log.Warn().Str("namespace", pod.Namespace).Str("pod_name", pod.Name).Msgf("Signing '%s' container without an image digest [%v]", container.Name, err)
+		}
+		entry.Image = digest
+		if digest != "" && !strings.Contains(container.Image, "@") {
+			// run exactly the signed image, instead of an older image of a mutable tag cached on the node
+			container.Image = fmt.Sprintf("%s@%s", container.Image, digest)
+			mutated = true
+		}
+		command := ""
+		if config.PiggyEnforceIntegrity {
+			command = entry.Signature
+		}
+		entry = m.signer.Sign(entry, command)
+	}
+	return entry, mutated, nil
 }
 
 // MutatePod mutate pod
 func (m *Mutating) MutatePod(config *service.PiggyConfig, pod *corev1.Pod) (interface{}, error) {
 	start := time.Now()
-	// Mutate pod only when it containing piggysec.com/aws-secret-name or piggysec.com/aws-ssm-parameter-path or piggysec.com/piggy-address annotation
-	if config.AWSSecretName != "" || config.AWSSSMParameterPath != "" || config.PiggyAddress != "" {
+	// Mutate pod only when it containing piggysec.com/aws-secret-name, piggysec.com/aws-ssm-parameter-path, piggysec.com/gcp-secret-name,
+	// piggysec.com/azure-key-vault-name, piggysec.com/k8s-secret-name, piggysec.com/sops-configmap, piggysec.com/sops-file
+	// or piggysec.com/piggy-address annotation
+	if config.AWSSecretName != "" || config.AWSSSMParameterPath != "" || config.GCPSecretName != "" || config.AzureKeyVaultName != "" ||
+		config.K8sSecretName != "" || config.SOPSConfigMap != "" || config.SOPSFile != "" || config.PiggyAddress != "" {
 		wasMutated := false
 		signature := make(Signature)
 		log.Debug().Str("namespace", pod.Namespace).Msgf("Adding volumes to podspec ...")
@@ -227,6 +416,55 @@ func (m *Mutating) MutatePod(config *service.PiggyConfig, pod *corev1.Pod) (inte
 			})
 			wasMutated = true
 		}
+		if usePiggyToken(config) {
+			foundTokenVolume := false
+			for _, v := range pod.Spec.Volumes {
+				if v.Name == service.VolumeNamePiggyToken {
+					foundTokenVolume = true
+					break
+				}
+			}
+			if !foundTokenVolume {
+				expiration := int64(config.PiggyTokenExpiration)
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+					Name: service.VolumeNamePiggyToken,
+					VolumeSource: corev1.VolumeSource{
+						Projected: &corev1.ProjectedVolumeSource{
+							Sources: []corev1.VolumeProjection{
+								{
+									ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+										Audience:          config.PiggyTokenAudience,
+										ExpirationSeconds: &expiration,
+										Path:              "token",
+									},
+								},
+							},
+						},
+					},
+				})
+				wasMutated = true
+			}
+		}
+		if usePiggyTLSClientSecret(config) {
+			foundTLSVolume := false
+			for _, v := range pod.Spec.Volumes {
+				if v.Name == service.VolumeNamePiggyTLS {
+					foundTLSVolume = true
+					break
+				}
+			}
+			if !foundTLSVolume {
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+					Name: service.VolumeNamePiggyTLS,
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: config.PiggyTLSClientSecret,
+						},
+					},
+				})
+				wasMutated = true
+			}
+		}
 		log.Debug().Str("namespace", pod.Namespace).Msgf("Mutating init-containers ...")
 		for i := range pod.Spec.InitContainers {
 			var err error
@@ -239,7 +477,7 @@ func (m *Mutating) MutatePod(config *service.PiggyConfig, pod *corev1.Pod) (inte
 			if mutated {
 				wasMutated = true
 			}
-			if sig != "" {
+			if sig.Signature != "" {
 				signature[uid] = sig
 			}
 		}
@@ -292,7 +530,7 @@ func (m *Mutating) MutatePod(config *service.PiggyConfig, pod *corev1.Pod) (inte
 			if mutated {
 				wasMutated = true
 			}
-			if sig != "" {
+			if sig.Signature != "" {
 				signature[uid] = sig
 			}
 		}
@@ -2,6 +2,9 @@ package mutate
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/KongZ/piggy/piggy-webhooks/service"
@@ -131,7 +134,8 @@ func TestMutateContainer_EnvFrom(t *testing.T) {
 	sig, mutated, err := m.mutateContainer("uid", config, container, pod)
 	assert.NoError(t, err)
 	assert.True(t, mutated)
-	assert.NotEmpty(t, sig)
+	assert.NotEmpty(t, sig.Signature)
+	assert.Equal(t, []string{"secret1"}, sig.Keys)
 
 	// Verify injection
 	found := false
@@ -186,3 +190,330 @@ func TestMutatePod_GranularIdempotency(t *testing.T) {
 	assert.Len(t, pod.Spec.Volumes, 1)
 	assert.Len(t, pod.Spec.InitContainers, 1)
 }
+
+// TestMutatePod_TLSClientSecret verifies that the client certificate secret, CA bundle and projected token are injected in proxy mode.
+func TestMutatePod_TLSClientSecret(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset()
+	m, _ := NewMutating(ctx, client)
+	m.SetCABundle(func() []byte { return []byte("ca-bundle") })
+	config := m.mergeConfig(&service.PiggyConfig{}, map[string]string{
+		service.Namespace + service.ConfigPiggyAddress:         "https://piggy-webhooks.piggy-webhooks.svc",
+		service.Namespace + service.ConfigPiggyTLSClientSecret: "piggy-client-tls",
+	})
+	m.registry = NewRegistry(config)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "app",
+					Command: []string{"app"},
+					Env: []corev1.EnvVar{
+						{Name: "DB", Value: "piggy:db"},
+					},
+				},
+			},
+		},
+	}
+	_, err := m.MutatePod(config, pod)
+	assert.NoError(t, err)
+	volumes := make(map[string]corev1.Volume)
+	for _, v := range pod.Spec.Volumes {
+		volumes[v.Name] = v
+	}
+	assert.Len(t, volumes, 3)
+	assert.Equal(t, "piggy-client-tls", volumes[service.VolumeNamePiggyTLS].Secret.SecretName)
+	token := volumes[service.VolumeNamePiggyToken].Projected.Sources[0].ServiceAccountToken
+	assert.Equal(t, service.DefaultPiggyTokenAudience, token.Audience)
+	assert.Equal(t, int64(600), *token.ExpirationSeconds)
+
+	container := pod.Spec.Containers[0]
+	assert.Contains(t, container.VolumeMounts, corev1.VolumeMount{Name: service.VolumeNamePiggyTLS, MountPath: "/piggy-tls/", ReadOnly: true})
+	envs := make(map[string]string)
+	for _, env := range container.Env {
+		envs[env.Name] = env.Value
+	}
+	assert.Equal(t, "ca-bundle", envs["PIGGY_CA_BUNDLE"])
+	assert.Equal(t, "/piggy-tls/tls.crt", envs["PIGGY_TLS_CLIENT_CERT_FILE"])
+	assert.Equal(t, "/piggy-tls/tls.key", envs["PIGGY_TLS_CLIENT_KEY_FILE"])
+	assert.Equal(t, service.PiggyTokenMountPath+"token", envs["PIGGY_TOKEN_FILE"])
+
+	// Reinvocation should not duplicate
+	_, err = m.MutatePod(config, pod)
+	assert.NoError(t, err)
+	assert.Len(t, pod.Spec.Volumes, 3)
+	assert.Len(t, pod.Spec.Containers[0].VolumeMounts, 3)
+}
+
+// TestMutateContainer_Signer verifies that entries are signed with the container name, image digest and references in proxy mode.
+func TestMutateContainer_Signer(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	m.registry = NewRegistry(&service.PiggyConfig{})
+	m.registry.digestFetcher = func(ctx context.Context, config *service.PiggyConfig, container containerInfo) (string, error) {
+		return "sha256:abc", nil
+	}
+	signer, _ := service.NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	m.SetSigner(signer)
+
+	config := &service.PiggyConfig{
+		AWSSecretName:         "my-secret",
+		PiggyAddress:          "https://piggy",
+		PiggyEnforceIntegrity: true,
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	container := &corev1.Container{
+		Name:    "app",
+		Image:   "my-image:v1",
+		Command: []string{"echo"},
+		Env: []corev1.EnvVar{
+			{Name: "DB_PASS", Value: "piggy:DB_PASS"},
+		},
+	}
+	sig, _, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, service.SignatureVersionHMAC, sig.Version)
+	assert.Equal(t, "app", sig.Container)
+	assert.Equal(t, "sha256:abc", sig.Image)
+	// the image is pinned to the signed digest
+	assert.Equal(t, "my-image:v1@sha256:abc", container.Image)
+	// piggy-env sends SHA-256 of the command
+	command := fmt.Sprintf("%x", sha256.Sum256([]byte("echo")))
+	assert.True(t, signer.Verify(sig, command, []string{"DB_PASS"}))
+
+	// Case 2: Reject the pod when the image digest cannot be resolved
+	m.registry = NewRegistry(&service.PiggyConfig{})
+	m.registry.digestFetcher = func(ctx context.Context, config *service.PiggyConfig, container containerInfo) (string, error) {
+		return "", errors.New("registry error")
+	}
+	_, _, err = m.mutateContainer("uid", config, container, pod)
+	assert.ErrorContains(t, err, "unable to resolve 'app' container image digest")
+
+	// Case 3: Sign without an image digest when allowed
+	t.Setenv("PIGGY_ALLOW_UNPINNED_IMAGE", "true")
+	sig, _, err = m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, sig.Image)
+	assert.True(t, signer.Verify(sig, command, []string{"DB_PASS"}))
+
+	// Not signed in standalone mode
+	config.Standalone = true
+	sig, _, err = m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.Zero(t, sig.Version)
+}
+
+// TestMutateContainer_Failover verifies that piggy-env gets the env of both modes when failover is enabled.
+func TestMutateContainer_Failover(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	envOf := func(container *corev1.Container) map[string]string {
+		env := make(map[string]string)
+		for _, e := range container.Env {
+			env[e.Name] = e.Value
+		}
+		return env
+	}
+	newContainer := func() *corev1.Container {
+		return &corev1.Container{
+			Name:    "app",
+			Command: []string{"echo"},
+			Env:     []corev1.EnvVar{{Name: "DB_PASS", Value: "piggy:DB_PASS"}},
+		}
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "app-sa"},
+	}
+
+	// Case 1: Proxy mode fails over to the default secret name
+	config := &service.PiggyConfig{
+		PiggyAddress:                 "https://piggy",
+		PiggyFailover:                true,
+		PiggyDefaultSecretNamePrefix: "prod/",
+	}
+	container := newContainer()
+	_, _, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	env := envOf(container)
+	assert.Equal(t, "https://piggy", env["PIGGY_ADDRESS"])
+	assert.Equal(t, "true", env["PIGGY_FAILOVER"])
+	assert.Equal(t, "prod/default/app-sa", env["PIGGY_AWS_SECRET_NAME"])
+
+	// Case 2: Standalone mode fails over to piggy-webhooks
+	config = &service.PiggyConfig{
+		AWSSecretName: "my-secret",
+		PiggyAddress:  "https://piggy",
+		Standalone:    true,
+		PiggyFailover: true,
+	}
+	container = newContainer()
+	_, _, err = m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	env = envOf(container)
+	assert.Equal(t, "true", env["PIGGY_STANDALONE"])
+	assert.Equal(t, "https://piggy", env["PIGGY_ADDRESS"])
+	assert.Equal(t, "uid", env["PIGGY_UID"])
+	assert.Equal(t, "my-secret", env["PIGGY_AWS_SECRET_NAME"])
+
+	// Case 3: No failover
+	config.PiggyFailover = false
+	container = newContainer()
+	_, _, err = m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	env = envOf(container)
+	assert.NotContains(t, env, "PIGGY_ADDRESS")
+	assert.NotContains(t, env, "PIGGY_FAILOVER")
+}
+
+// TestMutateContainer_GCP verifies that GCP secret settings are injected.
+func TestMutateContainer_GCP(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	config := &service.PiggyConfig{
+		GCPSecretName:            "my-secret",
+		GCPSecretProject:         "my-project",
+		GCPSecretCredentialsFile: "/var/run/secrets/gcp/key.json",
+		Standalone:               true,
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	container := &corev1.Container{
+		Name:    "app",
+		Command: []string{"echo"},
+		Env:     []corev1.EnvVar{{Name: "DB_PASS", Value: "piggy:DB_PASS"}},
+	}
+	_, _, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.Contains(t, container.Env, corev1.EnvVar{Name: "PIGGY_GCP_SECRET_NAME", Value: "my-secret"})
+	assert.Contains(t, container.Env, corev1.EnvVar{Name: "PIGGY_GCP_SECRET_PROJECT", Value: "my-project"})
+	assert.Contains(t, container.Env, corev1.EnvVar{Name: "PIGGY_GCP_SECRET_CREDENTIALS_FILE", Value: "/var/run/secrets/gcp/key.json"})
+	for _, env := range container.Env {
+		assert.NotEqual(t, "PIGGY_GCP_SECRET_VERSION", env.Name)
+	}
+}
+
+// TestMutateContainer_Azure verifies that the Azure Key Vault name is injected.
+func TestMutateContainer_Azure(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	config := &service.PiggyConfig{
+		AzureKeyVaultName: "my-vault",
+		Standalone:        true,
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	container := &corev1.Container{
+		Name:    "app",
+		Command: []string{"echo"},
+		Env:     []corev1.EnvVar{{Name: "DB_PASS", Value: "piggy:DB_PASS"}},
+	}
+	_, _, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.Contains(t, container.Env, corev1.EnvVar{Name: "PIGGY_AZURE_KEY_VAULT_NAME", Value: "my-vault"})
+}
+
+// TestMutateContainer_KMS verifies that piggy-env gets the encryption context of inline KMS ciphertexts.
+func TestMutateContainer_KMS(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	config := &service.PiggyConfig{
+		AWSSecretName: "my-secret",
+		Standalone:    true,
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	namespace := corev1.EnvVar{
+		Name:      "PIGGY_POD_NAMESPACE",
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}},
+	}
+	serviceAccount := corev1.EnvVar{
+		Name:      "PIGGY_SERVICE_ACCOUNT_NAME",
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.serviceAccountName"}},
+	}
+
+	// Case 1: No KMS ciphertext
+	container := &corev1.Container{
+		Name:    "app",
+		Command: []string{"echo"},
+		Env:     []corev1.EnvVar{{Name: "DB_PASS", Value: "piggy:DB_PASS"}},
+	}
+	_, _, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.NotContains(t, container.Env, namespace)
+
+	// Case 2: KMS ciphertext
+	container = &corev1.Container{
+		Name:    "app",
+		Command: []string{"echo"},
+		Env:     []corev1.EnvVar{{Name: "API_TOKEN", Value: "piggy:kms:AQICAHh="}},
+	}
+	entry, _, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kms:AQICAHh="}, entry.Keys)
+	assert.Contains(t, container.Env, namespace)
+	assert.Contains(t, container.Env, serviceAccount)
+}
+
+// TestMutateContainer_SSMParameterKey verifies that piggy-env gets the SSM parameter key mapping.
+func TestMutateContainer_SSMParameterKey(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	config := &service.PiggyConfig{Standalone: true}
+	m.mergeConfig(config, map[string]string{
+		service.Namespace + service.AWSSSMParameterPath:      "/app",
+		service.Namespace + service.AWSSSMParameterKey:       "path",
+		service.Namespace + service.AWSSSMParameterSeparator: ".",
+	})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	container := &corev1.Container{
+		Name:    "app",
+		Command: []string{"echo"},
+		Env:     []corev1.EnvVar{{Name: "DB_PASS", Value: "piggy:db.password"}},
+	}
+	_, _, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.Contains(t, container.Env, corev1.EnvVar{Name: "PIGGY_AWS_SSM_PARAMETER_KEY", Value: "path"})
+	assert.Contains(t, container.Env, corev1.EnvVar{Name: "PIGGY_AWS_SSM_PARAMETER_SEPARATOR", Value: "."})
+}
+
+func TestMutateContainer_SSMSplitStringList(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	config := &service.PiggyConfig{Standalone: true}
+	m.mergeConfig(config, map[string]string{
+		service.Namespace + service.AWSSSMSplitStringList: "true",
+	})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	container := &corev1.Container{
+		Name:    "app",
+		Command: []string{"echo"},
+		Env:     []corev1.EnvVar{{Name: "HOSTS", Value: "piggy:ssm:/shared/hosts:prod"}},
+	}
+	entry, _, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ssm:/shared/hosts:prod"}, entry.Keys)
+	assert.Contains(t, container.Env, corev1.EnvVar{Name: "PIGGY_AWS_SSM_SPLIT_STRING_LIST", Value: "true"})
+}
+
+func TestMutateContainer_EmbeddedReferences(t *testing.T) {
+	m, _ := NewMutating(context.Background(), fake.NewClientset())
+	config := &service.PiggyConfig{Standalone: true}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	container := &corev1.Container{
+		Name:    "app",
+		Command: []string{"echo"},
+		Env: []corev1.EnvVar{
+			{Name: "DATABASE_URL", Value: "postgres://app:${piggy:DB_PASS}@db:5432/app"},
+			{Name: "LITERAL", Value: "$${piggy:NOT_A_KEY}"},
+		},
+	}
+	entry, mutated, err := m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.True(t, mutated)
+	assert.Equal(t, []string{"DB_PASS"}, entry.Keys)
+
+	// escaped references only
+	container = &corev1.Container{
+		Name:    "app",
+		Command: []string{"echo"},
+		Env:     []corev1.EnvVar{{Name: "LITERAL", Value: "$${piggy:NOT_A_KEY}"}},
+	}
+	_, mutated, err = m.mutateContainer("uid", config, container, pod)
+	assert.NoError(t, err)
+	assert.False(t, mutated)
+}
@@ -23,17 +23,21 @@ type containerInfo struct {
 
 // ImageRegistry object
 type ImageRegistry struct {
-	imageCache   map[string]*v1.Config
-	config       *service.PiggyConfig
-	imageFetcher func(ctx context.Context, config *service.PiggyConfig, container containerInfo) (*v1.Config, error)
+	imageCache    map[string]*v1.Config
+	digestCache   map[string]string
+	config        *service.PiggyConfig
+	imageFetcher  func(ctx context.Context, config *service.PiggyConfig, container containerInfo) (*v1.Config, error)
+	digestFetcher func(ctx context.Context, config *service.PiggyConfig, container containerInfo) (string, error)
 }
 
 // NewRegistry creates and initializes registry
 func NewRegistry(config *service.PiggyConfig) *ImageRegistry {
 	return &ImageRegistry{
-		imageCache:   make(map[string]*v1.Config),
-		config:       config,
-		imageFetcher: getImageConfig,
+		imageCache:    make(map[string]*v1.Config),
+		digestCache:   make(map[string]string),
+		config:        config,
+		imageFetcher:  getImageConfig,
+		digestFetcher: getImageDigest,
 	}
 }
 
@@ -47,8 +51,7 @@ func isAllowedToCache(container corev1.Container) bool {
 	return false
 }
 
-func getImageConfig(ctx context.Context, config *service.PiggyConfig, container containerInfo) (*v1.Config, error) {
-	log.Debug().Msgf("Reading image %s", container.Image)
+func remoteOptions(ctx context.Context, config *service.PiggyConfig, container containerInfo) ([]remote.Option, error) {
 	kc, err := k8schain.NewInCluster(ctx, k8schain.Options{
 		Namespace:          container.Namespace,
 		ServiceAccountName: container.ServiceAccountName,
@@ -69,6 +72,15 @@ func getImageConfig(ctx context.Context, config *service.PiggyConfig, container
 		}
 		options = append(options, remote.WithTransport(tr))
 	}
+	return options, nil
+}
+
+func getImageConfig(ctx context.Context, config *service.PiggyConfig, container containerInfo) (*v1.Config, error) {
+	log.Debug().Msgf("Reading image %s", container.Image)
+	options, err := remoteOptions(ctx, config, container)
+	if err != nil {
+		return nil, err
+	}
 	ref, err := name.ParseReference(container.Image)
 	if err != nil {
 		return nil, err
@@ -92,12 +104,53 @@ func getImageConfig(ctx context.Context, config *service.PiggyConfig, container
 	return &configFile.Config, nil
 }
 
+func getImageDigest(ctx context.Context, config *service.PiggyConfig, container containerInfo) (string, error) {
+	ref, err := name.ParseReference(container.Image)
+	if err != nil {
+		return "", err
+	}
+	if digest, ok := ref.(name.Digest); ok {
+		return digest.DigestStr(), nil
+	}
+	log.Debug().Msgf("Resolving image digest %s", container.Image)
+	options, err := remoteOptions(ctx, config, container)
+	if err != nil {
+		return "", err
+	}
+	descriptor, err := remote.Head(ref, options...)
+	if err != nil {
+		return "", err
+	}
+	return descriptor.Digest.String(), nil
+}
+
 // GetImageConfig returns entrypoint and command of container
 func (r *ImageRegistry) GetImageConfig(ctx context.Context, config *service.PiggyConfig, namespace string, container corev1.Container, podSpec corev1.PodSpec) (*v1.Config, error) {
 	if imageConfig, found := r.imageCache[container.Image]; found {
 		log.Debug().Msgf("found image %s in cache", container.Image)
 		return imageConfig, nil
 	}
+	imageConfig, err := r.imageFetcher(ctx, config, newContainerInfo(config, namespace, container, podSpec))
+	if imageConfig != nil && isAllowedToCache(container) {
+		r.imageCache[container.Image] = imageConfig
+	}
+	return imageConfig, err
+}
+
+// GetImageDigest returns the digest the container image resolves to
+func (r *ImageRegistry) GetImageDigest(ctx context.Context, config *service.PiggyConfig, namespace string, container corev1.Container, podSpec corev1.PodSpec) (string, error) {
+	if digest, found := r.digestCache[container.Image]; found {
+		log.Debug().Msgf("found image digest %s in cache", container.Image)
+		return digest, nil
+	}
+	digest, err := r.digestFetcher(ctx, config, newContainerInfo(config, namespace, container, podSpec))
+	if digest != "" && isAllowedToCache(container) {
+		r.digestCache[container.Image] = digest
+	}
+	return digest, err
+}
+
+func newContainerInfo(config *service.PiggyConfig, namespace string, container corev1.Container, podSpec corev1.PodSpec) containerInfo {
 	containerInfo := containerInfo{
 		Namespace:          namespace,
 		ServiceAccountName: podSpec.ServiceAccountName,
@@ -120,9 +173,5 @@ func (r *ImageRegistry) GetImageConfig(ctx context.Context, config *service.Pigg
 		containerInfo.ImagePullSecrets = append(containerInfo.ImagePullSecrets, config.ImagePullSecret)
 	}
 	log.Debug().Msgf("Container info %+v", containerInfo)
-	imageConfig, err := r.imageFetcher(ctx, config, containerInfo)
-	if imageConfig != nil && isAllowedToCache(container) {
-		r.imageCache[container.Image] = imageConfig
-	}
-	return imageConfig, err
+	return containerInfo
 }
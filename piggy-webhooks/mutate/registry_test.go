@@ -2,6 +2,7 @@ package mutate
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/KongZ/piggy/piggy-webhooks/service"
@@ -98,3 +99,25 @@ func TestGetImageConfig_Fetch(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, expectedConfig, result)
 }
+
+// TestGetImageDigest verifies that digests are resolved once and taken from digest references without a lookup.
+func TestGetImageDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	digest, err := getImageDigest(context.Background(), &service.PiggyConfig{}, containerInfo{Image: "my-image@" + digest})
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+strings.Repeat("a", 64), digest)
+
+	r := NewRegistry(&service.PiggyConfig{})
+	calls := 0
+	r.digestFetcher = func(ctx context.Context, config *service.PiggyConfig, container containerInfo) (string, error) {
+		calls++
+		return "sha256:abc", nil
+	}
+	container := corev1.Container{Image: "my-image:v1"}
+	for i := 0; i < 2; i++ {
+		digest, err = r.GetImageDigest(context.Background(), r.config, "default", container, corev1.PodSpec{})
+		assert.NoError(t, err)
+		assert.Equal(t, "sha256:abc", digest)
+	}
+	assert.Equal(t, 1, calls)
+}
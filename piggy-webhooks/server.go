@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/KongZ/piggy/piggy-webhooks/service"
+	"github.com/rs/zerolog/log"
+)
+
+// listener an HTTP listener serving one or more endpoints
+type listener struct {
+	name     string
+	address  string
+	certPath string
+	keyPath  string
+	clientCA string
+	tls      bool
+	mux      *http.ServeMux
+	server   *http.Server
+}
+
+// listenerConfig reads the listener settings for the endpoint group with the given env prefix
+// e.g. MUTATE_LISTEN_ADDRESS, MUTATE_TLS_CERT_FILE, MUTATE_TLS_PRIVATE_KEY_FILE, MUTATE_TLS_ENABLED, MUTATE_TLS_CLIENT_CA_FILE
+// When {prefix}_TLS_CLIENT_CA_FILE is set, clients must present a certificate signed by the CA. The other settings fall back to LISTEN_ADDRESS, TLS_CERT_FILE and TLS_PRIVATE_KEY_FILE
+func listenerConfig(prefix string, selfManagedCert bool) *listener {
+	certPath := service.GetEnv(prefix+"_TLS_CERT_FILE", service.GetEnv("TLS_CERT_FILE", ""))
+	keyPath := service.GetEnv(prefix+"_TLS_PRIVATE_KEY_FILE", service.GetEnv("TLS_PRIVATE_KEY_FILE", ""))
+	enabledTLS := selfManagedCert || !(certPath == "" && keyPath == "")
+	return &listener{
+		name:     prefix,
+		address:  service.GetEnv(prefix+"_LISTEN_ADDRESS", service.GetEnv("LISTEN_ADDRESS", ":8080")),
+		certPath: certPath,
+		keyPath:  keyPath,
+		clientCA: service.GetEnv(prefix+"_TLS_CLIENT_CA_FILE", ""),
+		tls:      service.GetEnvBool(prefix+"_TLS_ENABLED", enabledTLS),
+	}
+}
+
+// groupListeners merges listeners sharing the same address. Listeners on the same address must have the same TLS settings
+func groupListeners(listeners ...*listener) (map[string]*listener, error) {
+	grouped := make(map[string]*listener)
+	for _, l := range listeners {
+		if existing, ok := grouped[l.address]; ok {
+			if existing.tls != l.tls || existing.certPath != l.certPath || existing.keyPath != l.keyPath || existing.clientCA != l.clientCA {
+				return nil, fmt.Errorf("%s and %s listen on %s with different TLS settings", existing.name, l.name, l.address)
+			}
+			l.mux = existing.mux
+			continue
+		}
+		l.mux = http.NewServeMux()
+		grouped[l.address] = l
+	}
+	return grouped, nil
+}
+
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+	}
+}
+
+// newServer create an HTTP server for the listener. getCertificate is used when no certificate file is configured
+func (l *listener) newServer(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*http.Server, error) {
+	l.server = &http.Server{
+		Addr:              l.address,
+		Handler:           l.mux,
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+	if l.tls {
+		l.server.TLSConfig = newTLSConfig()
+		if l.certPath == "" && l.keyPath == "" {
+			l.server.TLSConfig.GetCertificate = getCertificate
+		}
+		if l.clientCA != "" {
+			pem, err := os.ReadFile(filepath.Clean(l.clientCA))
+			if err != nil {
+				return nil, fmt.Errorf("error reading client CA: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in client CA %s", l.clientCA)
+			}
+			l.server.TLSConfig.ClientCAs = pool
+			l.server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if l.clientCA != "" {
+		return nil, fmt.Errorf("%s requires TLS to verify client certificates", l.name)
+	}
+	return l.server, nil
+}
+
+func (l *listener) serve() error {
+	if l.tls {
+		log.Info().Msgf("Listening %s on https://%s", l.name, l.address)
+		return l.server.ListenAndServeTLS(l.certPath, l.keyPath)
+	}
+	log.Info().Msgf("Listening %s on http://%s", l.name, l.address)
+	return l.server.ListenAndServe()
+}
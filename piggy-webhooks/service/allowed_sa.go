@@ -0,0 +1,60 @@
+package service
+
+import (
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PrefixAllowedSALabel a PIGGY_ALLOWED_SA rule matching the labels of the pod service account e.g. `label:team=payments`
+const PrefixAllowedSALabel = "label:"
+
+// matchAllowedSA evaluates comma separated PIGGY_ALLOWED_SA rules against `namespace:serviceaccount`.
+// A rule is a glob pattern e.g. `team-a-*:deployer`, `payments:*` or a label selector of the service account e.g. `label:team=payments`.
+// A rule prefixed with `!` denies the service account and takes precedence over other rules.
+// Returns the decision and the rule deciding it
+func matchAllowedSA(rules string, serviceAccount string, saLabels func() labels.Set) (bool, string) {
+	var cached labels.Set
+	getLabels := func() labels.Set {
+		if cached == nil && saLabels != nil {
+			cached = saLabels()
+		}
+		return cached
+	}
+	matched := ""
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		negate := strings.HasPrefix(rule, "!")
+		pattern := strings.TrimPrefix(rule, "!")
+		if pattern == "" {
+			continue
+		}
+		ok := false
+		if strings.HasPrefix(pattern, PrefixAllowedSALabel) {
+			selector, err := labels.Parse(strings.TrimPrefix(pattern, PrefixAllowedSALabel))
+			if err != nil {
+				log.Error().Msgf("Invalid PIGGY_ALLOWED_SA rule [%s]: %v", rule, err)
+				continue
+			}
+			ok = selector.Matches(getLabels())
+		} else {
+			var err error
+			if ok, err = path.Match(pattern, serviceAccount); err != nil {
+				log.Error().Msgf("Invalid PIGGY_ALLOWED_SA rule [%s]: %v", rule, err)
+				continue
+			}
+		}
+		if !ok {
+			continue
+		}
+		if negate {
+			return false, rule
+		}
+		if matched == "" {
+			matched = rule
+		}
+	}
+	return matched != "", matched
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestMatchAllowedSA(t *testing.T) {
+	saLabels := func() labels.Set { return labels.Set{"team": "payments"} }
+	tests := []struct {
+		rules   string
+		sa      string
+		allowed bool
+		rule    string
+	}{
+		{"default:test-sa,other:sa", "default:test-sa", true, "default:test-sa"},
+		{"other:sa", "default:test-sa", false, ""},
+		{"team-a-*:deployer", "team-a-dev:deployer", true, "team-a-*:deployer"},
+		{"team-a-*:deployer", "team-b-dev:deployer", false, ""},
+		{"payments:*", "payments:api", true, "payments:*"},
+		{"payments:*, !payments:debug", "payments:debug", false, "!payments:debug"},
+		{"!payments:debug,payments:*", "payments:api", true, "payments:*"},
+		{"label:team=payments", "billing:api", true, "label:team=payments"},
+		{"label:team=billing", "billing:api", false, ""},
+		{"*:*,!label:team", "billing:api", false, "!label:team"},
+		{"[invalid,default:test-sa", "default:test-sa", true, "default:test-sa"},
+	}
+	for _, tt := range tests {
+		allowed, rule := matchAllowedSA(tt.rules, tt.sa, saLabels)
+		assert.Equal(t, tt.allowed, allowed, tt.rules)
+		assert.Equal(t, tt.rule, rule, tt.rules)
+	}
+
+	// No service account labels
+	allowed, _ := matchAllowedSA("label:team=payments", "billing:api", nil)
+	assert.False(t, allowed)
+}
+
+// TestGetSecret_AllowedSALabel verifies that label rules are resolved against the pod service account.
+func TestGetSecret_AllowedSALabel(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+	})
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: sa, Namespace: ns, Labels: map[string]string{"team": "payments"}},
+	}
+	_, client, svc := setupTest(pod, serviceAccount)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	secretVal := `{"PIGGY_ALLOWED_SA": "label:team=payments", "DB_PASS": "secret"}`
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					return &secretsmanager.GetSecretValueOutput{SecretString: &secretVal}, nil
+				},
+			}, nil
+		},
+	}
+	payload := &GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+	}
+	env, _, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", (*env)["DB_PASS"])
+
+	secretVal = `{"PIGGY_ALLOWED_SA": "label:team=billing", "DB_PASS": "secret"}`
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorAuthorized)
+}
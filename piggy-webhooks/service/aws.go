@@ -4,6 +4,7 @@ import (
 	"context"
 
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
@@ -16,12 +17,19 @@ type SecretsManagerClient interface {
 // SSMClient defines the interface for AWS SSM client
 type SSMClient interface {
 	GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+	GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
+}
+
+// KMSClient defines the interface for AWS KMS client
+type KMSClient interface {
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
 }
 
 // AWSClientFactory defines the interface for creating AWS clients
 type AWSClientFactory interface {
 	GetSecretsManagerClient(ctx context.Context, region string) (SecretsManagerClient, error)
 	GetSSMClient(ctx context.Context, region string) (SSMClient, error)
+	GetKMSClient(ctx context.Context, region string) (KMSClient, error)
 }
 
 // DefaultAWSClientFactory is the default implementation that creates real AWS clients
@@ -42,3 +50,11 @@ func (f *DefaultAWSClientFactory) GetSSMClient(ctx context.Context, region strin
 	}
 	return ssm.NewFromConfig(cfg), nil
 }
+
+func (f *DefaultAWSClientFactory) GetKMSClient(ctx context.Context, region string) (KMSClient, error) {
+	cfg, err := awsConfig.LoadDefaultConfig(ctx, awsConfig.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return kms.NewFromConfig(cfg), nil
+}
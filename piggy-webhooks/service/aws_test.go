@@ -21,4 +21,9 @@ func TestDefaultAWSClientFactory(t *testing.T) {
 	ssm, err := f.GetSSMClient(ctx, region)
 	assert.NoError(t, err)
 	assert.NotNil(t, ssm)
+
+	// Test KMS
+	kms, err := f.GetKMSClient(ctx, region)
+	assert.NoError(t, err)
+	assert.NotNil(t, kms)
 }
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// DefaultAzureKeyVaultDNSSuffix the DNS suffix of Azure Key Vault in Azure public cloud
+const DefaultAzureKeyVaultDNSSuffix = ".vault.azure.net"
+
+const azureKeyVaultAPIVersion = "7.4"
+const azureKeyVaultScope = "https://vault.azure.net/.default"
+const azureDefaultAuthorityHost = "https://login.microsoftonline.com/"
+
+// Key Vault names contain 3-24 alphanumerics and dashes
+var azureVaultNameRegx = regexp.MustCompile(`^[0-9a-zA-Z-]{3,24}$`)
+
+// Key Vault secret names contain only alphanumerics and dashes
+var azureSecretNameRegx = regexp.MustCompile(`^[0-9a-zA-Z-]{1,127}$`)
+
+// AzureError an error response of Azure Key Vault API
+type AzureError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *AzureError) Error() string {
+	return fmt.Sprintf("[%d] %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// AzureKeyVaultClient defines the interface for Azure Key Vault client
+type AzureKeyVaultClient interface {
+	// GetSecret returns the current value of a Key Vault secret
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// AzureClientFactory defines the interface for creating Azure clients
+type AzureClientFactory interface {
+	GetKeyVaultClient(ctx context.Context, vaultURL string) (AzureKeyVaultClient, error)
+}
+
+// DefaultAzureClientFactory is the default implementation that creates Azure Key Vault clients
+// with the Azure Workload Identity of piggy-webhooks
+type DefaultAzureClientFactory struct {
+	once        sync.Once
+	tokenSource oauth2.TokenSource
+	err         error
+}
+
+func (f *DefaultAzureClientFactory) GetKeyVaultClient(ctx context.Context, vaultURL string) (AzureKeyVaultClient, error) {
+	// share the token source to reuse access tokens until they expire
+	f.once.Do(func() {
+		f.tokenSource, f.err = NewAzureWorkloadIdentityTokenSource(context.Background())
+	})
+	if f.err != nil {
+		return nil, f.err
+	}
+	return NewAzureKeyVaultClient(oauth2.NewClient(ctx, f.tokenSource), vaultURL), nil
+}
+
+// azureWorkloadIdentityTokenSource exchanges the federated service account token for a Microsoft Entra access token
+type azureWorkloadIdentityTokenSource struct {
+	ctx       context.Context
+	clientID  string
+	tokenURL  string
+	tokenFile string
+}
+
+func (s *azureWorkloadIdentityTokenSource) Token() (*oauth2.Token, error) {
+	// the federated token is rotated by kubelet, read it on every exchange
+	assertion, err := os.ReadFile(filepath.Clean(s.tokenFile))
+	if err != nil {
+		return nil, err
+	}
+	config := clientcredentials.Config{
+		ClientID: s.clientID,
+		TokenURL: s.tokenURL,
+		Scopes:   []string{azureKeyVaultScope},
+		EndpointParams: url.Values{
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		},
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+	return config.Token(s.ctx)
+}
+
+// NewAzureWorkloadIdentityTokenSource creates a token source from the AZURE_CLIENT_ID, AZURE_TENANT_ID,
+// AZURE_FEDERATED_TOKEN_FILE and AZURE_AUTHORITY_HOST env injected by Azure Workload Identity
+func NewAzureWorkloadIdentityTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if clientID == "" || tenantID == "" || tokenFile == "" {
+		return nil, errors.New("azure workload identity requires AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE")
+	}
+	authorityHost := GetEnv("AZURE_AUTHORITY_HOST", azureDefaultAuthorityHost)
+	return oauth2.ReuseTokenSource(nil, &azureWorkloadIdentityTokenSource{
+		ctx:       ctx,
+		clientID:  clientID,
+		tokenURL:  fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authorityHost, "/"), tenantID),
+		tokenFile: tokenFile,
+	}), nil
+}
+
+type azureKeyVaultClient struct {
+	httpClient *http.Client
+	vaultURL   string
+}
+
+// NewAzureKeyVaultClient creates an Azure Key Vault REST API client
+func NewAzureKeyVaultClient(httpClient *http.Client, vaultURL string) AzureKeyVaultClient {
+	return &azureKeyVaultClient{httpClient: httpClient, vaultURL: strings.TrimSuffix(vaultURL, "/")}
+}
+
+func (c *azureKeyVaultClient) GetSecret(ctx context.Context, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/secrets/%s?api-version=%s", c.vaultURL, url.PathEscape(name), azureKeyVaultAPIVersion), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		azureErr := &AzureError{StatusCode: resp.StatusCode, Message: string(body)}
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error.Message != "" {
+			azureErr.Code = errResp.Error.Code
+			azureErr.Message = errResp.Error.Message
+		}
+		return "", azureErr
+	}
+	var output struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &output); err != nil {
+		return "", err
+	}
+	return output.Value, nil
+}
+
+// AzureKeyVaultURL returns the URL of a Key Vault name e.g. `my-vault` with the DNS suffix of piggy-webhooks.
+// The name comes from pod annotations, so a URL or any other host is rejected. Otherwise the webhook would send its own access token to it
+func AzureKeyVaultURL(vault string) (string, error) {
+	if !azureVaultNameRegx.MatchString(vault) {
+		return "", fmt.Errorf("invalid Azure Key Vault name [%s], expecting 3-24 alphanumerics and dashes", vault)
+	}
+	return fmt.Sprintf("https://%s%s", vault, GetStringValue(EmptyMap, ConfigAzureKeyVaultDNSSuffix, DefaultAzureKeyVaultDNSSuffix)), nil
+}
+
+// AzureKeyVaultSecretName returns the Key Vault secret name of a piggy reference.
+// Underscores are not allowed in Key Vault secret names so they are replaced with dashes e.g. DB_PASS reads DB-PASS
+func AzureKeyVaultSecretName(reference string) (string, bool) {
+	name := strings.ReplaceAll(reference, "_", "-")
+	return name, azureSecretNameRegx.MatchString(name)
+}
+
+// injectAzureSecret reads a Key Vault secret for each reference of the container, and PIGGY_ALLOWED_SA
+func (s *Service) injectAzureSecret(config *PiggyConfig, references []string, env *SanitizedEnv) error {
+	if len(references) == 0 && config.ContainerKeys != nil {
+		references = slices.Sorted(maps.Keys(config.ContainerKeys))
+	}
+	vaultURL, err := AzureKeyVaultURL(config.AzureKeyVaultName)
+	if err != nil {
+		return err
+	}
+	client, err := s.azureFactory.GetKeyVaultClient(s.context, vaultURL)
+	if err != nil {
+		return err
+	}
+	secrets := make(map[string]string)
+	for _, reference := range append([]string{"PIGGY_ALLOWED_SA"}, references...) {
+		if _, ok := secrets[reference]; ok || (reference != "PIGGY_ALLOWED_SA" && !config.allowKey(reference)) {
+			continue
+		}
+		name, ok := AzureKeyVaultSecretName(reference)
+		if !ok {
+			log.Debug().Msgf("Skip [%s], not a valid Key Vault secret name", reference)
+			continue
+		}
+		value, err := client.GetSecret(s.context, name)
+		if err != nil {
+			var azureErr *AzureError
+			if errors.As(err, &azureErr) && azureErr.StatusCode == http.StatusNotFound {
+				continue
+			}
+			return err
+		}
+		secrets[reference] = value
+	}
+	return processSecret(config, secrets, env)
+}
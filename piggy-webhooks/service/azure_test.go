@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newFakeAzureKeyVault serves secrets like the Azure Key Vault API
+func newFakeAzureKeyVault(secrets map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/secrets/")
+		value, ok := secrets[name]
+		if !ok || r.URL.Query().Get("api-version") == "" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprintf(w, `{"error": {"code": "SecretNotFound", "message": "A secret with (name/id) %s was not found in this key vault."}}`, name)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"value": "%s", "id": "https://vault.azure.net/secrets/%s/1"}`, value, name)
+	}))
+}
+
+func TestAzureKeyVaultNames(t *testing.T) {
+	vaultURL, err := AzureKeyVaultURL("my-vault")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://my-vault.vault.azure.net", vaultURL)
+	// a URL or another host is never taken from pod annotations
+	for _, vault := range []string{"https://my-vault.vault.azure.cn", "evil.example/x#", "my-vault.evil.example", "ab", "a-very-long-key-vault-name"} {
+		_, err = AzureKeyVaultURL(vault)
+		assert.Error(t, err, vault)
+	}
+	t.Setenv("AZURE_KEY_VAULT_DNS_SUFFIX", ".vault.azure.cn")
+	vaultURL, err = AzureKeyVaultURL("my-vault")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://my-vault.vault.azure.cn", vaultURL)
+	name, ok := AzureKeyVaultSecretName("DB_PASS")
+	assert.True(t, ok)
+	assert.Equal(t, "DB-PASS", name)
+	_, ok = AzureKeyVaultSecretName("db.pass")
+	assert.False(t, ok)
+}
+
+func TestAzureKeyVaultClient(t *testing.T) {
+	server := newFakeAzureKeyVault(map[string]string{"DB-PASS": "secret"})
+	defer server.Close()
+	client := NewAzureKeyVaultClient(server.Client(), server.URL+"/")
+
+	// Case 1: Get a secret
+	value, err := client.GetSecret(context.Background(), "DB-PASS")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", value)
+
+	// Case 2: Not found
+	_, err = client.GetSecret(context.Background(), "UNKNOWN")
+	var azureErr *AzureError
+	assert.ErrorAs(t, err, &azureErr)
+	assert.Equal(t, http.StatusNotFound, azureErr.StatusCode)
+	assert.Equal(t, "SecretNotFound", azureErr.Code)
+	assert.ErrorIs(t, classifyError(err), ErrorNotFound)
+
+	// Case 3: Unavailable
+	assert.ErrorIs(t, classifyError(&AzureError{StatusCode: http.StatusTooManyRequests}), ErrorUnavailable)
+	assert.NotErrorIs(t, classifyError(&AzureError{StatusCode: http.StatusForbidden}), ErrorUnavailable)
+}
+
+func TestAzureWorkloadIdentityTokenSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/my-tenant/oauth2/v2.0/token", r.URL.Path)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "my-client", r.PostForm.Get("client_id"))
+		assert.Equal(t, "federated-token", r.PostForm.Get("client_assertion"))
+		assert.Equal(t, "https://vault.azure.net/.default", r.PostForm.Get("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("federated-token\n"), 0600))
+
+	// Case 1: Not configured
+	t.Setenv("AZURE_CLIENT_ID", "")
+	_, err := NewAzureWorkloadIdentityTokenSource(context.Background())
+	assert.Error(t, err)
+
+	// Case 2: Exchange the federated token
+	t.Setenv("AZURE_CLIENT_ID", "my-client")
+	t.Setenv("AZURE_TENANT_ID", "my-tenant")
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+	t.Setenv("AZURE_AUTHORITY_HOST", server.URL+"/")
+	ts, err := NewAzureWorkloadIdentityTokenSource(context.Background())
+	assert.NoError(t, err)
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+}
+
+func TestGetSecret_Azure(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID:    `{"test-uid": "correct-signature"}`,
+		Namespace + AzureKeyVaultName: "my-vault",
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	server := newFakeAzureKeyVault(map[string]string{
+		"DB-PASS":          "secret",
+		"API-KEY":          "key",
+		"PIGGY-ALLOWED-SA": "default:test-sa",
+	})
+	defer server.Close()
+	var vaultURL string
+	svc.azureFactory = &MockAzureClientFactory{
+		GetKeyVaultClientFunc: func(ctx context.Context, url string) (AzureKeyVaultClient, error) {
+			vaultURL = url
+			return NewAzureKeyVaultClient(server.Client(), server.URL), nil
+		},
+	}
+	payload := &GetSecretPayload{
+		Name:       name,
+		Token:      "valid-token",
+		UID:        uid,
+		Signature:  "correct-signature",
+		References: []string{"DB_PASS", "MISSING", "db.pass"},
+	}
+
+	// Case 1: Read the referenced Key Vault secrets only
+	env, info, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://my-vault.vault.azure.net", vaultURL)
+	assert.Equal(t, "my-vault", info.SecretName)
+	assert.Equal(t, SanitizedEnv{"DB_PASS": "secret"}, *env)
+
+	// Case 2: Key Vault is unavailable
+	svc.azureFactory = &MockAzureClientFactory{
+		GetKeyVaultClientFunc: func(ctx context.Context, url string) (AzureKeyVaultClient, error) {
+			return &MockAzureKeyVaultClient{
+				GetSecretFunc: func(ctx context.Context, name string) (string, error) {
+					return "", &AzureError{StatusCode: http.StatusServiceUnavailable}
+				},
+			}, nil
+		},
+	}
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorUnavailable)
+
+	// Case 3: A vault URL annotation is rejected before the webhook token is sent anywhere
+	pod.Annotations[Namespace+AzureKeyVaultName] = "https://evil.example"
+	_, err = client.CoreV1().Pods(ns).Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	svc.azureFactory = &MockAzureClientFactory{
+		GetKeyVaultClientFunc: func(ctx context.Context, url string) (AzureKeyVaultClient, error) {
+			t.Errorf("Key Vault client created for %s", url)
+			return nil, errors.New("unexpected")
+		},
+	}
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorContains(t, err, "invalid Azure Key Vault name")
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// DefaultGCPSecretManagerEndpoint the Google Secret Manager API endpoint
+const DefaultGCPSecretManagerEndpoint = "https://secretmanager.googleapis.com"
+
+// GCPError an error response of Google Secret Manager API
+type GCPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *GCPError) Error() string {
+	return fmt.Sprintf("[%d] %s", e.StatusCode, e.Message)
+}
+
+// GCPSecretManagerClient defines the interface for Google Secret Manager client
+type GCPSecretManagerClient interface {
+	// AccessSecretVersion returns the payload of a secret version e.g. projects/my-project/secrets/my-secret/versions/latest
+	AccessSecretVersion(ctx context.Context, name string) ([]byte, error)
+}
+
+// GCPClientFactory defines the interface for creating Google Cloud clients
+type GCPClientFactory interface {
+	GetSecretManagerClient(ctx context.Context, credentialsFile string) (GCPSecretManagerClient, error)
+}
+
+// DefaultGCPClientFactory is the default implementation that creates Google Secret Manager clients
+// with a credentials file, or the application default credentials e.g. GKE Workload Identity
+type DefaultGCPClientFactory struct{}
+
+func (f *DefaultGCPClientFactory) GetSecretManagerClient(ctx context.Context, credentialsFile string) (GCPSecretManagerClient, error) {
+	var creds *google.Credentials
+	var err error
+	if credentialsFile != "" {
+		b, err := os.ReadFile(filepath.Clean(credentialsFile))
+		if err != nil {
+			return nil, err
+		}
+		creds, err = google.CredentialsFromJSON(ctx, b, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			return nil, err
+		}
+	} else if creds, err = google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform"); err != nil {
+		return nil, err
+	}
+	endpoint := GetEnv("PIGGY_GCP_SECRET_MANAGER_ENDPOINT", DefaultGCPSecretManagerEndpoint)
+	return NewGCPSecretManagerClient(oauth2.NewClient(ctx, creds.TokenSource), endpoint), nil
+}
+
+type gcpSecretManagerClient struct {
+	httpClient *http.Client
+	endpoint   string
+}
+
+// NewGCPSecretManagerClient creates a Google Secret Manager REST API client
+func NewGCPSecretManagerClient(httpClient *http.Client, endpoint string) GCPSecretManagerClient {
+	return &gcpSecretManagerClient{httpClient: httpClient, endpoint: strings.TrimSuffix(endpoint, "/")}
+}
+
+func (c *gcpSecretManagerClient) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/%s:access", c.endpoint, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		message := string(body)
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error.Message != "" {
+			message = errResp.Error.Message
+		}
+		return nil, &GCPError{StatusCode: resp.StatusCode, Message: message}
+	}
+	var output struct {
+		Payload struct {
+			Data       string `json:"data"`
+			DataCrc32c string `json:"dataCrc32c"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &output); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(output.Payload.Data)
+	if err != nil {
+		return nil, err
+	}
+	if output.Payload.DataCrc32c != "" {
+		if fmt.Sprint(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))) != output.Payload.DataCrc32c {
+			return nil, fmt.Errorf("secret %s payload checksum mismatch", name)
+		}
+	}
+	return data, nil
+}
+
+// gcpSecretVersionName returns the resource name of a secret version. The secret is a secret ID in the project,
+// or a full resource name `projects/{project}/secrets/{secret}`. The version is a version number or an alias, default to `latest`
+func gcpSecretVersionName(secret string, project string, version string) (string, error) {
+	if version == "" {
+		version = "latest"
+	}
+	if !strings.HasPrefix(secret, "projects/") {
+		if project == "" {
+			return "", fmt.Errorf("GCP project of secret %s is not set", secret)
+		}
+		secret = fmt.Sprintf("projects/%s/secrets/%s", project, secret)
+	}
+	return fmt.Sprintf("%s/versions/%s", secret, version), nil
+}
+
+func (s *Service) injectGCPSecret(config *PiggyConfig, env *SanitizedEnv) error {
+	name, err := gcpSecretVersionName(config.GCPSecretName, config.GCPSecretProject, config.GCPSecretVersion)
+	if err != nil {
+		return err
+	}
+	client, err := s.gcpFactory.GetSecretManagerClient(s.context, config.GCPSecretCredentialsFile)
+	if err != nil {
+		return err
+	}
+	data, err := client.AccessSecretVersion(s.context, name)
+	if err != nil {
+		return err
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("secret %s is not a JSON object: %v", name, err)
+	}
+	return processSecret(config, secrets, env)
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newFakeGCPSecretManager serves secret versions like the Google Secret Manager API
+func newFakeGCPSecretManager(secrets map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := secrets[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprintf(w, `{"error": {"code": 404, "message": "Secret [%s] not found or has no versions."}}`, r.URL.Path)
+			return
+		}
+		checksum := crc32.Checksum([]byte(data), crc32.MakeTable(crc32.Castagnoli))
+		_, _ = fmt.Fprintf(w, `{"name": "%s", "payload": {"data": "%s", "dataCrc32c": "%d"}}`, r.URL.Path, base64.StdEncoding.EncodeToString([]byte(data)), checksum)
+	}))
+}
+
+func TestGCPSecretVersionName(t *testing.T) {
+	name, err := gcpSecretVersionName("my-secret", "my-project", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "projects/my-project/secrets/my-secret/versions/latest", name)
+	name, err = gcpSecretVersionName("projects/other/secrets/my-secret", "my-project", "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "projects/other/secrets/my-secret/versions/prod", name)
+	_, err = gcpSecretVersionName("my-secret", "", "1")
+	assert.Error(t, err)
+}
+
+func TestGCPSecretManagerClient(t *testing.T) {
+	server := newFakeGCPSecretManager(map[string]string{
+		"/v1/projects/p/secrets/s/versions/latest:access": `{"DB_PASS": "secret"}`,
+	})
+	defer server.Close()
+	client := NewGCPSecretManagerClient(server.Client(), server.URL+"/")
+
+	// Case 1: Access a secret version
+	data, err := client.AccessSecretVersion(context.Background(), "projects/p/secrets/s/versions/latest")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"DB_PASS": "secret"}`, string(data))
+
+	// Case 2: Not found
+	_, err = client.AccessSecretVersion(context.Background(), "projects/p/secrets/unknown/versions/latest")
+	var gcpErr *GCPError
+	assert.ErrorAs(t, err, &gcpErr)
+	assert.Equal(t, http.StatusNotFound, gcpErr.StatusCode)
+	assert.Contains(t, gcpErr.Message, "not found")
+	assert.ErrorIs(t, classifyError(err), ErrorNotFound)
+
+	// Case 3: Corrupted payload
+	corrupted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"payload": {"data": "%s", "dataCrc32c": "1"}}`, base64.StdEncoding.EncodeToString([]byte("{}")))
+	}))
+	defer corrupted.Close()
+	_, err = NewGCPSecretManagerClient(corrupted.Client(), corrupted.URL).AccessSecretVersion(context.Background(), "projects/p/secrets/s/versions/1")
+	assert.ErrorContains(t, err, "checksum")
+
+	// Case 4: Unavailable
+	assert.ErrorIs(t, classifyError(&GCPError{StatusCode: http.StatusServiceUnavailable}), ErrorUnavailable)
+	assert.NotErrorIs(t, classifyError(&GCPError{StatusCode: http.StatusForbidden}), ErrorUnavailable)
+}
+
+func TestGetSecret_GCP(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID:   `{"test-uid": "correct-signature"}`,
+		Namespace + GCPSecretName:    "my-secret",
+		Namespace + GCPSecretProject: "my-project",
+		Namespace + GCPSecretVersion: "prod",
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	server := newFakeGCPSecretManager(map[string]string{
+		"/v1/projects/my-project/secrets/my-secret/versions/prod:access": `{"DB_PASS": "secret", "PIGGY_ALLOWED_SA": "default:test-sa"}`,
+	})
+	defer server.Close()
+	svc.gcpFactory = &MockGCPClientFactory{
+		GetSecretManagerClientFunc: func(ctx context.Context, credentialsFile string) (GCPSecretManagerClient, error) {
+			return NewGCPSecretManagerClient(server.Client(), server.URL), nil
+		},
+	}
+	payload := &GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+	}
+
+	// Case 1: Read a GCP secret
+	env, info, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", (*env)["DB_PASS"])
+	assert.Equal(t, "my-secret", info.SecretName)
+
+	// Case 2: Version not found
+	pod.Annotations[Namespace+GCPSecretVersion] = "1"
+	_, err = client.CoreV1().Pods(ns).Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorNotFound)
+
+	// Case 3: Not a JSON object
+	svc.gcpFactory = &MockGCPClientFactory{
+		GetSecretManagerClientFunc: func(ctx context.Context, credentialsFile string) (GCPSecretManagerClient, error) {
+			return &MockGCPSecretManagerClient{
+				AccessSecretVersionFunc: func(ctx context.Context, name string) ([]byte, error) {
+					return []byte("plain"), nil
+				},
+			}, nil
+		},
+	}
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorContains(t, err, "not a JSON object")
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/smithy-go"
+	"github.com/rs/zerolog/log"
+)
+
+// KMS encryption context keys binding an inline ciphertext to the service account allowed to decrypt it
+const KMSContextNamespace = Namespace + "namespace"
+const KMSContextServiceAccount = Namespace + "service-account"
+
+// KMSEncryptionContext returns the encryption context of inline ciphertexts of a service account.
+// The ciphertext must be encrypted with the same context, e.g.
+// `aws kms encrypt --encryption-context piggysec.com/namespace=default,piggysec.com/service-account=myapp`
+func KMSEncryptionContext(namespace string, serviceAccount string) map[string]string {
+	return map[string]string{
+		KMSContextNamespace:      namespace,
+		KMSContextServiceAccount: serviceAccount,
+	}
+}
+
+// SplitKMSReferences splits references into inline KMS ciphertexts and secret keys
+func SplitKMSReferences(references []string) ([]string, []string) {
+	var ciphertexts, keys []string
+	for _, reference := range references {
+		if strings.HasPrefix(reference, PrefixKMS) {
+			ciphertexts = append(ciphertexts, reference)
+		} else {
+			keys = append(keys, reference)
+		}
+	}
+	return ciphertexts, keys
+}
+
+// injectKMSSecret decrypts the inline KMS ciphertexts referenced by the container with the AWS role of piggy-webhooks.
+// The encryption context restricts each ciphertext to the pod service account, so a pod cannot decrypt ciphertexts of others
+func (s *Service) injectKMSSecret(config *PiggyConfig, references []string, namespace string, serviceAccount string, env *SanitizedEnv) error {
+	client, err := s.awsFactory.GetKMSClient(s.context, config.AWSRegion)
+	if err != nil {
+		return err
+	}
+	encryptionContext := KMSEncryptionContext(namespace, serviceAccount)
+	for _, reference := range references {
+		// the access policy keys name secret keys, the encryption context authorizes the ciphertext
+		if config.ContainerKeys != nil && !config.ContainerKeys[reference] {
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(reference, PrefixKMS))
+		if err != nil || len(blob) == 0 {
+			log.Debug().Msgf("Skip [%s], not a base64 KMS ciphertext", reference)
+			continue
+		}
+		output, err := client.Decrypt(s.context, &kms.DecryptInput{
+			CiphertextBlob:    blob,
+			EncryptionContext: encryptionContext,
+		})
+		if awsErr(err) {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "InvalidCiphertextException" || apiErr.ErrorCode() == "IncorrectKeyException") {
+				// the ciphertext was not encrypted for the service account
+				return fmt.Errorf("%w: %v", ErrorAuthorized, err)
+			}
+			return err
+		}
+		env.append(reference, string(output.Plaintext))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"maps"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMockKMSClient decrypts the ciphertexts encrypted for the given encryption context
+func newMockKMSClient(plaintexts map[string]string, encryptionContext map[string]string) *MockKMSClient {
+	return &MockKMSClient{
+		DecryptFunc: func(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+			plaintext, ok := plaintexts[string(params.CiphertextBlob)]
+			if !ok || !maps.Equal(params.EncryptionContext, encryptionContext) {
+				return nil, &smithy.GenericAPIError{Code: "InvalidCiphertextException"}
+			}
+			return &kms.DecryptOutput{Plaintext: []byte(plaintext)}, nil
+		},
+	}
+}
+
+func TestSplitKMSReferences(t *testing.T) {
+	ciphertexts, keys := SplitKMSReferences([]string{"DB_PASS", "kms:AQID", "API_KEY"})
+	assert.Equal(t, []string{"kms:AQID"}, ciphertexts)
+	assert.Equal(t, []string{"DB_PASS", "API_KEY"}, keys)
+}
+
+func TestGetSecret_KMS(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID:  `{"test-uid": "correct-signature"}`,
+		Namespace + ConfigAWSRegion: "eu-west-1",
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	token := PrefixKMS + base64.StdEncoding.EncodeToString([]byte("token-ciphertext"))
+	other := PrefixKMS + base64.StdEncoding.EncodeToString([]byte("other-ciphertext"))
+	kmsClient := newMockKMSClient(map[string]string{"token-ciphertext": "token"}, KMSEncryptionContext(ns, sa))
+	var kmsRegion string
+	readSecret := false
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					readSecret = true
+					return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(`{"DB_PASS": "secret"}`)}, nil
+				},
+			}, nil
+		},
+		GetKMSClientFunc: func(ctx context.Context, region string) (KMSClient, error) {
+			kmsRegion = region
+			return kmsClient, nil
+		},
+	}
+	payload := &GetSecretPayload{
+		Name:       name,
+		Token:      "valid-token",
+		UID:        uid,
+		Signature:  "correct-signature",
+		References: []string{"DB_PASS", token, "kms:not base64"},
+	}
+
+	// Case 1: Secret keys and KMS ciphertexts
+	env, _, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1", kmsRegion)
+	assert.True(t, readSecret)
+	assert.Equal(t, SanitizedEnv{"DB_PASS": "secret", token: "token"}, *env)
+
+	// Case 2: KMS ciphertexts only do not read the secret
+	readSecret = false
+	payload.References = []string{token}
+	env, _, err = svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.False(t, readSecret)
+	assert.Equal(t, SanitizedEnv{token: "token"}, *env)
+
+	// Case 3: Ciphertext of another service account
+	payload.References = []string{other}
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorAuthorized)
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"errors"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// injectK8sSecret reads a Kubernetes Secret on behalf of the pod. The Secret lives in a locked-down namespace
+// which the pod service account cannot read, so the secret values never appear in the pod spec
+func (s *Service) injectK8sSecret(config *PiggyConfig, env *SanitizedEnv) error {
+	if config.K8sSecretNamespace == "" {
+		return errors.New("kubernetes secret requires K8S_SECRET_NAMESPACE env of piggy-webhooks")
+	}
+	secret, err := s.k8sClient.CoreV1().Secrets(config.K8sSecretNamespace).Get(s.context, config.K8sSecretName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	secrets := make(map[string]string, len(secret.Data))
+	for name, value := range secret.Data {
+		secrets[name] = string(value)
+	}
+	return processSecret(config, secrets, env)
+}
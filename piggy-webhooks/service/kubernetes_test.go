@@ -0,0 +1,65 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetSecret_K8sSecret(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+		Namespace + K8sSecretName:  "myapp",
+	})
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp", Namespace: "piggy-secrets"},
+		Data: map[string][]byte{
+			"DB_PASS":          []byte("secret"),
+			"PIGGY_ALLOWED_SA": []byte("default:test-sa"),
+		},
+	}
+	other := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "piggy-secrets"},
+		Data: map[string][]byte{
+			"DB_PASS":          []byte("other"),
+			"PIGGY_ALLOWED_SA": []byte("default:other-sa"),
+		},
+	}
+	_, client, svc := setupTest(pod, secret, other)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	payload := &GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+	}
+
+	// Case 1: Namespace of Kubernetes Secrets is not set
+	_, _, err := svc.GetSecret(payload)
+	assert.ErrorContains(t, err, "K8S_SECRET_NAMESPACE")
+
+	// Case 2: Read the Secret in the locked-down namespace
+	t.Setenv("K8S_SECRET_NAMESPACE", "piggy-secrets")
+	t.Setenv("PIGGY_ENFORCE_SERVICE_ACCOUNT", "true")
+	env, info, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, SanitizedEnv{"DB_PASS": "secret"}, *env)
+	assert.Equal(t, "myapp", info.SecretName)
+
+	// Case 3: Secret does not allow the service account
+	pod.Annotations[Namespace+K8sSecretName] = "other"
+	_, err = client.CoreV1().Pods(ns).Update(svc.context, pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorAuthorized)
+
+	// Case 4: Secret not found
+	pod.Annotations[Namespace+K8sSecretName] = "unknown"
+	_, err = client.CoreV1().Pods(ns).Update(svc.context, pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorNotFound)
+}
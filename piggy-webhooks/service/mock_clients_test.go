@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
@@ -20,6 +21,7 @@ func (m *MockSecretsManagerClient) GetSecretValue(ctx context.Context, params *s
 
 type MockSSMClient struct {
 	GetParametersByPathFunc func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+	GetParametersFunc       func(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
 }
 
 func (m *MockSSMClient) GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
@@ -29,9 +31,28 @@ func (m *MockSSMClient) GetParametersByPath(ctx context.Context, params *ssm.Get
 	return &ssm.GetParametersByPathOutput{}, nil
 }
 
+func (m *MockSSMClient) GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+	if m.GetParametersFunc != nil {
+		return m.GetParametersFunc(ctx, params, optFns...)
+	}
+	return &ssm.GetParametersOutput{}, nil
+}
+
+type MockKMSClient struct {
+	DecryptFunc func(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+func (m *MockKMSClient) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	if m.DecryptFunc != nil {
+		return m.DecryptFunc(ctx, params, optFns...)
+	}
+	return &kms.DecryptOutput{}, nil
+}
+
 type MockAWSClientFactory struct {
 	GetSecretsManagerClientFunc func(ctx context.Context, region string) (SecretsManagerClient, error)
 	GetSSMClientFunc            func(ctx context.Context, region string) (SSMClient, error)
+	GetKMSClientFunc            func(ctx context.Context, region string) (KMSClient, error)
 }
 
 func (m *MockAWSClientFactory) GetSecretsManagerClient(ctx context.Context, region string) (SecretsManagerClient, error) {
@@ -47,3 +68,54 @@ func (m *MockAWSClientFactory) GetSSMClient(ctx context.Context, region string)
 	}
 	return &MockSSMClient{}, nil
 }
+
+func (m *MockAWSClientFactory) GetKMSClient(ctx context.Context, region string) (KMSClient, error) {
+	if m.GetKMSClientFunc != nil {
+		return m.GetKMSClientFunc(ctx, region)
+	}
+	return &MockKMSClient{}, nil
+}
+
+type MockGCPSecretManagerClient struct {
+	AccessSecretVersionFunc func(ctx context.Context, name string) ([]byte, error)
+}
+
+func (m *MockGCPSecretManagerClient) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	if m.AccessSecretVersionFunc != nil {
+		return m.AccessSecretVersionFunc(ctx, name)
+	}
+	return []byte("{}"), nil
+}
+
+type MockGCPClientFactory struct {
+	GetSecretManagerClientFunc func(ctx context.Context, credentialsFile string) (GCPSecretManagerClient, error)
+}
+
+func (m *MockGCPClientFactory) GetSecretManagerClient(ctx context.Context, credentialsFile string) (GCPSecretManagerClient, error) {
+	if m.GetSecretManagerClientFunc != nil {
+		return m.GetSecretManagerClientFunc(ctx, credentialsFile)
+	}
+	return &MockGCPSecretManagerClient{}, nil
+}
+
+type MockAzureKeyVaultClient struct {
+	GetSecretFunc func(ctx context.Context, name string) (string, error)
+}
+
+func (m *MockAzureKeyVaultClient) GetSecret(ctx context.Context, name string) (string, error) {
+	if m.GetSecretFunc != nil {
+		return m.GetSecretFunc(ctx, name)
+	}
+	return "", &AzureError{StatusCode: 404, Code: "SecretNotFound"}
+}
+
+type MockAzureClientFactory struct {
+	GetKeyVaultClientFunc func(ctx context.Context, vaultURL string) (AzureKeyVaultClient, error)
+}
+
+func (m *MockAzureClientFactory) GetKeyVaultClient(ctx context.Context, vaultURL string) (AzureKeyVaultClient, error) {
+	if m.GetKeyVaultClientFunc != nil {
+		return m.GetKeyVaultClientFunc(ctx, vaultURL)
+	}
+	return &MockAzureKeyVaultClient{}, nil
+}
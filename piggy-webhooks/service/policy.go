@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// SecretAccessPolicyResource the SecretAccessPolicy custom resource
+var SecretAccessPolicyResource = schema.GroupVersionResource{Group: "piggysec.com", Version: "v1alpha1", Resource: "secretaccesspolicies"}
+
+// SecretAccessPolicy grants subjects access to secrets and their keys
+type SecretAccessPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              SecretAccessPolicySpec `json:"spec"`
+}
+
+// SecretAccessPolicySpec a SecretAccessPolicy spec
+type SecretAccessPolicySpec struct {
+	Subjects []PolicySubject `json:"subjects"`
+	Secrets  []PolicySecret  `json:"secrets"`
+}
+
+// PolicySubject matches pods by namespace, service account and labels. Empty fields match everything
+type PolicySubject struct {
+	Namespaces      []string              `json:"namespaces,omitempty"`
+	ServiceAccounts []string              `json:"serviceAccounts,omitempty"`
+	PodSelector     *metav1.LabelSelector `json:"podSelector,omitempty"`
+}
+
+// PolicySecret a secret name or SSM parameter path pattern and the keys allowed to read. Empty keys allow all keys
+type PolicySecret struct {
+	Name string   `json:"name"`
+	Keys []string `json:"keys,omitempty"`
+}
+
+// PolicyDecision a result of evaluating policies
+type PolicyDecision struct {
+	Policy string          // name of the matched policy
+	Keys   map[string]bool // allowed keys, nil allows all keys
+}
+
+// PolicyLister lists SecretAccessPolicy objects
+type PolicyLister interface {
+	List() ([]*SecretAccessPolicy, error)
+}
+
+// PolicyCache an informer backed PolicyLister
+type PolicyCache struct {
+	informer cache.SharedIndexInformer
+}
+
+// NewPolicyCache start an informer watching SecretAccessPolicy objects and wait until it is synced
+func NewPolicyCache(ctx context.Context, client dynamic.Interface) (*PolicyCache, error) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 10*time.Minute)
+	informer := factory.ForResource(SecretAccessPolicyResource).Informer()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("unable to sync %s", SecretAccessPolicyResource.Resource)
+	}
+	return &PolicyCache{informer: informer}, nil
+}
+
+// List returns all cached policies
+func (c *PolicyCache) List() ([]*SecretAccessPolicy, error) {
+	var policies []*SecretAccessPolicy
+	for _, obj := range c.informer.GetStore().List() {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		policy := &SecretAccessPolicy{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, policy); err != nil {
+			log.Error().Msgf("Invalid SecretAccessPolicy %s: %v", u.GetName(), err)
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func (p *PolicySubject) matches(pod *corev1.Pod) (bool, error) {
+	if len(p.Namespaces) > 0 && !slices.Contains(p.Namespaces, pod.Namespace) {
+		return false, nil
+	}
+	if len(p.ServiceAccounts) > 0 && !slices.Contains(p.ServiceAccounts, pod.Spec.ServiceAccountName) {
+		return false, nil
+	}
+	if p.PodSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(p.PodSelector)
+		if err != nil {
+			return false, err
+		}
+		return selector.Matches(labels.Set(pod.Labels)), nil
+	}
+	return true, nil
+}
+
+// EvaluatePolicies returns a decision of the first policy granting the pod access to the secret, or nil if none
+func EvaluatePolicies(policies []*SecretAccessPolicy, pod *corev1.Pod, secretName string) *PolicyDecision {
+	// evaluate in a stable order
+	slices.SortFunc(policies, func(a, b *SecretAccessPolicy) int {
+		if a.Name < b.Name {
+			return -1
+		} else if a.Name > b.Name {
+			return 1
+		}
+		return 0
+	})
+	for _, policy := range policies {
+		subjectMatched := false
+		for _, subject := range policy.Spec.Subjects {
+			matched, err := subject.matches(pod)
+			if err != nil {
+				log.Error().Msgf("Invalid SecretAccessPolicy %s: %v", policy.Name, err)
+				break
+			}
+			if matched {
+				subjectMatched = true
+				break
+			}
+		}
+		if !subjectMatched {
+			continue
+		}
+		for _, secret := range policy.Spec.Secrets {
+			if matched, _ := path.Match(secret.Name, secretName); !matched {
+				continue
+			}
+			decision := &PolicyDecision{Policy: policy.Name}
+			if len(secret.Keys) > 0 {
+				decision.Keys = make(map[string]bool, len(secret.Keys))
+				for _, key := range secret.Keys {
+					decision.Keys[key] = true
+				}
+			}
+			return decision
+		}
+	}
+	return nil
+}
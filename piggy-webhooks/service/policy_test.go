@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+type staticPolicyLister []*SecretAccessPolicy
+
+func (l staticPolicyLister) List() ([]*SecretAccessPolicy, error) {
+	return l, nil
+}
+
+func newPolicy(name string, subject PolicySubject, secrets ...PolicySecret) *SecretAccessPolicy {
+	return &SecretAccessPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: SecretAccessPolicySpec{
+			Subjects: []PolicySubject{subject},
+			Secrets:  secrets,
+		},
+	}
+}
+
+func TestEvaluatePolicies(t *testing.T) {
+	pod := newPod("team-a", "app", "deployer", nil)
+	pod.Labels = map[string]string{"app": "web"}
+
+	// Case 1: No policy
+	assert.Nil(t, EvaluatePolicies(nil, pod, "team-a/deployer"))
+
+	// Case 2: Namespace and service account match, all keys
+	policies := []*SecretAccessPolicy{
+		newPolicy("team-a", PolicySubject{Namespaces: []string{"team-a"}, ServiceAccounts: []string{"deployer"}}, PolicySecret{Name: "team-a/*"}),
+	}
+	decision := EvaluatePolicies(policies, pod, "team-a/deployer")
+	assert.NotNil(t, decision)
+	assert.Equal(t, "team-a", decision.Policy)
+	assert.Nil(t, decision.Keys)
+	assert.Nil(t, EvaluatePolicies(policies, pod, "team-b/deployer"))
+
+	// Case 3: Service account mismatch
+	other := newPod("team-a", "app", "other", nil)
+	assert.Nil(t, EvaluatePolicies(policies, other, "team-a/deployer"))
+
+	// Case 4: Label selector and keys
+	policies = []*SecretAccessPolicy{
+		newPolicy("web", PolicySubject{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}, PolicySecret{Name: "shared", Keys: []string{"API_KEY"}}),
+	}
+	decision = EvaluatePolicies(policies, pod, "shared")
+	assert.NotNil(t, decision)
+	assert.Equal(t, map[string]bool{"API_KEY": true}, decision.Keys)
+	assert.Nil(t, EvaluatePolicies(policies, other, "shared"))
+
+	// Case 5: Policies are evaluated by name
+	policies = []*SecretAccessPolicy{
+		newPolicy("b", PolicySubject{}, PolicySecret{Name: "shared"}),
+		newPolicy("a", PolicySubject{}, PolicySecret{Name: "shared", Keys: []string{"API_KEY"}}),
+	}
+	assert.Equal(t, "a", EvaluatePolicies(policies, pod, "shared").Policy)
+}
+
+func TestPolicyCache(t *testing.T) {
+	policy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "piggysec.com/v1alpha1",
+		"kind":       "SecretAccessPolicy",
+		"metadata":   map[string]interface{}{"name": "team-a"},
+		"spec": map[string]interface{}{
+			"subjects": []interface{}{map[string]interface{}{"namespaces": []interface{}{"team-a"}}},
+			"secrets":  []interface{}{map[string]interface{}{"name": "team-a/*", "keys": []interface{}{"DB_PASS"}}},
+		},
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{SecretAccessPolicyResource: "SecretAccessPolicyList"}, policy)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache, err := NewPolicyCache(ctx, client)
+	assert.NoError(t, err)
+	policies, err := cache.List()
+	assert.NoError(t, err)
+	assert.Len(t, policies, 1)
+	assert.Equal(t, "team-a", policies[0].Name)
+	assert.Equal(t, []string{"team-a"}, policies[0].Spec.Subjects[0].Namespaces)
+	assert.Equal(t, []string{"DB_PASS"}, policies[0].Spec.Secrets[0].Keys)
+}
+
+func TestGetSecret_AccessPolicy(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	secretVal := `{"DB_PASS": "secret", "API_KEY": "key"}`
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					return &secretsmanager.GetSecretValueOutput{SecretString: &secretVal}, nil
+				},
+			}, nil
+		},
+	}
+	payload := &GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+	}
+
+	// Case 1: Denied by default when enforced
+	t.Setenv("PIGGY_ENFORCE_ACCESS_POLICY", "true")
+	svc.SetPolicyLister(staticPolicyLister{
+		newPolicy("other", PolicySubject{Namespaces: []string{"other"}}, PolicySecret{Name: "*/*"}),
+	})
+	_, _, err := svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorAuthorized)
+
+	// Case 2: Only granted keys are returned
+	svc.SetPolicyLister(staticPolicyLister{
+		newPolicy("default", PolicySubject{Namespaces: []string{ns}, ServiceAccounts: []string{sa}}, PolicySecret{Name: "default/test-sa", Keys: []string{"DB_PASS"}}),
+	})
+	env, _, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, SanitizedEnv{"DB_PASS": "secret"}, *env)
+
+	// Case 3: Not enforced, falls back to service account check
+	t.Setenv("PIGGY_ENFORCE_ACCESS_POLICY", "")
+	svc.SetPolicyLister(staticPolicyLister{})
+	env, _, err = svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Len(t, *env, 2)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitError when the requestor exceeds the rate limit
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry after %s", e.Key, e.RetryAfter)
+}
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter keeps a token bucket for each key
+type RateLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	idle     time.Duration
+	limiters map[string]*rateLimiterEntry
+	now      func() time.Time
+}
+
+// NewRateLimiter create a rate limiter allowing qps requests per second with burst for each key. Returns nil if qps is not positive
+func NewRateLimiter(qps float64, burst int) *RateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		limit:    rate.Limit(qps),
+		burst:    burst,
+		idle:     10 * time.Minute,
+		limiters: make(map[string]*rateLimiterEntry),
+		now:      time.Now,
+	}
+}
+
+// reserve takes a token of the key. Returns the reservation, or how long to wait if no token is available
+func (r *RateLimiter) reserve(key string) (*rate.Reservation, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for k, entry := range r.limiters {
+		if now.Sub(entry.lastSeen) > r.idle {
+			delete(r.limiters, k)
+		}
+	}
+	entry, ok := r.limiters[key]
+	if !ok {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(r.limit, r.burst)}
+		r.limiters[key] = entry
+	}
+	entry.lastSeen = now
+	reservation := entry.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return nil, delay
+	}
+	return reservation, 0
+}
+
+// checkRateLimit takes a token from the namespace and the service account buckets. Tokens are not taken if any bucket is empty
+func (s *Service) checkRateLimit(namespace string, serviceAccount string) error {
+	type bucket struct {
+		limiter *RateLimiter
+		key     string
+	}
+	var reserved []*rate.Reservation
+	for _, b := range []bucket{{s.namespaceLimiter, namespace}, {s.serviceAccountLimiter, serviceAccount}} {
+		if b.limiter == nil {
+			continue
+		}
+		reservation, delay := b.limiter.reserve(b.key)
+		if delay > 0 {
+			for _, r := range reserved {
+				r.Cancel()
+			}
+			return &RateLimitError{Key: b.key, RetryAfter: delay}
+		}
+		reserved = append(reserved, reservation)
+	}
+	return nil
+}
+
+// checkRemoteRateLimit takes a token from the bucket of the remote IP. It is checked before the token is reviewed
+func (s *Service) checkRemoteRateLimit(remoteIP string) error {
+	if s.remoteLimiter == nil || remoteIP == "" {
+		return nil
+	}
+	if _, delay := s.remoteLimiter.reserve(remoteIP); delay > 0 {
+		return &RateLimitError{Key: remoteIP, RetryAfter: delay}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNewRateLimiter_Disabled(t *testing.T) {
+	assert.Nil(t, NewRateLimiter(0, 10))
+}
+
+func TestRateLimiter_Reserve(t *testing.T) {
+	r := NewRateLimiter(1, 2)
+	now := time.Unix(0, 0)
+	r.now = func() time.Time { return now }
+
+	_, delay := r.reserve("a")
+	assert.Zero(t, delay)
+	_, delay = r.reserve("a")
+	assert.Zero(t, delay)
+	// bucket is empty
+	_, delay = r.reserve("a")
+	assert.Equal(t, time.Second, delay)
+	// other keys have their own bucket
+	_, delay = r.reserve("b")
+	assert.Zero(t, delay)
+	// refilled
+	now = now.Add(time.Second)
+	_, delay = r.reserve("a")
+	assert.Zero(t, delay)
+
+	// idle buckets are evicted
+	now = now.Add(time.Hour)
+	_, _ = r.reserve("c")
+	assert.Len(t, r.limiters, 1)
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	_, _, svc := setupTest()
+	assert.NoError(t, svc.checkRateLimit("default", "default:sa"))
+
+	svc.namespaceLimiter = NewRateLimiter(1, 1)
+	svc.serviceAccountLimiter = NewRateLimiter(1, 2)
+	assert.NoError(t, svc.checkRateLimit("default", "default:sa"))
+
+	// Case 1: Namespace bucket is empty, the service account token is given back
+	err := svc.checkRateLimit("default", "default:sa")
+	var rateLimitErr *RateLimitError
+	assert.True(t, errors.As(err, &rateLimitErr))
+	assert.Equal(t, "default", rateLimitErr.Key)
+	assert.Greater(t, rateLimitErr.RetryAfter, time.Duration(0))
+	assert.NoError(t, svc.checkRateLimit("other", "default:sa"))
+
+	// Case 2: Service account bucket is empty
+	err = svc.checkRateLimit("another", "default:sa")
+	assert.True(t, errors.As(err, &rateLimitErr))
+	assert.Equal(t, "default:sa", rateLimitErr.Key)
+}
+
+// TestGetSecret_RemoteRateLimit verifies that requests over the remote IP limit are rejected before the token is reviewed.
+func TestGetSecret_RemoteRateLimit(t *testing.T) {
+	_, client, svc := setupTest()
+	reviews := 0
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		reviews++
+		return true, &authv1.TokenReview{}, nil
+	})
+	svc.remoteLimiter = NewRateLimiter(1, 1)
+	payload := &GetSecretPayload{Name: "test-pod", Token: "invalid-token", RemoteIP: "10.0.0.1"}
+
+	_, _, err := svc.GetSecret(payload)
+	assert.ErrorContains(t, err, "token is not authenticated")
+	reviewed := reviews
+	assert.Positive(t, reviewed)
+	_, _, err = svc.GetSecret(payload)
+	var rateLimitErr *RateLimitError
+	assert.True(t, errors.As(err, &rateLimitErr))
+	assert.Equal(t, "10.0.0.1", rateLimitErr.Key)
+	assert.Equal(t, reviewed, reviews)
+
+	// other IPs and requests without a remote IP are not limited by this bucket
+	payload.RemoteIP = "10.0.0.2"
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorContains(t, err, "token is not authenticated")
+	assert.Greater(t, reviews, reviewed)
+	assert.NoError(t, svc.checkRemoteRateLimit(""))
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reference a piggy reference `KEY[|FILTER[:ARG]]...[?|:-DEFAULT]` e.g. `CONFIG|jsonpath:$.db.host:-localhost`
+type Reference struct {
+	Key        string
+	Filters    []string
+	Optional   bool // set to empty if the key is missing
+	HasDefault bool // set to Default if the key is missing
+	Default    string
+}
+
+// ParseReference parses the modifiers of a reference. A reference without modifiers is the secret key
+func ParseReference(reference string) Reference {
+	var r Reference
+	spec, defaultValue, hasDefault := strings.Cut(reference, ":-")
+	if hasDefault {
+		r.HasDefault = true
+		r.Default = defaultValue
+	} else if trimmed, ok := strings.CutSuffix(spec, "?"); ok {
+		r.Optional = true
+		spec = trimmed
+	}
+	filters := strings.Split(spec, "|")
+	r.Key = filters[0]
+	r.Filters = filters[1:]
+	return r
+}
+
+// Filter applies the filters of the reference to the value of the key
+func (r Reference) Filter(value string) (string, error) {
+	for _, filter := range r.Filters {
+		var err error
+		if value, err = applyFilter(filter, value); err != nil {
+			return "", fmt.Errorf("filter [%s] of [%s]: %v", filter, r.Key, err)
+		}
+	}
+	return value, nil
+}
+
+// applyFilter applies a `base64decode`, `base64encode`, `urlencode` or `jsonpath:EXPR` filter
+func applyFilter(filter string, value string) (string, error) {
+	name, arg, _ := strings.Cut(filter, ":")
+	switch name {
+	case "base64decode":
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		return string(decoded), err
+	case "base64encode":
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	case "urlencode":
+		return url.QueryEscape(value), nil
+	case "jsonpath":
+		return jsonPath(value, arg)
+	}
+	return "", fmt.Errorf("unknown filter %s", name)
+}
+
+// jsonPath returns the value at a path of a JSON document. Supports `$`, `.name`, `['name']` and `[index]`.
+// A string is returned as it is, other values as JSON
+func jsonPath(document string, path string) (string, error) {
+	var value any
+	decoder := json.NewDecoder(strings.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return "", fmt.Errorf("invalid jsonpath [%s], expecting $", path)
+	}
+	for rest != "" {
+		name, index := "", -1
+		switch {
+		case strings.HasPrefix(rest, "."):
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			name, rest = rest[1:end], rest[end:]
+		case strings.HasPrefix(rest, "['"), strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest[2:], rest[1:2]+"]")
+			if end < 0 {
+				return "", fmt.Errorf("invalid jsonpath [%s]", path)
+			}
+			name, rest = rest[2:2+end], rest[2+end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			i, err := strconv.Atoi(rest[1:max(end, 1)])
+			if end < 0 || err != nil || i < 0 {
+				return "", fmt.Errorf("invalid jsonpath [%s]", path)
+			}
+			index, rest = i, rest[end+1:]
+		default:
+			return "", fmt.Errorf("invalid jsonpath [%s]", path)
+		}
+		if index >= 0 {
+			list, ok := value.([]any)
+			if !ok || index >= len(list) {
+				return "", fmt.Errorf("jsonpath [%s] not found", path)
+			}
+			value = list[index]
+		} else {
+			object, ok := value.(map[string]any)
+			if !ok || name == "" {
+				return "", fmt.Errorf("jsonpath [%s] not found", path)
+			}
+			if value, ok = object[name]; !ok {
+				return "", fmt.Errorf("jsonpath [%s] not found", path)
+			}
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+// secretKeys returns the unique secret keys of references without their modifiers
+func secretKeys(references []string) []string {
+	var keys []string
+	for _, reference := range references {
+		key := ParseReference(reference).Key
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// resolveReferences returns the value of each reference from the secrets, keyed by the reference.
+// Secrets which are not referenced are not returned, so a container receives only the filtered value of a key.
+// A missing key or a failed filter resolves to the default value, or empty if optional. Generated references are left to piggy-env
+func resolveReferences(references []string, secrets SanitizedEnv) *SanitizedEnv {
+	resolved := SanitizedEnv{}
+	for _, reference := range references {
+		r := ParseReference(reference)
+		if IsGeneratedReference(r.Key) {
+			continue
+		}
+		if value, ok := secrets[r.Key]; ok {
+			filtered, err := r.Filter(value)
+			if err == nil {
+				resolved[reference] = filtered
+				if len(r.Filters) == 0 {
+					// elements of a split StringList parameter
+					for i := 0; ; i++ {
+						element, ok := secrets[SSMIndexedKey(r.Key, i)]
+						if !ok {
+							break
+						}
+						resolved[SSMIndexedKey(reference, i)] = element
+					}
+				}
+				continue
+			}
+			log.Error().Msgf("Unable to resolve [%s]: %v", reference, err)
+		}
+		if r.HasDefault {
+			resolved[reference] = r.Default
+		} else if r.Optional {
+			resolved[reference] = ""
+		}
+	}
+	return &resolved
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReference(t *testing.T) {
+	assert.Equal(t, Reference{Key: "DB_PASS", Filters: []string{}}, ParseReference("DB_PASS"))
+	assert.Equal(t, Reference{Key: "DB_PASS", Filters: []string{}, Optional: true}, ParseReference("DB_PASS?"))
+	assert.Equal(t, Reference{Key: "DB_HOST", Filters: []string{}, HasDefault: true, Default: "localhost:5432"}, ParseReference("DB_HOST:-localhost:5432"))
+	assert.Equal(t, Reference{Key: "CONFIG", Filters: []string{"base64decode", "jsonpath:$.db.host"}, HasDefault: true, Default: "db"}, ParseReference("CONFIG|base64decode|jsonpath:$.db.host:-db"))
+	assert.Equal(t, Reference{Key: "ssm:/shared/api-key:3", Filters: []string{}}, ParseReference("ssm:/shared/api-key:3"))
+	assert.Equal(t, []string{"CONFIG", "DB_PASS"}, secretKeys([]string{"CONFIG|jsonpath:$.a", "CONFIG|jsonpath:$.b", "DB_PASS?"}))
+}
+
+func TestJSONPath(t *testing.T) {
+	document := `{"db": {"host": "db", "port": 5432, "replicas": ["r1", "r2"], "tls": {"enabled": true}}, "a.b": "dotted"}`
+	for path, expected := range map[string]string{
+		"$.db.host":        "db",
+		"$.db.port":        "5432",
+		"$.db.replicas[1]": "r2",
+		"$['a.b']":         "dotted",
+		`$["db"].tls`:      `{"enabled":true}`,
+		"$.db.replicas":    `["r1","r2"]`,
+	} {
+		value, err := jsonPath(document, path)
+		assert.NoError(t, err, path)
+		assert.Equal(t, expected, value, path)
+	}
+	for _, path := range []string{"db.host", "$.db.missing", "$.db.replicas[2]", "$.db[0]", "$.db.replicas[x]", "$['db'"} {
+		_, err := jsonPath(document, path)
+		assert.Error(t, err, path)
+	}
+	_, err := jsonPath("not json", "$.a")
+	assert.Error(t, err)
+}
+
+func TestReferenceFilter(t *testing.T) {
+	value, err := ParseReference("CERT|base64decode").Filter(base64.StdEncoding.EncodeToString([]byte("-----BEGIN CERTIFICATE-----")))
+	assert.NoError(t, err)
+	assert.Equal(t, "-----BEGIN CERTIFICATE-----", value)
+	value, err = ParseReference("PASS|urlencode").Filter("p@ss/word")
+	assert.NoError(t, err)
+	assert.Equal(t, "p%40ss%2Fword", value)
+	value, err = ParseReference("PASS|base64encode").Filter("pass")
+	assert.NoError(t, err)
+	assert.Equal(t, "cGFzcw==", value)
+	_, err = ParseReference("CERT|base64decode").Filter("not base64!")
+	assert.Error(t, err)
+	_, err = ParseReference("CERT|unknown").Filter("value")
+	assert.Error(t, err)
+}
+
+func TestGetSecret_ReferenceModifiers(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	secret := `{"DB_PASS": "secret", "CONFIG": "{\"db\": {\"host\": \"db\"}}", "OTHER": "other"}`
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(secret)}, nil
+				},
+			}, nil
+		},
+	}
+	env, _, err := svc.GetSecret(&GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+		References: []string{
+			"DB_PASS",
+			"CONFIG|jsonpath:$.db.host",
+			"CONFIG|jsonpath:$.db.port",
+			"CONFIG|jsonpath:$.db.user:-app",
+			"MISSING?",
+			"DB_HOST:-localhost",
+			"rds-iam-token:mydb:5432:app?",
+		},
+	})
+	assert.NoError(t, err)
+	// the whole CONFIG and unreferenced keys are not returned
+	assert.Equal(t, SanitizedEnv{
+		"DB_PASS":                        "secret",
+		"CONFIG|jsonpath:$.db.host":      "db",
+		"CONFIG|jsonpath:$.db.user:-app": "app",
+		"MISSING?":                       "",
+		"DB_HOST:-localhost":             "localhost",
+	}, *env)
+}
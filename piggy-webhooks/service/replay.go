@@ -0,0 +1,55 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// ReplayProtectionOnce serves each piggy uid of a pod only once by each replica
+	ReplayProtectionOnce = "once"
+	// ReplayProtectionPending serves secrets only on the first start of a container, while the pod is pending or the container has not restarted
+	ReplayProtectionPending = "pending"
+)
+
+// ReplayCache remembers served requests so they can not be replayed. It is kept in memory, so each replica
+// of piggy-webhooks has its own cache
+type ReplayCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time
+	now     func() time.Time
+}
+
+// NewReplayCache create a replay cache. Entries are forgotten after ttl
+func NewReplayCache(ttl time.Duration) *ReplayCache {
+	return &ReplayCache{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Add adds the key to the cache. Returns false if the key was already added
+func (c *ReplayCache) Add(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, expiry := range c.entries {
+		if now.After(expiry) {
+			delete(c.entries, k)
+		}
+	}
+	if _, ok := c.entries[key]; ok {
+		return false
+	}
+	c.entries[key] = now.Add(c.ttl)
+	return true
+}
+
+// Remove removes the key from the cache, e.g. when the request was not served
+func (c *ReplayCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
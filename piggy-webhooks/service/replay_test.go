@@ -0,0 +1,27 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReplayCache verifies that a key can be added only once until it expires or is removed.
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	c := NewReplayCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	assert.True(t, c.Add("pod/uid"))
+	assert.False(t, c.Add("pod/uid"))
+	assert.True(t, c.Add("pod/other-uid"))
+
+	c.Remove("pod/uid")
+	assert.True(t, c.Add("pod/uid"))
+
+	// expired
+	now = now.Add(2 * time.Minute)
+	assert.True(t, c.Add("pod/uid"))
+	assert.Len(t, c.entries, 1)
+}
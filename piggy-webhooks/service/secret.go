@@ -5,16 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/smithy-go"
 	authv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/rs/zerolog/log"
 )
@@ -26,7 +31,11 @@ type GetSecretPayload struct {
 	Name      string `json:"name"`
 	UID       string `json:"uid"`
 	Signature string `json:"signature"`
-	Token     string `json:"-"`
+	// piggy references of the container, required by signature version 2
+	References []string `json:"references,omitempty"`
+	Token      string   `json:"-"`
+	// IP address of the requestor, set by the handler
+	RemoteIP string `json:"-"`
 }
 
 type Info struct {
@@ -39,24 +48,55 @@ type Info struct {
 	SSMParameterPath string `json:"ssmParameterPath,omitempty"`
 }
 
-type Signature map[string]string
+const (
+	claimPodName = "authentication.kubernetes.io/pod-name"
+	claimPodUID  = "authentication.kubernetes.io/pod-uid"
+	claimNode    = "authentication.kubernetes.io/node-name"
+)
 
 var sanitizeEnvmap = map[string]bool{
-	"PIGGY_AWS_SECRET_NAME":            true,
-	"PIGGY_AWS_SSM_PARAMETER_PATH":     true,
-	"PIGGY_AWS_REGION":                 true,
-	"PIGGY_POD_NAME":                   true,
-	"PIGGY_DEBUG":                      true,
-	"PIGGY_STANDALONE":                 true,
-	"PIGGY_ADDRESS":                    true,
-	"PIGGY_ALLOWED_SA":                 true,
-	"PIGGY_SKIP_VERIFY_TLS":            true,
-	"PIGGY_IGNORE_NO_ENV":              true,
-	"PIGGY_DEFAULT_SECRET_NAME_PREFIX": true, // use before secret
-	"PIGGY_DEFAULT_SECRET_NAME_SUFFIX": true, // use before secret
-	"PIGGY_DNS_RESOLVER":               true, // use before secret
-	"PIGGY_INITIAL_DELAY":              true, // use before secret
-	"PIGGY_NUMBER_OF_RETRY":            true, // use before secret
+	"PIGGY_AWS_SECRET_NAME":             true,
+	"PIGGY_AWS_SSM_PARAMETER_PATH":      true,
+	"PIGGY_AWS_SSM_PARAMETER_KEY":       true,
+	"PIGGY_AWS_SSM_PARAMETER_SEPARATOR": true,
+	"PIGGY_AWS_SSM_SPLIT_STRING_LIST":   true,
+	"PIGGY_AWS_REGION":                  true,
+	"PIGGY_GCP_SECRET_NAME":             true,
+	"PIGGY_GCP_SECRET_PROJECT":          true,
+	"PIGGY_GCP_SECRET_VERSION":          true,
+	"PIGGY_GCP_SECRET_CREDENTIALS_FILE": true,
+	"PIGGY_AZURE_KEY_VAULT_NAME":        true,
+	"PIGGY_POD_NAME":                    true,
+	"PIGGY_POD_NAMESPACE":               true,
+	"PIGGY_SERVICE_ACCOUNT_NAME":        true,
+	"PIGGY_DEBUG":                       true,
+	"PIGGY_STANDALONE":                  true,
+	"PIGGY_ADDRESS":                     true,
+	"PIGGY_ADDRESS_ORDER":               true, // use before secret
+	"PIGGY_ADDRESS_TIMEOUT":             true, // use before secret
+	"PIGGY_ALLOWED_SA":                  true,
+	"PIGGY_SKIP_VERIFY_TLS":             true,
+	"PIGGY_IGNORE_NO_ENV":               true,
+	"PIGGY_DEFAULT_SECRET_NAME_PREFIX":  true, // use before secret
+	"PIGGY_DEFAULT_SECRET_NAME_SUFFIX":  true, // use before secret
+	"PIGGY_DNS_RESOLVER":                true, // use before secret
+	"PIGGY_DNS_SERVER":                  true, // use before secret
+	"PIGGY_IP_FAMILY":                   true, // use before secret
+	"PIGGY_CONNECT_TIMEOUT":             true, // use before secret
+	"PIGGY_TLS_HANDSHAKE_TIMEOUT":       true, // use before secret
+	"PIGGY_REQUEST_TIMEOUT":             true, // use before secret
+	"PIGGY_HTTP_PROXY":                  true, // use before secret
+	"PIGGY_NO_PROXY":                    true, // use before secret
+	"PIGGY_INITIAL_DELAY":               true, // use before secret
+	"PIGGY_NUMBER_OF_RETRY":             true, // use before secret
+	"PIGGY_FAILOVER":                    true, // use before secret
+	"PIGGY_RETRY_INITIAL_INTERVAL":      true, // use before secret
+	"PIGGY_RETRY_MAX_INTERVAL":          true, // use before secret
+	"PIGGY_RETRY_MAX_ELAPSED_TIME":      true, // use before secret
+	"PIGGY_CA_BUNDLE":                   true, // use before secret
+	"PIGGY_TLS_CLIENT_CERT_FILE":        true, // use before secret
+	"PIGGY_TLS_CLIENT_KEY_FILE":         true, // use before secret
+	"PIGGY_TOKEN_FILE":                  true, // use before secret
 }
 
 func (e *SanitizedEnv) append(name string, value string) {
@@ -76,6 +116,56 @@ func awsErr(err error) bool {
 	return false
 }
 
+// classifyAWSError wraps AWS errors which piggy-env should not retry with ErrorNotFound,
+// and errors which piggy-env should retry later with ErrorUnavailable
+func classifyAWSError(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	code := apiErr.ErrorCode()
+	if code == "ResourceNotFoundException" || code == "ParameterNotFound" {
+		return fmt.Errorf("%w: %v", ErrorNotFound, err)
+	}
+	_, throttle := retry.DefaultThrottleErrorCodes[code]
+	_, retryable := retry.DefaultRetryableErrorCodes[code]
+	if throttle || retryable {
+		return fmt.Errorf("%w: %v", ErrorUnavailable, err)
+	}
+	return err
+}
+
+// classifyError wraps secret backend errors with ErrorNotFound or ErrorUnavailable
+func classifyError(err error) error {
+	var gcpErr *GCPError
+	if errors.As(err, &gcpErr) {
+		switch {
+		case gcpErr.StatusCode == http.StatusNotFound:
+			return fmt.Errorf("%w: %v", ErrorNotFound, err)
+		case gcpErr.StatusCode == http.StatusTooManyRequests || gcpErr.StatusCode >= http.StatusInternalServerError:
+			return fmt.Errorf("%w: %v", ErrorUnavailable, err)
+		}
+		return err
+	}
+	if k8serrors.IsNotFound(err) {
+		return fmt.Errorf("%w: %v", ErrorNotFound, err)
+	}
+	if k8serrors.IsTooManyRequests(err) || k8serrors.IsServerTimeout(err) || k8serrors.IsServiceUnavailable(err) {
+		return fmt.Errorf("%w: %v", ErrorUnavailable, err)
+	}
+	var azureErr *AzureError
+	if errors.As(err, &azureErr) {
+		switch {
+		case azureErr.StatusCode == http.StatusNotFound:
+			return fmt.Errorf("%w: %v", ErrorNotFound, err)
+		case azureErr.StatusCode == http.StatusTooManyRequests || azureErr.StatusCode >= http.StatusInternalServerError:
+			return fmt.Errorf("%w: %v", ErrorUnavailable, err)
+		}
+		return err
+	}
+	return classifyAWSError(err)
+}
+
 func (s *Service) injectParameters(config *PiggyConfig, env *SanitizedEnv) error {
 	// Create a SSM client
 	pm, err := s.awsFactory.GetSSMClient(s.context, config.AWSRegion)
@@ -86,6 +176,7 @@ func (s *Service) injectParameters(config *PiggyConfig, env *SanitizedEnv) error
 	// Get parameter values
 	var nextToken *string
 	secrets := make(map[string]string)
+	names := make(map[string]string) // parameter name of each key
 
 	for {
 		input := &ssm.GetParametersByPathInput{
@@ -100,8 +191,18 @@ func (s *Service) injectParameters(config *PiggyConfig, env *SanitizedEnv) error
 			return err
 		}
 		for _, param := range output.Parameters {
-			name := filepath.Base(*param.Name)
-			secrets[name] = *param.Value
+			key, err := SSMParameterKey(config.AWSSSMParameterPath, *param.Name, config.AWSSSMParameterKey, config.AWSSSMParameterSeparator)
+			if err != nil {
+				return err
+			}
+			if other, ok := names[key]; ok {
+				if config.AWSSSMParameterKey == SSMParameterKeyPath {
+					return fmt.Errorf("ssm parameters %s and %s map to the same key [%s]", other, *param.Name, key)
+				}
+				log.Warn().Msgf("SSM parameter %s overwrites %s of the same key [%s]", *param.Name, other, key)
+			}
+			names[key] = *param.Name
+			secrets[key] = *param.Value
 		}
 		if output.NextToken == nil {
 			break
@@ -111,6 +212,22 @@ func (s *Service) injectParameters(config *PiggyConfig, env *SanitizedEnv) error
 	return processSecret(config, secrets, env)
 }
 
+// SSMParameterKey returns the secret key of an SSM parameter under the path. The key is the basename of the parameter
+// by default, or the path relative to the parameter path joined with the separator e.g. `/app/db/password` under `/app` is `db_password`
+func SSMParameterKey(path string, name string, mode string, separator string) (string, error) {
+	switch mode {
+	case "", SSMParameterKeyBasename:
+		return filepath.Base(name), nil
+	case SSMParameterKeyPath:
+		if separator == "" {
+			separator = DefaultSSMParameterSeparator
+		}
+		relative := strings.TrimPrefix(strings.TrimPrefix(name, strings.TrimSuffix(path, "/")), "/")
+		return strings.ReplaceAll(relative, "/", separator), nil
+	}
+	return "", fmt.Errorf("invalid ssm parameter key [%s], expecting %s or %s", mode, SSMParameterKeyBasename, SSMParameterKeyPath)
+}
+
 func (s *Service) injectSecrets(config *PiggyConfig, env *SanitizedEnv) error {
 	// Create a Secrets Manager client
 	sm, err := s.awsFactory.GetSecretsManagerClient(s.context, config.AWSRegion)
@@ -150,30 +267,217 @@ func (s *Service) injectSecrets(config *PiggyConfig, env *SanitizedEnv) error {
 }
 
 func processSecret(config *PiggyConfig, secrets map[string]string, env *SanitizedEnv) error {
+	if config.AccessPolicy != nil {
+		log.Debug().Msgf("Decision [true] by SecretAccessPolicy [%s]", config.AccessPolicy.Policy)
+		for name, value := range secrets {
+			if config.allowKey(name) {
+				env.append(name, value)
+			}
+		}
+		return nil
+	}
 	allowed := false
 	if sas, ok := secrets["PIGGY_ALLOWED_SA"]; ok && config.PodServiceAccountName != "" {
 		log.Debug().Msgf("Allowed service accounts [%s]", sas)
 		log.Debug().Msgf("Pod service account [%s]", config.PodServiceAccountName)
 		// if secrets contains PIGGY_ALLOWED_SA
-		for _, sa := range strings.Split(sas, ",") {
-			if sa == config.PodServiceAccountName {
-				allowed = true
-				break
-			}
-		}
+		var rule string
+		allowed, rule = matchAllowedSA(sas, config.PodServiceAccountName, config.ServiceAccountLabels)
+		log.Debug().Msgf("Decision [%v] by rule [%s]", allowed, rule)
 	} else {
 		allowed = !config.PiggyEnforceServiceAccount
+		log.Debug().Msgf("Decision [%v]", allowed)
 	}
-	log.Debug().Msgf("Decision [%v]", allowed)
 	if allowed {
 		for name, value := range secrets {
-			env.append(name, value)
+			if config.allowKey(name) {
+				env.append(name, value)
+			}
 		}
 		return nil
 	}
 	return ErrorAuthorized
 }
 
+// secretName returns the name of the secret to read, a GCP secret, an Azure Key Vault, a Kubernetes Secret,
+// a SOPS document, an SSM parameter path or an AWS secret
+func (config *PiggyConfig) secretName() string {
+	if config.GCPSecretName != "" {
+		return config.GCPSecretName
+	}
+	if config.AzureKeyVaultName != "" {
+		return config.AzureKeyVaultName
+	}
+	if config.K8sSecretName != "" {
+		return config.K8sSecretName
+	}
+	if config.SOPSConfigMap != "" {
+		return config.SOPSConfigMap
+	}
+	if config.SOPSFile != "" {
+		return config.SOPSFile
+	}
+	if config.AWSSSMParameterPath != "" {
+		return config.AWSSSMParameterPath
+	}
+	return config.AWSSecretName
+}
+
+// IsGeneratedReference returns true if the reference is generated by piggy-env with the AWS identity of the pod.
+// piggy-webhooks never generates credentials, so a pod cannot borrow the role of piggy-webhooks
+func IsGeneratedReference(reference string) bool {
+	return strings.HasPrefix(reference, PrefixRDSIAMToken) || strings.HasPrefix(reference, PrefixSTS)
+}
+
+// allowKey returns true if the secret key is referenced by the container and granted by the access policy
+func (config *PiggyConfig) allowKey(name string) bool {
+	if config.ContainerKeys != nil && !config.ContainerKeys[name] {
+		return false
+	}
+	if config.AccessPolicy != nil && config.AccessPolicy.Keys != nil && !config.AccessPolicy.Keys[name] {
+		return false
+	}
+	return true
+}
+
+func (s *Service) createTokenReview(token string, audiences []string) (*authv1.TokenReview, error) {
+	tr := authv1.TokenReview{
+		Spec: authv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: audiences,
+		},
+	}
+	review, err := s.k8sClient.AuthenticationV1().TokenReviews().Create(context.TODO(), &tr, metav1.CreateOptions{})
+	if err != nil {
+		if statusError, isStatus := err.(*k8serrors.StatusError); isStatus {
+			return nil, fmt.Errorf("error review token %v", statusError.ErrStatus.Message)
+		}
+		return nil, err
+	}
+	return review, nil
+}
+
+// reviewToken reviews a token bound to piggy audience. Falls back to the API server audience
+// for pods mutated before bound tokens were used, unless bound token is enforced
+func (s *Service) reviewToken(token string) (*authv1.TokenReview, error) {
+	audience := GetStringValue(EmptyMap, ConfigPiggyTokenAudience, DefaultPiggyTokenAudience)
+	review, err := s.createTokenReview(token, []string{audience})
+	if err != nil {
+		return nil, err
+	}
+	if review.Status.Authenticated {
+		if !slices.Contains(review.Status.Audiences, audience) {
+			return nil, fmt.Errorf("%w: token is not issued for %s audience", ErrorAuthorized, audience)
+		}
+		return review, nil
+	}
+	if GetBoolValue(EmptyMap, ConfigPiggyEnforceBoundToken, false) {
+		return nil, fmt.Errorf("%w: token is not authenticated", ErrorAuthorized)
+	}
+	review, err = s.createTokenReview(token, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		return nil, fmt.Errorf("%w: token is not authenticated", ErrorAuthorized)
+	}
+	log.Debug().Msgf("Request with a token not bound to %s audience", audience)
+	return review, nil
+}
+
+// verifySignature verifies an HMAC signed piggy-uid entry against the request and the image the container is running
+func (s *Service) verifySignature(pod *corev1.Pod, entry SignatureEntry, payload *GetSecretPayload, enforceIntegrity bool) error {
+	if entry.Version > SignatureVersionHMAC {
+		return fmt.Errorf("%w: %s unsupported signature version %d", ErrorIntegrity, pod.Name, entry.Version)
+	}
+	if s.signer == nil {
+		return fmt.Errorf("%s signature version %d requires a signing key", pod.Name, entry.Version)
+	}
+	command := ""
+	if enforceIntegrity {
+		command = payload.Signature
+	}
+	references := slices.Clone(payload.References)
+	slices.Sort(references)
+	references = slices.Compact(references)
+	if !s.signer.Verify(entry, command, references) {
+		return fmt.Errorf("%w: %s invalid signature", ErrorIntegrity, pod.Name)
+	}
+	if entry.Image != "" {
+		imageID := containerImageID(pod, entry.Container)
+		if imageID == "" {
+			return fmt.Errorf("%w: container %s has not reported its image yet", ErrorUnavailable, entry.Container)
+		}
+		if imageID[strings.LastIndex(imageID, "@")+1:] != entry.Image {
+			return fmt.Errorf("%w: container %s image %s does not match the signed image digest %s", ErrorIntegrity, entry.Container, imageID, entry.Image)
+		}
+	}
+	return nil
+}
+
+// containerImageID returns the image ID reported by the container or init container
+func containerImageID(pod *corev1.Pod, name string) string {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses} {
+		for _, status := range statuses {
+			if status.Name == name {
+				return status.ImageID
+			}
+		}
+	}
+	return ""
+}
+
+// checkAccessPolicy finds a SecretAccessPolicy granting the pod access to the secret.
+// Without a matching policy, the request is denied if access policy is enforced
+func (s *Service) checkAccessPolicy(pod *corev1.Pod, config *PiggyConfig) error {
+	secretName := config.secretName()
+	if s.policies != nil {
+		policies, err := s.policies.List()
+		if err != nil {
+			return err
+		}
+		config.AccessPolicy = EvaluatePolicies(policies, pod, secretName)
+	}
+	if config.AccessPolicy == nil && GetBoolValue(EmptyMap, ConfigPiggyEnforceAccessPolicy, false) {
+		log.Debug().Msgf("No SecretAccessPolicy grants [pod=%s/%s] access to [%s]", pod.Namespace, pod.Name, secretName)
+		return ErrorAuthorized
+	}
+	return nil
+}
+
+// firstStart returns true while the pod is pending or the container has not restarted. A container which has not
+// reported its status yet is starting. Without a container name, no container of the pod may have restarted
+func firstStart(pod *corev1.Pod, container string) bool {
+	if pod.Status.Phase == corev1.PodPending {
+		return true
+	}
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if (container == "" || status.Name == container) && status.RestartCount > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkReplay rejects requests which have already been served. Returns the replay cache key of the request
+func (s *Service) checkReplay(pod *corev1.Pod, uid string, container string) (string, error) {
+	switch GetStringValue(EmptyMap, ConfigPiggyReplayProtection, "") {
+	case ReplayProtectionOnce:
+		key := fmt.Sprintf("%s/%s", pod.UID, uid)
+		if !s.replayCache.Add(key) {
+			return "", ErrorReplay
+		}
+		return key, nil
+	case ReplayProtectionPending:
+		if !firstStart(pod, container) {
+			return "", ErrorReplay
+		}
+	}
+	return "", nil
+}
+
 func (s *Service) GetSecret(payload *GetSecretPayload) (*SanitizedEnv, Info, error) {
 	// creates the in-cluster config
 	// config, err := rest.InClusterConfig()
@@ -190,40 +494,54 @@ func (s *Service) GetSecret(payload *GetSecretPayload) (*SanitizedEnv, Info, err
 		Name:      payload.Name,
 		UID:       payload.UID,
 	}
-	tr := authv1.TokenReview{
-		Spec: authv1.TokenReviewSpec{
-			Token: payload.Token,
-		},
+	// limit requests by the remote IP first, so a flood of invalid tokens does not reach the API server
+	if err := s.checkRemoteRateLimit(payload.RemoteIP); err != nil {
+		return nil, info, err
 	}
-	review, err := s.k8sClient.AuthenticationV1().TokenReviews().Create(context.TODO(), &tr, metav1.CreateOptions{})
+	review, err := s.reviewToken(payload.Token)
 	if err != nil {
-		if statusError, isStatus := err.(*k8serrors.StatusError); isStatus {
-			return nil, info, fmt.Errorf("error review token %v", statusError.ErrStatus.Message)
-		}
 		return nil, info, err
 	}
-	if !review.Status.Authenticated {
-		return nil, info, errors.New("token is not authenticated")
-	}
 	fqSa := review.Status.User.Username
 	tokenSa := strings.TrimPrefix(fqSa, "system:serviceaccount:")
 	log.Debug().Msgf("Request from [sa=%s], [pod=%s]", tokenSa, payload.Name)
 	namespace := strings.Split(tokenSa, ":")[0]
 	info.Namespace = namespace
 	info.ServiceAccount = tokenSa
+	if err := s.checkRateLimit(namespace, tokenSa); err != nil {
+		return nil, info, err
+	}
+	// use the pod bound to the token instead of trusting the payload
+	podName := payload.Name
+	if names := review.Status.User.Extra[claimPodName]; len(names) > 0 {
+		if payload.Name != "" && payload.Name != names[0] {
+			return nil, info, fmt.Errorf("%w: pod %s does not match the token bound pod %s", ErrorAuthorized, payload.Name, names[0])
+		}
+		podName = names[0]
+		info.Name = podName
+	}
+	if podName == "" {
+		return nil, info, fmt.Errorf("malformed payload: pod name is not supplied by payload or token")
+	}
 	// get a pod
-	pod, err := s.k8sClient.CoreV1().Pods(namespace).Get(context.TODO(), payload.Name, metav1.GetOptions{})
+	pod, err := s.k8sClient.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
-			return nil, info, fmt.Errorf("pod %s not found in %s namespace", payload.Name, namespace)
+			return nil, info, fmt.Errorf("pod %s not found in %s namespace", podName, namespace)
 		} else if statusError, isStatus := err.(*k8serrors.StatusError); isStatus {
 			return nil, info, fmt.Errorf("error getting pod %v", statusError.ErrStatus.Message)
 		}
 		return nil, info, err
 	}
+	if uids := review.Status.User.Extra[claimPodUID]; len(uids) > 0 && string(pod.UID) != uids[0] {
+		return nil, info, fmt.Errorf("%w: pod %s uid does not match the token bound pod uid", ErrorAuthorized, podName)
+	}
+	if nodes := review.Status.User.Extra[claimNode]; len(nodes) > 0 && pod.Spec.NodeName != nodes[0] {
+		return nil, info, fmt.Errorf("%w: pod %s node does not match the token bound node %s", ErrorAuthorized, podName, nodes[0])
+	}
 	podSa := fmt.Sprintf("%s:%s", namespace, pod.Spec.ServiceAccountName)
 	if podSa != tokenSa {
-		return nil, info, fmt.Errorf("invalid service account found %s, expected %s", podSa, tokenSa)
+		return nil, info, fmt.Errorf("%w: invalid service account found %s, expected %s", ErrorAuthorized, podSa, tokenSa)
 	}
 	annotations := pod.Annotations
 	defaultPrefix := GetStringValue(annotations, ConfigPiggyDefaultSecretNamePrefix, "")
@@ -231,34 +549,120 @@ func (s *Service) GetSecret(payload *GetSecretPayload) (*SanitizedEnv, Info, err
 	config := &PiggyConfig{
 		AWSSecretName:                GetStringValue(annotations, AWSSecretName, fmt.Sprintf("%s%s/%s%s", defaultPrefix, namespace, pod.Spec.ServiceAccountName, defaultSuffix)),
 		AWSSSMParameterPath:          GetStringValue(annotations, AWSSSMParameterPath, ""),
+		AWSSSMParameterKey:           GetStringValue(annotations, AWSSSMParameterKey, SSMParameterKeyBasename),
+		AWSSSMParameterSeparator:     GetStringValue(annotations, AWSSSMParameterSeparator, DefaultSSMParameterSeparator),
+		AWSSSMSplitStringList:        GetBoolValue(annotations, AWSSSMSplitStringList, false),
 		AWSSecretVersion:             GetStringValue(annotations, AWSSecretVersion, "AWSCURRENT"),
 		AWSRegion:                    GetStringValue(annotations, ConfigAWSRegion, ""),
+		GCPSecretName:                GetStringValue(annotations, GCPSecretName, ""),
+		GCPSecretProject:             GetStringValue(annotations, GCPSecretProject, ""),
+		GCPSecretVersion:             GetStringValue(annotations, GCPSecretVersion, "latest"),
+		GCPSecretCredentialsFile:     GetStringValue(EmptyMap, ConfigGCPSecretCredentialsFile, ""),
+		AzureKeyVaultName:            GetStringValue(annotations, AzureKeyVaultName, ""),
+		K8sSecretName:                GetStringValue(annotations, K8sSecretName, ""),
+		K8sSecretNamespace:           GetStringValue(EmptyMap, K8sSecretNamespace, ""),
+		SOPSConfigMap:                GetStringValue(annotations, SOPSConfigMap, ""),
+		SOPSFile:                     GetStringValue(annotations, SOPSFile, ""),
+		SOPSFileDir:                  GetStringValue(EmptyMap, ConfigSOPSFileDir, ""),
+		SOPSAgeKeyFile:               GetStringValue(EmptyMap, ConfigSOPSAgeKeyFile, ""),
 		PodServiceAccountName:        tokenSa,
 		PiggyEnforceIntegrity:        GetBoolValue(annotations, ConfigPiggyEnforceIntegrity, true),
 		PiggyEnforceServiceAccount:   GetBoolValue(EmptyMap, ConfigPiggyEnforceServiceAccount, false),
 		PiggyDefaultSecretNamePrefix: defaultPrefix,
 		PiggyDefaultSecretNameSuffix: defaultSuffix,
 	}
-	info.SecretName = config.AWSSecretName
+	config.ServiceAccountLabels = func() labels.Set {
+		serviceAccount, err := s.k8sClient.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), pod.Spec.ServiceAccountName, metav1.GetOptions{})
+		if err != nil {
+			log.Error().Msgf("Error getting service account %s: %v", tokenSa, err)
+			return labels.Set{}
+		}
+		return serviceAccount.Labels
+	}
+	info.SecretName = config.secretName()
 	info.SSMParameterPath = config.AWSSSMParameterPath
 	signature := make(Signature)
 	if err := json.Unmarshal([]byte(annotations[Namespace+ConfigPiggyUID]), &signature); err != nil {
 		log.Error().Msgf("Error while unmarshal signature %v", err)
 	}
-	if config.PiggyEnforceIntegrity {
-		if signature[payload.UID] != payload.Signature {
-			return nil, info, fmt.Errorf("%s invalid signature", payload.Name)
+	entry := signature[payload.UID]
+	if entry.Version >= SignatureVersionHMAC {
+		if err := s.verifySignature(pod, entry, payload, config.PiggyEnforceIntegrity); err != nil {
+			return nil, info, err
 		}
-	} else if signature[payload.UID] == "" {
-		return nil, info, fmt.Errorf("%s invalid uid", payload.Name)
+	} else if GetBoolValue(EmptyMap, ConfigPiggyEnforceHMACSignature, false) {
+		return nil, info, fmt.Errorf("%w: %s signature version %d is not allowed", ErrorIntegrity, payload.Name, entry.Version)
+	} else if config.PiggyEnforceIntegrity {
+		if entry.Signature != payload.Signature {
+			return nil, info, fmt.Errorf("%w: %s invalid signature", ErrorIntegrity, payload.Name)
+		}
+	} else if entry.Signature == "" {
+		return nil, info, fmt.Errorf("%w: %s invalid uid", ErrorIntegrity, payload.Name)
+	}
+	if len(entry.Keys) > 0 {
+		config.ContainerKeys = make(map[string]bool, len(entry.Keys))
+		for _, key := range secretKeys(entry.Keys) {
+			config.ContainerKeys[key] = true
+		}
+	}
+
+	references := payload.References
+	if len(references) == 0 && len(entry.Keys) > 0 {
+		references = entry.Keys
+	}
+	ciphertexts, keys := SplitKMSReferences(secretKeys(references))
+	parameters, keys := SplitSSMReferences(keys)
+	keys = slices.DeleteFunc(keys, IsGeneratedReference)
+	readSecretStore := len(references) == 0 || len(keys) > 0
+
+	// ciphertexts, parameters and generated credentials are authorized on their own
+	if readSecretStore {
+		if err := s.checkAccessPolicy(pod, config); err != nil {
+			return nil, info, err
+		}
+	}
+
+	replayKey, err := s.checkReplay(pod, payload.UID, entry.Container)
+	if err != nil {
+		return nil, info, err
 	}
 
 	sanitized := &SanitizedEnv{}
-	if config.AWSSSMParameterPath != "" {
+	if !readSecretStore {
+		log.Debug().Msgf("No secret key referenced [ciphertexts=%d], [parameters=%d]", len(ciphertexts), len(parameters))
+	} else if config.GCPSecretName != "" {
+		log.Debug().Msgf("GCP Secret [name=%s]", config.GCPSecretName)
+		err = s.injectGCPSecret(config, sanitized)
+	} else if config.AzureKeyVaultName != "" {
+		log.Debug().Msgf("Azure Key Vault [name=%s]", config.AzureKeyVaultName)
+		err = s.injectAzureSecret(config, keys, sanitized)
+	} else if config.K8sSecretName != "" {
+		log.Debug().Msgf("Kubernetes Secret [name=%s/%s]", config.K8sSecretNamespace, config.K8sSecretName)
+		err = s.injectK8sSecret(config, sanitized)
+	} else if config.SOPSConfigMap != "" || config.SOPSFile != "" {
+		log.Debug().Msgf("SOPS document [name=%s]", config.secretName())
+		err = s.injectSOPSSecret(config, namespace, sanitized)
+	} else if config.AWSSSMParameterPath != "" {
 		log.Debug().Msgf("SSM Parameter [path=%s]", config.AWSSSMParameterPath)
 		err = s.injectParameters(config, sanitized)
 	} else {
 		err = s.injectSecrets(config, sanitized)
 	}
+	if err == nil && len(parameters) > 0 {
+		err = s.injectSSMParameters(config, pod, parameters, sanitized)
+	}
+	if err == nil && len(ciphertexts) > 0 {
+		err = s.injectKMSSecret(config, ciphertexts, namespace, pod.Spec.ServiceAccountName, sanitized)
+	}
+	if err == nil && len(references) > 0 {
+		sanitized = resolveReferences(references, *sanitized)
+	}
+	if err != nil && replayKey != "" {
+		// allow piggy-env to retry since nothing was served
+		s.replayCache.Remove(replayKey)
+	}
+	if err != nil {
+		err = classifyError(err)
+	}
 	return sanitized, info, err
 }
@@ -2,12 +2,15 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
 	"github.com/stretchr/testify/assert"
 	authv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -25,12 +28,20 @@ func setupTest(objects ...runtime.Object) (context.Context, *fake.Clientset, *Se
 }
 
 func mockTokenReview(client *fake.Clientset, username string, authenticated bool) {
+	mockBoundTokenReview(client, username, authenticated, nil)
+}
+
+// mockBoundTokenReview returns the requested audiences and the given bound claims
+func mockBoundTokenReview(client *fake.Clientset, username string, authenticated bool, extra map[string]authv1.ExtraValue) {
 	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		tr := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview)
 		return true, &authv1.TokenReview{
 			Status: authv1.TokenReviewStatus{
 				Authenticated: authenticated,
+				Audiences:     tr.Spec.Audiences,
 				User: authv1.UserInfo{
 					Username: username,
+					Extra:    extra,
 				},
 			},
 		}, nil
@@ -148,6 +159,18 @@ func TestAwsErr(t *testing.T) {
 	assert.True(t, awsErr(errors.New("generic error")))
 }
 
+// TestClassifyAWSError verifies that missing secrets and throttling are told apart from other AWS errors.
+func TestClassifyAWSError(t *testing.T) {
+	generic := errors.New("generic error")
+	assert.Equal(t, generic, classifyAWSError(generic))
+	assert.ErrorIs(t, classifyAWSError(&smithy.GenericAPIError{Code: "ResourceNotFoundException"}), ErrorNotFound)
+	assert.ErrorIs(t, classifyAWSError(&smithy.GenericAPIError{Code: "ParameterNotFound"}), ErrorNotFound)
+	assert.ErrorIs(t, classifyAWSError(&smithy.GenericAPIError{Code: "ThrottlingException"}), ErrorUnavailable)
+	err := classifyAWSError(&smithy.GenericAPIError{Code: "AccessDeniedException"})
+	assert.NotErrorIs(t, err, ErrorNotFound)
+	assert.NotErrorIs(t, err, ErrorUnavailable)
+}
+
 // TestProcessSecret ensures that secrets are correctly processed and filtered based on service account permissions.
 func TestProcessSecret(t *testing.T) {
 	config := &PiggyConfig{
@@ -325,3 +348,451 @@ func TestInjectParameters_Success(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "localhost", (*env)["DB_HOST"])
 }
+
+// TestSSMParameterKey verifies mapping SSM parameter names to secret keys.
+func TestSSMParameterKey(t *testing.T) {
+	for _, tc := range []struct {
+		path, name, mode, separator, key string
+	}{
+		{"/app", "/app/db/password", "", "", "password"},
+		{"/app", "/app/db/password", SSMParameterKeyBasename, "", "password"},
+		{"/app", "/app/db/password", SSMParameterKeyPath, "", "db_password"},
+		{"/app/", "/app/db/password", SSMParameterKeyPath, ".", "db.password"},
+		{"/", "/app/db/password", SSMParameterKeyPath, "__", "app__db__password"},
+		{"/app", "/app/DB_HOST", SSMParameterKeyPath, "_", "DB_HOST"},
+	} {
+		key, err := SSMParameterKey(tc.path, tc.name, tc.mode, tc.separator)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.key, key, tc.name)
+	}
+	_, err := SSMParameterKey("/app", "/app/db/password", "relative", "")
+	assert.Error(t, err)
+}
+
+// TestInjectParameters_Path verifies that parameters are keyed by relative path and collisions are rejected.
+func TestInjectParameters_Path(t *testing.T) {
+	names := []string{"/app/db/password", "/app/cache/password"}
+	mockSSM := &MockSSMClient{
+		GetParametersByPathFunc: func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+			var parameters []types.Parameter
+			for _, name := range names {
+				parameters = append(parameters, types.Parameter{Name: aws.String(name), Value: aws.String("value of " + name)})
+			}
+			return &ssm.GetParametersByPathOutput{Parameters: parameters}, nil
+		},
+	}
+	svc := &Service{
+		awsFactory: &MockAWSClientFactory{
+			GetSSMClientFunc: func(ctx context.Context, region string) (SSMClient, error) {
+				return mockSSM, nil
+			},
+		},
+		context: context.Background(),
+	}
+
+	// Case 1: Basename overwrites the parameters of the same name
+	env := &SanitizedEnv{}
+	assert.NoError(t, svc.injectParameters(&PiggyConfig{AWSSSMParameterPath: "/app"}, env))
+	assert.Equal(t, SanitizedEnv{"password": "value of /app/cache/password"}, *env)
+
+	// Case 2: Relative path
+	config := &PiggyConfig{AWSSSMParameterPath: "/app", AWSSSMParameterKey: SSMParameterKeyPath, AWSSSMParameterSeparator: "_"}
+	env = &SanitizedEnv{}
+	assert.NoError(t, svc.injectParameters(config, env))
+	assert.Equal(t, SanitizedEnv{
+		"db_password":    "value of /app/db/password",
+		"cache_password": "value of /app/cache/password",
+	}, *env)
+
+	// Case 3: Collision
+	names = append(names, "/app/db_password")
+	env = &SanitizedEnv{}
+	err := svc.injectParameters(config, env)
+	assert.ErrorContains(t, err, "map to the same key [db_password]")
+	assert.Empty(t, *env)
+}
+
+// TestGetSecret_BoundPodMismatch verifies that the pod name in payload must match the token bound pod.
+func TestGetSecret_BoundPodMismatch(t *testing.T) {
+	ns, name, sa := "default", "test-pod", "test-sa"
+	pod := newPod(ns, name, sa, nil)
+
+	_, client, svc := setupTest(pod)
+	mockBoundTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true, map[string]authv1.ExtraValue{
+		claimPodName: {"other-pod"},
+	})
+
+	payload := &GetSecretPayload{
+		Name:  name,
+		Token: "valid-token",
+	}
+
+	_, _, err := svc.GetSecret(payload)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match the token bound pod other-pod")
+}
+
+// TestGetSecret_BoundPodUIDMismatch verifies that a token bound to a deleted pod with the same name is rejected.
+func TestGetSecret_BoundPodUIDMismatch(t *testing.T) {
+	ns, name, sa := "default", "test-pod", "test-sa"
+	pod := newPod(ns, name, sa, nil)
+	pod.UID = "new-uid"
+
+	_, client, svc := setupTest(pod)
+	mockBoundTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true, map[string]authv1.ExtraValue{
+		claimPodName: {name},
+		claimPodUID:  {"old-uid"},
+	})
+
+	payload := &GetSecretPayload{
+		Name:  name,
+		Token: "valid-token",
+	}
+
+	_, _, err := svc.GetSecret(payload)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "uid does not match the token bound pod uid")
+}
+
+// TestGetSecret_BoundPodWithoutName verifies that the pod name is read from the bound token when the payload has no name.
+func TestGetSecret_BoundPodWithoutName(t *testing.T) {
+	ns, name, sa := "default", "test-pod", "test-sa"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+	})
+
+	// Case 1: Legacy token without a name
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	_, _, err := svc.GetSecret(&GetSecretPayload{Token: "valid-token"})
+	assert.ErrorContains(t, err, "pod name is not supplied")
+
+	// Case 2: Bound token without a name
+	_, client, svc = setupTest(pod)
+	mockBoundTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true, map[string]authv1.ExtraValue{
+		claimPodName: {name},
+	})
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(`{"DB_PASS": "secret"}`)}, nil
+				},
+			}, nil
+		},
+	}
+	env, info, err := svc.GetSecret(&GetSecretPayload{Token: "valid-token", UID: "test-uid", Signature: "correct-signature"})
+	assert.NoError(t, err)
+	assert.Equal(t, name, info.Name)
+	assert.Equal(t, "secret", (*env)["DB_PASS"])
+}
+
+// TestReviewToken verifies the audience check of bound tokens and the fallback to legacy tokens.
+func TestReviewToken(t *testing.T) {
+	// Case 1: Bound token
+	_, client, svc := setupTest()
+	mockTokenReview(client, "system:serviceaccount:default:test-sa", true)
+	review, err := svc.reviewToken("token")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{DefaultPiggyTokenAudience}, review.Status.Audiences)
+
+	// Case 2: Authenticated without piggy audience
+	_, client, svc = setupTest()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, &authv1.TokenReview{
+			Status: authv1.TokenReviewStatus{
+				Authenticated: true,
+				Audiences:     []string{"https://kubernetes.default.svc"},
+			},
+		}, nil
+	})
+	_, err = svc.reviewToken("token")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "audience")
+
+	// Case 3: Legacy token is accepted unless bound token is enforced
+	_, client, svc = setupTest()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		tr := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview)
+		return true, &authv1.TokenReview{
+			Status: authv1.TokenReviewStatus{
+				Authenticated: len(tr.Spec.Audiences) == 0,
+			},
+		}, nil
+	})
+	_, err = svc.reviewToken("token")
+	assert.NoError(t, err)
+
+	t.Setenv("PIGGY_ENFORCE_BOUND_TOKEN", "true")
+	_, err = svc.reviewToken("token")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "token is not authenticated")
+}
+
+// TestGetSecret_BoundNodeMismatch verifies that a token bound to another node is rejected.
+func TestGetSecret_BoundNodeMismatch(t *testing.T) {
+	ns, name, sa := "default", "test-pod", "test-sa"
+	pod := newPod(ns, name, sa, nil)
+	pod.Spec.NodeName = "node-a"
+
+	_, client, svc := setupTest(pod)
+	mockBoundTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true, map[string]authv1.ExtraValue{
+		claimPodName: {name},
+		claimNode:    {"node-b"},
+	})
+
+	payload := &GetSecretPayload{
+		Name:  name,
+		Token: "valid-token",
+	}
+
+	_, _, err := svc.GetSecret(payload)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match the token bound node node-b")
+}
+
+// TestGetSecret_ReplayProtection verifies that replayed requests are rejected.
+func TestGetSecret_ReplayProtection(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+	})
+	pod.UID = "pod-uid"
+	pod.Status.Phase = corev1.PodRunning
+
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	secretVal := `{"DB_PASS": "secret"}`
+	failed := true
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			if failed {
+				return nil, errors.New("connection failed")
+			}
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					return &secretsmanager.GetSecretValueOutput{SecretString: &secretVal}, nil
+				},
+			}, nil
+		},
+	}
+	payload := &GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+	}
+
+	// Case 1: Served only once
+	t.Setenv("PIGGY_REPLAY_PROTECTION", ReplayProtectionOnce)
+	_, _, err := svc.GetSecret(payload)
+	assert.Error(t, err)
+	// a failed request can be retried
+	failed = false
+	env, _, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", (*env)["DB_PASS"])
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorReplay)
+
+	// Case 2: Served on the first start of a running pod
+	t.Setenv("PIGGY_REPLAY_PROTECTION", ReplayProtectionPending)
+	env, _, err = svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", (*env)["DB_PASS"])
+
+	// Case 3: Not served after a container restarted
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "app", RestartCount: 1}}
+	_, err = client.CoreV1().Pods(ns).UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorReplay)
+}
+
+// TestFirstStart verifies telling the first start of a container from a restart.
+func TestFirstStart(t *testing.T) {
+	pod := newPod("default", "test-pod", "test-sa", nil)
+	pod.Status.Phase = corev1.PodPending
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{{Name: "init", RestartCount: 1}}
+	assert.True(t, firstStart(pod, "init"))
+
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "app"}, {Name: "sidecar", RestartCount: 2}}
+	assert.True(t, firstStart(pod, "app"))
+	assert.True(t, firstStart(pod, "not-reported"))
+	assert.False(t, firstStart(pod, "sidecar"))
+	assert.False(t, firstStart(pod, "init"))
+	// without a container name, no container may have restarted
+	assert.False(t, firstStart(pod, ""))
+	pod.Status.InitContainerStatuses = nil
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "app"}}
+	assert.True(t, firstStart(pod, ""))
+}
+
+// TestSignature_Unmarshal verifies that both plain signatures and entries with keys are accepted.
+func TestSignature_Unmarshal(t *testing.T) {
+	signature := make(Signature)
+	err := json.Unmarshal([]byte(`{"a": "sig-a", "b": {"signature": "sig-b", "keys": ["DB_PASS"]}}`), &signature)
+	assert.NoError(t, err)
+	assert.Equal(t, SignatureEntry{Signature: "sig-a"}, signature["a"])
+	assert.Equal(t, SignatureEntry{Signature: "sig-b", Keys: []string{"DB_PASS"}}, signature["b"])
+}
+
+// TestGetSecret_ContainerKeys verifies that only the keys referenced by the container are returned.
+func TestGetSecret_ContainerKeys(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": {"signature": "correct-signature", "keys": ["DB_PASS"]}}`,
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	secretVal := `{"DB_PASS": "secret", "API_KEY": "key"}`
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					return &secretsmanager.GetSecretValueOutput{SecretString: &secretVal}, nil
+				},
+			}, nil
+		},
+	}
+	env, _, err := svc.GetSecret(&GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, SanitizedEnv{"DB_PASS": "secret"}, *env)
+}
+
+// TestGetSecret_HMACSignature verifies signed piggy-uid entries against the request and the container image.
+func TestGetSecret_HMACSignature(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	signer, _ := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	entry := signer.Sign(SignatureEntry{
+		Container: "app",
+		Image:     "sha256:abc",
+		Keys:      []string{"DB_PASS"},
+	}, "command-hash")
+	signature, _ := json.Marshal(Signature{uid: entry})
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: string(signature),
+	})
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "app", ImageID: "docker.io/library/app@sha256:abc"},
+	}
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	secretVal := `{"DB_PASS": "secret", "API_KEY": "key"}`
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					return &secretsmanager.GetSecretValueOutput{SecretString: &secretVal}, nil
+				},
+			}, nil
+		},
+	}
+	payload := &GetSecretPayload{
+		Name:       name,
+		Token:      "valid-token",
+		UID:        uid,
+		Signature:  "command-hash",
+		References: []string{"DB_PASS"},
+	}
+
+	// Case 1: No signing key
+	_, _, err := svc.GetSecret(payload)
+	assert.Error(t, err)
+
+	// Case 2: Valid signature
+	svc.SetSigner(signer)
+	env, _, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, SanitizedEnv{"DB_PASS": "secret"}, *env)
+
+	// Case 3: References do not match
+	payload.References = []string{"API_KEY", "DB_PASS"}
+	_, _, err = svc.GetSecret(payload)
+	assert.Error(t, err)
+	payload.References = []string{"DB_PASS"}
+
+	// Case 4: Keys of the annotation are widened without the signature
+	tampered := entry
+	tampered.Keys = []string{"API_KEY", "DB_PASS"}
+	tamperedSignature, _ := json.Marshal(Signature{uid: tampered})
+	pod.Annotations[Namespace+ConfigPiggyUID] = string(tamperedSignature)
+	_, _ = client.CoreV1().Pods(ns).Update(context.Background(), pod, metav1.UpdateOptions{})
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorIntegrity)
+	payload.References = []string{"API_KEY", "DB_PASS"}
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorIntegrity)
+	payload.References = []string{"DB_PASS"}
+	pod.Annotations[Namespace+ConfigPiggyUID] = string(signature)
+	pod, _ = client.CoreV1().Pods(ns).Update(context.Background(), pod, metav1.UpdateOptions{})
+
+	// Case 5: Command does not match
+	payload.Signature = "other-hash"
+	_, _, err = svc.GetSecret(payload)
+	assert.Error(t, err)
+	payload.Signature = "command-hash"
+
+	// Case 6: Container runs another image
+	pod.Status.ContainerStatuses[0].ImageID = "docker.io/library/app@sha256:def"
+	_, _ = client.CoreV1().Pods(ns).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{})
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorContains(t, err, "does not match the signed image digest")
+
+	// Case 7: Container has not reported its image yet, so piggy-env retries
+	pod.Status.ContainerStatuses[0].ImageID = ""
+	_, _ = client.CoreV1().Pods(ns).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{})
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorUnavailable)
+}
+
+// TestGetSecret_EnforceHMACSignature verifies that unsigned piggy-uid entries are rejected when HMAC signature is enforced.
+func TestGetSecret_EnforceHMACSignature(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	t.Setenv("PIGGY_ENFORCE_HMAC_SIGNATURE", "true")
+	_, _, err := svc.GetSecret(&GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+	})
+	assert.ErrorContains(t, err, "signature version 0 is not allowed")
+}
+
+// TestGetSecret_GeneratedReferences verifies that credentials generated by piggy-env are not read from the secret store.
+func TestGetSecret_GeneratedReferences(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return nil, errors.New("secret store should not be read")
+		},
+	}
+	assert.True(t, IsGeneratedReference("rds-iam-token:mydb:5432:app"))
+	assert.True(t, IsGeneratedReference("sts:arn:aws:iam::123456789012:role/app"))
+	assert.False(t, IsGeneratedReference("DB_PASS"))
+	env, _, err := svc.GetSecret(&GetSecretPayload{
+		Name:       name,
+		Token:      "valid-token",
+		UID:        uid,
+		Signature:  "correct-signature",
+		References: []string{"rds-iam-token:mydb:5432:app", "sts:arn:aws:iam::123456789012:role/app"},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, *env)
+}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -16,17 +19,86 @@ var (
 	EmptyMap = make(map[string]string)
 	// ErrorAuthorized when requestor does not have a permission
 	ErrorAuthorized = errors.New("decision not allowed")
+	// ErrorReplay when the request has already been served or is no longer allowed for the pod
+	ErrorReplay = errors.New("request is not allowed to be served again")
+	// ErrorIntegrity when the request does not match the piggy-uid signature
+	ErrorIntegrity = errors.New("integrity check failed")
+	// ErrorNotFound when the secret does not exist
+	ErrorNotFound = errors.New("secret not found")
+	// ErrorUnavailable when the secret backend is throttling or temporarily failing
+	ErrorUnavailable = errors.New("secret backend is unavailable")
 )
 
 const VolumeNamePiggy = "piggy-env"
+const VolumeNamePiggyTLS = "piggy-tls"
+const VolumeNamePiggyToken = "piggy-token"
+const PiggyTokenMountPath = "/var/run/secrets/piggysec.com/serviceaccount/"
+const DefaultPiggyTokenAudience = "piggysec.com"
 const PrefixPiggy = "piggy:"
 
+// embeddedRegx matches `${piggy:KEY}` references and `$${piggy:KEY}` escapes embedded in a value
+var embeddedRegx = regexp.MustCompile(`\$?\$\{piggy:([^}]+)\}`)
+
+// PrefixKMS a reference to an inline AWS KMS ciphertext e.g. `piggy:kms:AQICAHh...`
+const PrefixKMS = "kms:"
+
+// PrefixRDSIAMToken a reference to an RDS IAM authentication token generated by piggy-env e.g. `piggy:rds-iam-token:HOST:PORT:USER`
+const PrefixRDSIAMToken = "rds-iam-token:"
+
+// PrefixSTS a reference to temporary credentials of a role generated by piggy-env e.g. `piggy:sts:ROLE_ARN`
+const PrefixSTS = "sts:"
+
+// PrefixSSM a reference to an SSM parameter, optionally of a version or label e.g. `piggy:ssm:/shared/api-key:3`
+const PrefixSSM = "ssm:"
+
+const (
+	// SSMParameterKeyBasename keys SSM parameters by the last segment of the name
+	SSMParameterKeyBasename = "basename"
+	// SSMParameterKeyPath keys SSM parameters by the path relative to the parameter path
+	SSMParameterKeyPath = "path"
+	// DefaultSSMParameterSeparator joins the path segments of SSM parameter keys
+	DefaultSSMParameterSeparator = "_"
+)
+
 const Namespace = "piggysec.com/"
-const AWSSecretName = "aws-secret-name"              // AWS secret name
-const AWSSSMParameterPath = "aws-ssm-parameter-path" // AWS SSM parameter path
+const AWSSecretName = "aws-secret-name"                        // AWS secret name
+const AWSSSMParameterPath = "aws-ssm-parameter-path"           // AWS SSM parameter path
+const AWSSSMParameterKey = "aws-ssm-parameter-key"             // `basename` or `path` of SSM parameters as secret keys
+const AWSSSMParameterSeparator = "aws-ssm-parameter-separator" // separator of the path segments of SSM parameter keys
+const AWSSSMSplitStringList = "aws-ssm-split-string-list"      // Default to false; Split StringList parameters of `ssm:` references into indexed env
+
 // AWSSecretVersion AWS secret version
 // #nosec G101 it is not a credential
 const AWSSecretVersion = "aws-secret-version"
+const GCPSecretName = "gcp-secret-name"       // Google secret ID or `projects/{project}/secrets/{secret}`
+const GCPSecretProject = "gcp-secret-project" // Google project of the secret
+// GCPSecretVersion Google secret version number or alias
+// #nosec G101 it is not a credential
+const GCPSecretVersion = "gcp-secret-version"
+const AzureKeyVaultName = "azure-key-vault-name" // Azure Key Vault name or URL. Each piggy:NAME reads the Key Vault secret NAME
+const K8sSecretName = "k8s-secret-name"          // Kubernetes Secret name in k8s-secret-namespace, read by piggy-webhooks only
+
+// ConfigAzureKeyVaultDNSSuffix Default to `.vault.azure.net`; The Key Vault DNS suffix of other Azure clouds e.g. `.vault.azure.cn`
+// use only in piggy-webhooks env
+const ConfigAzureKeyVaultDNSSuffix = "azure-key-vault-dns-suffix"
+
+// K8sSecretNamespace The locked-down namespace of Kubernetes Secrets read by piggy-webhooks
+// use only in piggy-webhooks env
+const K8sSecretNamespace = "k8s-secret-namespace"
+const SOPSConfigMap = "sops-configmap" // SOPS encrypted document in a ConfigMap `NAME` or `NAME/KEY` of the pod namespace, decrypted by piggy-webhooks only
+const SOPSFile = "sops-file"           // SOPS encrypted document file in sops-file-dir of piggy-webhooks, decrypted by piggy-webhooks only
+
+// ConfigSOPSFileDir The directory of SOPS encrypted document files mounted into piggy-webhooks
+// use only in piggy-webhooks env
+const ConfigSOPSFileDir = "sops-file-dir"
+
+// ConfigSOPSAgeKeyFile The age identities file decrypting SOPS documents. The private keys never leave piggy-webhooks
+// use only in piggy-webhooks env
+const ConfigSOPSAgeKeyFile = "sops-age-key-file"
+
+// ConfigGCPSecretCredentialsFile Google credentials file of piggy-env in standalone mode, or piggy-webhooks from env
+// #nosec G101 it is not a credential
+const ConfigGCPSecretCredentialsFile = "gcp-secret-credentials-file"
 const ConfigAWSRegion = "aws-region"                                                  // AWS secret's region
 const ConfigPiggyEnvImage = "piggy-env-image"                                         // The piggy-env image URL
 const ConfigPiggyEnvImagePullPolicy = "piggy-env-image-pull-policy"                   // The piggy-env image pull policy
@@ -35,7 +107,9 @@ const ConfigPiggyEnvResourceMemoryRequest = "piggy-env-resource-memory-request"
 const ConfigPiggyEnvResourceCPULimit = "piggy-env-resource-cpu-limit"                 // The piggy-env init-container cpu limit
 const ConfigPiggyEnvResourceMemoryLimit = "piggy-env-resource-memory-limit"           // The piggy-env init-container memory request
 const ConfigPiggyPSPAllowPrivilegeEscalation = "piggy-psp-allow-privilege-escalation" // Default to false; not allow init-container to run as root
-const ConfigPiggyAddress = "piggy-address"                                            // The endpoint of piggy-webhook
+const ConfigPiggyAddress = "piggy-address"                                            // The endpoints of piggy-webhook. A comma separated list of URLs or `srv://` DNS SRV names
+const ConfigPiggyAddressOrder = "piggy-address-order"                                 // Default to "ordered"; Try piggy-address endpoints `ordered` or `random`
+const ConfigPiggyAddressTimeout = "piggy-address-timeout"                             // Default to 10s; Timeout of a request to each piggy-address endpoint
 const ConfigPiggySkipVerifyTLS = "piggy-skip-verify-tls"                              // Default to true; Allow to skip verify TLS connection at piggy-address
 const ConfigPiggyUID = "piggy-uid"                                                    // A piggy uid
 const ConfigPiggyIgnoreNoEnv = "piggy-ignore-no-env"                                  // Default to false; Exit piggy-env if no environment variable found on secret manager
@@ -48,16 +122,55 @@ const ConfigImagePullSecret = "image-pull-secret"
 // ConfigImagePullSecretNamespace Container image pull secret namespace
 // #nosec G101 it is not a credential
 const ConfigImagePullSecretNamespace = "image-pull-secret-namespace"
-const ConfigImageSkipVerifyRegistry = "image-skip-verify-registry" // Default to true; not verify the registry
-const ConfigStandalone = "standalone"                              // Default to false; use piggy-webhook to read secrets instead of pod
-const ConfigPiggyDNSResolver = "piggy-dns-resolver"                // Default to ""; Set Golang DNS resolver such as `tcp`, `udp`. See https://pkg.go.dev/net
-const ConfigPiggyInitialDelay = "piggy-initial-delay"              // Default to 0; Delay n[ns|us|ms|s|m|h] before requesting secret from piggy-webhooks or secret-manager e.g. 1s (1 second)
-const ConfigPiggyNumberOfRetry = "piggy-number-of-retry"           // Default to 0; Set number of retry retrieving secrets before giving up
+const ConfigImageSkipVerifyRegistry = "image-skip-verify-registry"     // Default to true; not verify the registry
+const ConfigStandalone = "standalone"                                  // Default to false; use piggy-webhook to read secrets instead of pod
+const ConfigPiggyFailover = "piggy-failover"                           // Default to false; Read secrets in the other mode after all retries are failed
+const ConfigPiggyDNSResolver = "piggy-dns-resolver"                    // Default to ""; Set Golang DNS resolver such as `tcp`, `udp`. See https://pkg.go.dev/net
+const ConfigPiggyDNSServer = "piggy-dns-server"                        // Default to ""; Set DNS server address e.g. 10.0.0.10:53
+const ConfigPiggyIPFamily = "piggy-ip-family"                          // Default to ""; Connect to piggy-address with `ipv4`, `ipv6`, `prefer-ipv4` or `prefer-ipv6`
+const ConfigPiggyConnectTimeout = "piggy-connect-timeout"              // Default to 5s; Timeout of connecting to piggy-address
+const ConfigPiggyTLSHandshakeTimeout = "piggy-tls-handshake-timeout"   // Default to 5s; Timeout of TLS handshake with piggy-address
+const ConfigPiggyRequestTimeout = "piggy-request-timeout"              // Default to 30s; Timeout of requesting secrets from all piggy-address endpoints
+const ConfigPiggyHTTPProxy = "piggy-http-proxy"                        // Default to ""; HTTP proxy URL for requesting piggy-address
+const ConfigPiggyNoProxy = "piggy-no-proxy"                            // Default to ""; Comma separated hosts not using piggy-http-proxy
+const ConfigPiggyInitialDelay = "piggy-initial-delay"                  // Default to 0; Delay n[ns|us|ms|s|m|h] before requesting secret from piggy-webhooks or secret-manager e.g. 1s (1 second)
+const ConfigPiggyNumberOfRetry = "piggy-number-of-retry"               // Default to 0; Set number of retry retrieving secrets before giving up
+const ConfigPiggyRetryInitialInterval = "piggy-retry-initial-interval" // Default to 500ms; Wait before the first retry. The wait doubles on each retry with jitter
+const ConfigPiggyRetryMaxInterval = "piggy-retry-max-interval"         // Default to 10s; Longest wait between retries
+const ConfigPiggyRetryMaxElapsedTime = "piggy-retry-max-elapsed-time"  // Default to 0; Give up retrying after this duration. 0 retries until piggy-number-of-retry
 // ConfigPiggyEnforceServiceAccount Force to check `PIGGY_ALLOWED_SA` env value in AWS secret manager
 // use only when injecting secrets
 const ConfigPiggyEnforceServiceAccount = "piggy-enforce-service-account"
 const ConfigPiggyDefaultSecretNamePrefix = "piggy-default-secret-name-prefix" // Default to ""; Set default prefix string for secret name
 const ConfigPiggyDefaultSecretNameSuffix = "piggy-default-secret-name-suffix" // Default to ""; Set default suffix string for secret name
+const ConfigPiggyTokenExpiration = "piggy-token-expiration"                   // Default to 600; Expiration seconds of the projected service account token sent to piggy-webhooks
+// ConfigPiggyTokenAudience Audience of the projected service account token sent to piggy-webhooks
+// use only in piggy-webhooks env
+const ConfigPiggyTokenAudience = "piggy-token-audience"
+
+// ConfigPiggyEnforceBoundToken Reject requests with a service account token not bound to piggy audience
+// use only in piggy-webhooks env
+const ConfigPiggyEnforceBoundToken = "piggy-enforce-bound-token"
+
+// ConfigPiggyReplayProtection Default to ""; Reject replayed requests. `once` serves each piggy uid of a pod only once,
+// `pending` serves only on the first start of a container. use only in piggy-webhooks env
+const ConfigPiggyReplayProtection = "piggy-replay-protection"
+
+// ConfigPiggyEnforceHMACSignature Default to false; Reject piggy-uid entries which are not signed with the signing key
+// use only in piggy-webhooks env
+const ConfigPiggyEnforceHMACSignature = "piggy-enforce-hmac-signature"
+
+// ConfigPiggyAllowUnpinnedImage Default to false; Sign piggy-uid entries without an image digest when the digest cannot be resolved,
+// instead of rejecting the pod. use only in piggy-webhooks env
+const ConfigPiggyAllowUnpinnedImage = "piggy-allow-unpinned-image"
+
+// ConfigPiggyEnforceAccessPolicy Default to false; Deny secret requests not granted by a SecretAccessPolicy
+// use only in piggy-webhooks env
+const ConfigPiggyEnforceAccessPolicy = "piggy-enforce-access-policy"
+
+// ConfigPiggyTLSClientSecret A kubernetes.io/tls secret in pod namespace. piggy-env presents it as a client certificate to piggy-webhooks
+// #nosec G101 it is not a credential
+const ConfigPiggyTLSClientSecret = "piggy-tls-client-secret"
 
 type PiggyConfig struct {
 	PiggyImage                       string            `json:"piggyImage"`
@@ -68,46 +181,125 @@ type PiggyConfig struct {
 	PiggyResourceMemoryLimit         resource.Quantity `json:"piggyResourceMemoryLimit"`
 	PiggyPspAllowPrivilegeEscalation bool              `json:"piggyPspAllowPrivilegeEscalation"`
 	PiggyAddress                     string            `json:"piggyAddress"`
+	PiggyAddressOrder                string            `json:"piggyAddressOrder"`
+	PiggyAddressTimeout              string            `json:"piggyAddressTimeout"`
 	PiggySkipVerifyTLS               string            `json:"piggySkipVerifyTLS"`
 	PiggyUID                         string            `json:"piggyUID"`
 	PiggyIgnoreNoEnv                 bool              `json:"piggyIgnoreNoEnv"`
 	PiggyEnforceIntegrity            bool              `json:"piggyEnforceIntegrity"`
 	AWSSecretName                    string            `json:"awsSecretName"`
+	GCPSecretName                    string            `json:"gcpSecretName"`
+	GCPSecretProject                 string            `json:"gcpSecretProject"`
+	GCPSecretVersion                 string            `json:"gcpSecretVersion"`
+	GCPSecretCredentialsFile         string            `json:"gcpSecretCredentialsFile"`
+	AzureKeyVaultName                string            `json:"azureKeyVaultName"`
+	K8sSecretName                    string            `json:"k8sSecretName"`
+	K8sSecretNamespace               string            `json:"k8sSecretNamespace"`
+	SOPSConfigMap                    string            `json:"sopsConfigMap"`
+	SOPSFile                         string            `json:"sopsFile"`
+	SOPSFileDir                      string            `json:"sopsFileDir"`
+	SOPSAgeKeyFile                   string            `json:"sopsAgeKeyFile"`
 	AWSRegion                        string            `json:"awsRegion"`
 	AWSSSMParameterPath              string            `json:"awsSSMParameterPath"`
+	AWSSSMParameterKey               string            `json:"awsSSMParameterKey"`
+	AWSSSMParameterSeparator         string            `json:"awsSSMParameterSeparator"`
+	AWSSSMSplitStringList            bool              `json:"awsSSMSplitStringList"`
 	AWSSecretVersion                 string            `json:"awsSecretVersion"`
 	Debug                            bool              `json:"debug"`
 	ImagePullSecret                  string            `json:"imagePullSecret"`
 	ImagePullSecretNamespace         string            `json:"imagePullSecretNamespace"`
 	ImageSkipVerifyRegistry          bool              `json:"imageSkipVerifyRegistry"`
 	Standalone                       bool              `json:"standalone"`
+	PiggyFailover                    bool              `json:"piggyFailover"`
 	PiggyDNSResolver                 string            `json:"piggyDNSResolver"`
+	PiggyDNSServer                   string            `json:"piggyDNSServer"`
+	PiggyIPFamily                    string            `json:"piggyIPFamily"`
+	PiggyConnectTimeout              string            `json:"piggyConnectTimeout"`
+	PiggyTLSHandshakeTimeout         string            `json:"piggyTLSHandshakeTimeout"`
+	PiggyRequestTimeout              string            `json:"piggyRequestTimeout"`
+	PiggyHTTPProxy                   string            `json:"piggyHTTPProxy"`
+	PiggyNoProxy                     string            `json:"piggyNoProxy"`
 	PiggyInitialDelay                string            `json:"piggyInitialDelay"`
 	PiggyNumberOfRetry               int               `json:"piggyNumberOfRetry"`
+	PiggyRetryInitialInterval        string            `json:"piggyRetryInitialInterval"`
+	PiggyRetryMaxInterval            string            `json:"piggyRetryMaxInterval"`
+	PiggyRetryMaxElapsedTime         string            `json:"piggyRetryMaxElapsedTime"`
 	// use only when injecting secrets
 	PiggyEnforceServiceAccount   bool   `json:"piggyEnforceServiceAccount"`
 	PiggyDefaultSecretNamePrefix string `json:"piggyDefaultSecretNamePrefix"`
 	PiggyDefaultSecretNameSuffix string `json:"piggyDefaultSecretNameSuffix"`
+	PiggyTLSClientSecret         string `json:"piggyTLSClientSecret"`
+	PiggyCABundle                string `json:"piggyCABundle"`
+	PiggyTokenAudience           string `json:"piggyTokenAudience"`
+	PiggyTokenExpiration         int    `json:"piggyTokenExpiration"`
 	//
 	PodServiceAccountName string
+	ServiceAccountLabels  func() labels.Set
+	AccessPolicy          *PolicyDecision
+	ContainerKeys         map[string]bool // secret keys referenced by the requesting container, nil allows all keys
 }
 
 type Service struct {
-	context    context.Context
-	k8sClient  kubernetes.Interface
-	awsFactory AWSClientFactory
+	context      context.Context
+	k8sClient    kubernetes.Interface
+	awsFactory   AWSClientFactory
+	gcpFactory   GCPClientFactory
+	azureFactory AzureClientFactory
+	replayCache  *ReplayCache
+	policies     PolicyLister
+	signer       *Signer
+	// token buckets of secret requests, nil when not limited
+	namespaceLimiter      *RateLimiter
+	serviceAccountLimiter *RateLimiter
+	remoteLimiter         *RateLimiter
 }
 
 // NewService new service
 func NewService(ctx context.Context, k8sClient kubernetes.Interface) *Service {
+	replayCacheTTL, err := time.ParseDuration(GetEnv("PIGGY_REPLAY_CACHE_TTL", "24h"))
+	if err != nil {
+		replayCacheTTL = 24 * time.Hour
+	}
 	svc := &Service{
-		context:    ctx,
-		k8sClient:  k8sClient,
-		awsFactory: &DefaultAWSClientFactory{},
+		context:               ctx,
+		k8sClient:             k8sClient,
+		awsFactory:            &DefaultAWSClientFactory{},
+		gcpFactory:            &DefaultGCPClientFactory{},
+		azureFactory:          &DefaultAzureClientFactory{},
+		replayCache:           NewReplayCache(replayCacheTTL),
+		namespaceLimiter:      NewRateLimiter(GetEnvFloat("PIGGY_RATE_LIMIT_NAMESPACE_QPS", 0), GetEnvInt("PIGGY_RATE_LIMIT_NAMESPACE_BURST", 0)),
+		serviceAccountLimiter: NewRateLimiter(GetEnvFloat("PIGGY_RATE_LIMIT_SERVICE_ACCOUNT_QPS", 0), GetEnvInt("PIGGY_RATE_LIMIT_SERVICE_ACCOUNT_BURST", 0)),
+		remoteLimiter:         NewRateLimiter(GetEnvFloat("PIGGY_RATE_LIMIT_REMOTE_IP_QPS", 0), GetEnvInt("PIGGY_RATE_LIMIT_REMOTE_IP_BURST", 0)),
 	}
 	return svc
 }
 
+// SetSigner verify HMAC signed piggy-uid entries with the signer
+func (s *Service) SetSigner(signer *Signer) {
+	s.signer = signer
+}
+
+// SetPolicyLister evaluate SecretAccessPolicy objects from the lister on secret requests
+func (s *Service) SetPolicyLister(policies PolicyLister) {
+	s.policies = policies
+}
+
+// ReferenceKeys returns the secret keys referenced by an env value, either a whole `piggy:KEY` value
+// or `${piggy:KEY}` references embedded in the value e.g. `postgres://app:${piggy:DB_PASS}@db:5432/app`.
+// An escaped `$${piggy:KEY}` is not a reference
+func ReferenceKeys(value string) []string {
+	if key, ok := strings.CutPrefix(value, PrefixPiggy); ok {
+		return []string{key}
+	}
+	var keys []string
+	for _, match := range embeddedRegx.FindAllStringSubmatch(value, -1) {
+		if !strings.HasPrefix(match[0], "$$") {
+			keys = append(keys, match[1])
+		}
+	}
+	return keys
+}
+
 // GetEnv get environment value or return default value if not found
 func GetEnv(name string, defaultValue string) string {
 	val := os.Getenv(name)
@@ -140,6 +332,19 @@ func GetEnvInt(name string, defaultValue int) int {
 	return int(b)
 }
 
+// GetEnvFloat get environment value as float or return default value if not found
+func GetEnvFloat(name string, defaultValue float64) float64 {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return f
+}
+
 // GetStringValue get a string value from annotation map
 func GetStringValue(annotations map[string]string, name string, defaultValue string) string {
 	if val, ok := annotations[Namespace+name]; ok {
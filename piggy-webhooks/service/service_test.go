@@ -7,6 +7,15 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// TestReferenceKeys checks the secret keys referenced by whole and embedded references.
+func TestReferenceKeys(t *testing.T) {
+	assert.Equal(t, []string{"DB_PASS"}, ReferenceKeys("piggy:DB_PASS"))
+	assert.Equal(t, []string{"DB_USER", "DB_PASS"}, ReferenceKeys("postgres://${piggy:DB_USER}:${piggy:DB_PASS}@db:5432/app"))
+	assert.Equal(t, []string{"ssm:/shared/api-key:3"}, ReferenceKeys("Bearer ${piggy:ssm:/shared/api-key:3}"))
+	assert.Empty(t, ReferenceKeys("literal $${piggy:DB_PASS}"))
+	assert.Empty(t, ReferenceKeys("${piggy:} ${DB_PASS} plain"))
+}
+
 // TestGetEnv checks the retrieval of environment variables with defaults.
 func TestGetEnv(t *testing.T) {
 	_ = os.Setenv("TEST_KEY", "test_value")
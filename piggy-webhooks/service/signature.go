@@ -0,0 +1,81 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+)
+
+// SignatureVersionHMAC signs the container name, image digest, command and references with a key held by piggy-webhooks
+const SignatureVersionHMAC = 2
+
+// SignatureEntry the piggy-uid data of a container
+type SignatureEntry struct {
+	Version   int      `json:"version,omitempty"` // empty for a plain SHA-256 of the command
+	Signature string   `json:"signature"`
+	Container string   `json:"container,omitempty"`
+	Image     string   `json:"image,omitempty"` // image digest resolved when the pod was mutated
+	Keys      []string `json:"keys,omitempty"`  // secret keys referenced by the container. Empty allows all keys
+}
+
+// UnmarshalJSON accepts a plain signature string written by older versions
+func (e *SignatureEntry) UnmarshalJSON(data []byte) error {
+	var sig string
+	if err := json.Unmarshal(data, &sig); err == nil {
+		*e = SignatureEntry{Signature: sig}
+		return nil
+	}
+	type entry SignatureEntry
+	return json.Unmarshal(data, (*entry)(e))
+}
+
+// Signature piggy-uid data of containers by uid
+type Signature map[string]SignatureEntry
+
+// Signer signs and verifies piggy-uid entries with an HMAC key
+type Signer struct {
+	key []byte
+}
+
+// NewSigner create a signer. The key must be at least 32 bytes
+func NewSigner(key []byte) (*Signer, error) {
+	if len(key) < 32 {
+		return nil, errors.New("signing key must be at least 32 bytes")
+	}
+	return &Signer{key: key}, nil
+}
+
+// mac returns HMAC-SHA256 of the entry with the command hash. An empty command hash is used when integrity is not enforced
+func (s *Signer) mac(entry SignatureEntry, command string, keys []string) []byte {
+	if keys == nil {
+		keys = []string{}
+	}
+	// JSON keeps the fields unambiguous
+	data, _ := json.Marshal([]interface{}{SignatureVersionHMAC, entry.Container, entry.Image, command, keys})
+	h := hmac.New(sha256.New, s.key)
+	_, _ = h.Write(data)
+	return h.Sum(nil)
+}
+
+// Sign sets version and signature of the entry
+func (s *Signer) Sign(entry SignatureEntry, command string) SignatureEntry {
+	entry.Version = SignatureVersionHMAC
+	entry.Signature = hex.EncodeToString(s.mac(entry, command, entry.Keys))
+	return entry
+}
+
+// Verify returns true if the entry was signed for the command hash and the references sent by piggy-env.
+// The keys of the entry must be the signed references, since they select the secret keys returned to the container
+func (s *Signer) Verify(entry SignatureEntry, command string, references []string) bool {
+	if !slices.Equal(entry.Keys, references) {
+		return false
+	}
+	sig, err := hex.DecodeString(entry.Signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, s.mac(entry, command, references))
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSigner(t *testing.T) {
+	_, err := NewSigner([]byte("short"))
+	assert.Error(t, err)
+	_, err = NewSigner(make([]byte, 32))
+	assert.NoError(t, err)
+}
+
+func TestSigner_Verify(t *testing.T) {
+	signer, _ := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	entry := signer.Sign(SignatureEntry{
+		Container: "app",
+		Image:     "sha256:abc",
+		Keys:      []string{"API_KEY", "DB_PASS"},
+	}, "command-hash")
+	assert.Equal(t, SignatureVersionHMAC, entry.Version)
+	assert.True(t, signer.Verify(entry, "command-hash", []string{"API_KEY", "DB_PASS"}))
+
+	// Case 1: Different command
+	assert.False(t, signer.Verify(entry, "other-hash", []string{"API_KEY", "DB_PASS"}))
+	// Case 2: Different references
+	assert.False(t, signer.Verify(entry, "command-hash", []string{"API_KEY"}))
+	// Case 3: Tampered entry
+	tampered := entry
+	tampered.Image = "sha256:def"
+	assert.False(t, signer.Verify(tampered, "command-hash", []string{"API_KEY", "DB_PASS"}))
+	tampered = entry
+	tampered.Container = "sidecar"
+	assert.False(t, signer.Verify(tampered, "command-hash", []string{"API_KEY", "DB_PASS"}))
+	// Case 4: Different key
+	other, _ := NewSigner([]byte("fedcba9876543210fedcba9876543210"))
+	assert.False(t, other.Verify(entry, "command-hash", []string{"API_KEY", "DB_PASS"}))
+	// Case 5: Widened keys with references matching the signature
+	tampered = entry
+	tampered.Keys = []string{"API_KEY", "DB_PASS", "OTHER"}
+	assert.False(t, signer.Verify(tampered, "command-hash", []string{"API_KEY", "DB_PASS"}))
+	// Case 6: Invalid signature encoding
+	tampered = entry
+	tampered.Signature = "not-hex"
+	assert.False(t, signer.Verify(tampered, "command-hash", []string{"API_KEY", "DB_PASS"}))
+}
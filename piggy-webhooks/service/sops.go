@@ -0,0 +1,457 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const sopsMetadataKey = "sops"
+const sopsDefaultUnencryptedSuffix = "_unencrypted"
+
+// sopsMACOnlyEncryptedInitialization initializes the MAC of documents with mac_only_encrypted, the same as SOPS
+var sopsMACOnlyEncryptedInitialization = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+var sopsValueRegx = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.+),iv:(.+),tag:(.+),type:(.+)\]`)
+
+// sopsComment a decrypted comment, which is not a secret value
+type sopsComment string
+
+// sopsMetadata the `sops` metadata of an encrypted document
+type sopsMetadata struct {
+	KMS []struct {
+		ARN     string            `yaml:"arn"`
+		Context map[string]string `yaml:"context"`
+		Enc     string            `yaml:"enc"`
+	} `yaml:"kms"`
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	KeyGroups               []yaml.Node `yaml:"key_groups"`
+	LastModified            string      `yaml:"lastmodified"`
+	MAC                     string      `yaml:"mac"`
+	UnencryptedSuffix       string      `yaml:"unencrypted_suffix"`
+	EncryptedSuffix         string      `yaml:"encrypted_suffix"`
+	UnencryptedRegex        string      `yaml:"unencrypted_regex"`
+	EncryptedRegex          string      `yaml:"encrypted_regex"`
+	UnencryptedCommentRegex string      `yaml:"unencrypted_comment_regex"`
+	EncryptedCommentRegex   string      `yaml:"encrypted_comment_regex"`
+	MACOnlyEncrypted        bool        `yaml:"mac_only_encrypted"`
+}
+
+// sopsDecrypter decrypts the values of a SOPS document and computes its MAC
+type sopsDecrypter struct {
+	metadata         *sopsMetadata
+	key              []byte
+	hash             hash.Hash
+	unencryptedRegex *regexp.Regexp
+	encryptedRegex   *regexp.Regexp
+}
+
+func newSOPSDecrypter(metadata *sopsMetadata, key []byte) (*sopsDecrypter, error) {
+	if metadata.UnencryptedCommentRegex != "" || metadata.EncryptedCommentRegex != "" {
+		return nil, errors.New("sops comment encryption rules are not supported")
+	}
+	d := &sopsDecrypter{metadata: metadata, key: key, hash: sha512.New()}
+	if metadata.UnencryptedSuffix == "" && metadata.EncryptedSuffix == "" && metadata.UnencryptedRegex == "" && metadata.EncryptedRegex == "" {
+		metadata.UnencryptedSuffix = sopsDefaultUnencryptedSuffix
+	}
+	var err error
+	if metadata.UnencryptedRegex != "" {
+		if d.unencryptedRegex, err = regexp.Compile(metadata.UnencryptedRegex); err != nil {
+			return nil, err
+		}
+	}
+	if metadata.EncryptedRegex != "" {
+		if d.encryptedRegex, err = regexp.Compile(metadata.EncryptedRegex); err != nil {
+			return nil, err
+		}
+	}
+	if metadata.MACOnlyEncrypted {
+		d.hash.Write(sopsMACOnlyEncryptedInitialization)
+	}
+	return d, nil
+}
+
+// shouldBeEncrypted applies the encryption rules of the document to the path of a value, the same as SOPS
+func (d *sopsDecrypter) shouldBeEncrypted(path []string) bool {
+	encrypted := true
+	if d.metadata.UnencryptedSuffix != "" {
+		for _, p := range path {
+			if strings.HasSuffix(p, d.metadata.UnencryptedSuffix) {
+				encrypted = false
+				break
+			}
+		}
+	}
+	if d.metadata.EncryptedSuffix != "" {
+		encrypted = false
+		for _, p := range path {
+			if strings.HasSuffix(p, d.metadata.EncryptedSuffix) {
+				encrypted = true
+				break
+			}
+		}
+	}
+	if d.unencryptedRegex != nil {
+		for _, p := range path {
+			if d.unencryptedRegex.MatchString(p) {
+				encrypted = false
+				break
+			}
+		}
+	}
+	if d.encryptedRegex != nil {
+		encrypted = false
+		for _, p := range path {
+			if d.encryptedRegex.MatchString(p) {
+				encrypted = true
+				break
+			}
+		}
+	}
+	return encrypted
+}
+
+// decrypt decrypts a SOPS encrypted value e.g. `ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]`
+// authenticated with the additional data
+func (d *sopsDecrypter) decrypt(value string, additionalData string) (interface{}, error) {
+	if value == "" {
+		return "", nil
+	}
+	match := sopsValueRegx.FindStringSubmatch(value)
+	if match == nil {
+		return nil, errors.New("not a sops encrypted value")
+	}
+	var parts [3][]byte
+	for i := range parts {
+		b, err := base64.StdEncoding.DecodeString(match[i+1])
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = b
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+	block, err := aes.NewCipher(d.key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+	switch match[4] {
+	case "str":
+		return string(plaintext), nil
+	case "int":
+		return strconv.Atoi(string(plaintext))
+	case "float":
+		return strconv.ParseFloat(string(plaintext), 64)
+	case "bool":
+		return strconv.ParseBool(string(plaintext))
+	case "bytes":
+		return plaintext, nil
+	case "time":
+		var t time.Time
+		err := t.UnmarshalText(plaintext)
+		return t, err
+	case "comment":
+		return sopsComment(plaintext), nil
+	}
+	return nil, fmt.Errorf("unknown sops value type %s", match[4])
+}
+
+// sopsBytes returns the bytes of a value added to the MAC, the same as SOPS
+func sopsBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case int:
+		return []byte(strconv.Itoa(v)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case bool:
+		if v {
+			return []byte("True"), nil
+		}
+		return []byte("False"), nil
+	case []byte:
+		return v, nil
+	case time.Time:
+		return v.MarshalText()
+	}
+	return nil, fmt.Errorf("unsupported sops value type %T", value)
+}
+
+// decryptNode decrypts the values of a node in document order. Returns the value of a scalar node
+func (d *sopsDecrypter) decryptNode(node *yaml.Node, path []string) (interface{}, error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if _, err := d.decryptNode(node.Content[i+1], append(path[:len(path):len(path)], node.Content[i].Value)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if _, err := d.decryptNode(item, path); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case yaml.AliasNode:
+		return d.decryptNode(node.Alias, path)
+	case yaml.ScalarNode:
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, nil
+		}
+		encrypted := d.shouldBeEncrypted(path)
+		if encrypted {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s is not encrypted", strings.Join(path, ":"))
+			}
+			var err error
+			if value, err = d.decrypt(s, strings.Join(path, ":")+":"); err != nil {
+				return nil, fmt.Errorf("could not decrypt %s: %v", strings.Join(path, ":"), err)
+			}
+		}
+		if _, ok := value.(sopsComment); !ok && (!d.metadata.MACOnlyEncrypted || encrypted) {
+			b, err := sopsBytes(value)
+			if err != nil {
+				return nil, err
+			}
+			d.hash.Write(b)
+		}
+		return value, nil
+	}
+	return nil, nil
+}
+
+// verifyMAC compares the MAC of the decrypted values with the MAC of the document
+func (d *sopsDecrypter) verifyMAC() error {
+	lastModified, err := time.Parse(time.RFC3339, d.metadata.LastModified)
+	if err != nil {
+		return fmt.Errorf("invalid sops lastmodified: %v", err)
+	}
+	if d.metadata.MAC == "" {
+		return errors.New("sops mac not found")
+	}
+	mac, err := d.decrypt(d.metadata.MAC, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("invalid sops mac: %v", err)
+	}
+	if mac != fmt.Sprintf("%X", d.hash.Sum(nil)) {
+		return errors.New("sops mac mismatch, the document has been modified")
+	}
+	return nil
+}
+
+// sopsString returns a decrypted value as an environment variable value
+func sopsString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+// parseSOPSDocument parses a SOPS encrypted YAML or JSON document. Returns the document root and its metadata
+func parseSOPSDocument(document []byte) (*yaml.Node, *sopsMetadata, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(document, &doc); err != nil {
+		return nil, nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, errors.New("sops document is not a YAML or JSON object")
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == sopsMetadataKey {
+			metadata := &sopsMetadata{}
+			if err := root.Content[i+1].Decode(metadata); err != nil {
+				return nil, nil, err
+			}
+			root.Content = append(root.Content[:i:i], root.Content[i+2:]...)
+			return root, metadata, nil
+		}
+	}
+	return nil, nil, errors.New("sops metadata not found, the document is not encrypted")
+}
+
+// sopsDataKey decrypts the data key of a SOPS document with the age identities or AWS KMS identity of piggy-webhooks
+func (s *Service) sopsDataKey(config *PiggyConfig, metadata *sopsMetadata) ([]byte, error) {
+	if len(metadata.KeyGroups) > 0 {
+		return nil, errors.New("sops key groups are not supported")
+	}
+	var errs []error
+	if len(metadata.Age) > 0 && config.SOPSAgeKeyFile != "" {
+		f, err := os.Open(filepath.Clean(config.SOPSAgeKeyFile))
+		if err != nil {
+			return nil, err
+		}
+		identities, err := age.ParseIdentities(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range metadata.Age {
+			r, err := age.Decrypt(armor.NewReader(strings.NewReader(key.Enc)), identities...)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("age %s: %v", key.Recipient, err))
+				continue
+			}
+			return io.ReadAll(r)
+		}
+	}
+	for _, key := range metadata.KMS {
+		dataKey, err := s.sopsKMSDataKey(key.ARN, key.Enc, key.Context)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("kms %s: %v", key.ARN, err))
+			continue
+		}
+		return dataKey, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no sops key of piggy-webhooks can decrypt the document")
+	}
+	return nil, fmt.Errorf("unable to decrypt sops data key: %w", errors.Join(errs...))
+}
+
+func (s *Service) sopsKMSDataKey(keyARN string, enc string, context map[string]string) ([]byte, error) {
+	parsed, err := arn.Parse(keyARN)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.awsFactory.GetKMSClient(s.context, parsed.Region)
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.Decrypt(s.context, &kms.DecryptInput{
+		KeyId:             aws.String(keyARN),
+		CiphertextBlob:    blob,
+		EncryptionContext: context,
+	})
+	if awsErr(err) {
+		return nil, err
+	}
+	return output.Plaintext, nil
+}
+
+// decryptSOPS decrypts a SOPS document and verifies its MAC. Returns the top-level values of the document
+func (s *Service) decryptSOPS(config *PiggyConfig, document []byte) (map[string]string, error) {
+	root, metadata, err := parseSOPSDocument(document)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := s.sopsDataKey(config, metadata)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newSOPSDecrypter(metadata, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]string)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name := root.Content[i].Value
+		value, err := d.decryptNode(root.Content[i+1], []string{name})
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			log.Debug().Msgf("Skip [%s], not a scalar value", name)
+			continue
+		}
+		secrets[name] = sopsString(value)
+	}
+	if err := d.verifyMAC(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// readSOPSDocument reads a SOPS document from a ConfigMap in the pod namespace, or a file mounted into piggy-webhooks
+func (s *Service) readSOPSDocument(config *PiggyConfig, namespace string) ([]byte, error) {
+	if config.SOPSConfigMap != "" {
+		name, key, _ := strings.Cut(config.SOPSConfigMap, "/")
+		configMap, err := s.k8sClient.CoreV1().ConfigMaps(namespace).Get(s.context, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if key == "" && len(configMap.Data) == 1 {
+			for k := range configMap.Data {
+				key = k
+			}
+		}
+		document, ok := configMap.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: key [%s] not found in configmap %s/%s", ErrorNotFound, key, namespace, name)
+		}
+		return []byte(document), nil
+	}
+	if config.SOPSFileDir == "" {
+		return nil, errors.New("sops file requires SOPS_FILE_DIR env of piggy-webhooks")
+	}
+	if !filepath.IsLocal(config.SOPSFile) {
+		return nil, fmt.Errorf("sops file %s is not in SOPS_FILE_DIR", config.SOPSFile)
+	}
+	document, err := os.ReadFile(filepath.Join(config.SOPSFileDir, config.SOPSFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: sops file %s", ErrorNotFound, config.SOPSFile)
+	}
+	return document, err
+}
+
+// injectSOPSSecret decrypts a SOPS document on behalf of the pod. The age and KMS keys never leave piggy-webhooks
+func (s *Service) injectSOPSSecret(config *PiggyConfig, namespace string, env *SanitizedEnv) error {
+	document, err := s.readSOPSDocument(config, namespace)
+	if err != nil {
+		return err
+	}
+	secrets, err := s.decryptSOPS(config, document)
+	if err != nil {
+		return err
+	}
+	return processSecret(config, secrets, env)
+}
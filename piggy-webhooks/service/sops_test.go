@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testSOPSAgeKey an age identity generated for the tests only
+const testSOPSAgeKey = `# created: 2026-10-19T06:05:22Z
+# public key: age1myxvzltuxpdlnjnxzvqzwewnk49maunheu0kszc9ke24mv8txcfqwragph
+AGE-SECRET-KEY-1MNTRL8V8YFK3YJH9XWJETN5PXF3624XV3039GHHEQFZC9N7M7QAQVRPDC7
+`
+
+// testSOPSYAML encrypted by `sops encrypt --age` from
+//
+//	# database settings
+//	DB_PASS: s3cr3t
+//	PORT: 5432
+//	RATIO: 1.5
+//	ENABLED: true
+//	EMPTY: ""
+//	NOTE_unencrypted: plain text
+//	nested:
+//	  user: admin
+//	  hosts: [a, b]
+const testSOPSYAML = `#ENC[AES256_GCM,data:IzkCCQkBJoiQRpQIsMO/4z10,iv:Z9He1LFHsbKr631gHPWks5GgHJ1z6GpKaVf6uDBezUM=,tag:elfIggdQ8U3cMxYb5LoROA==,type:comment]
+DB_PASS: ENC[AES256_GCM,data:X9BZBfYe,iv:e9j1vhd5Er/ocHJmqRZe23g233Mdc/XBP3WAmfg7It8=,tag:OGYPtsABDhjvaJgURuu3dg==,type:str]
+PORT: ENC[AES256_GCM,data:ZbRgDg==,iv:A/3xnozXRUGA5Z/cKnV7nc2z9xuoxtAxXA1ybsBYlYc=,tag:n8dIro64OF6p2nGdeRRDEA==,type:int]
+RATIO: ENC[AES256_GCM,data:fr/N,iv:ebFgs8t/iynUBJ8ctLCCCOQ1IBxg3V2U4VEQ0SF2A0g=,tag:3qmY0Jr8DXSiIMMdGFPL9g==,type:float]
+ENABLED: ENC[AES256_GCM,data:/i0Pog==,iv:KCAN1o3wtelwNWlUm9JwL+h2kEiu2yEqwpSjBPXSdM0=,tag:466WfADoiq1PE1uFnQeP2g==,type:bool]
+EMPTY: ""
+NOTE_unencrypted: plain text
+nested:
+    user: ENC[AES256_GCM,data:LHKGGbo=,iv:/QjNJf1akqCuzNXTR972eqSxyr7y20jJ/7jrQAIOVoY=,tag:EPNVF/ALK8cDCGOFj3pg4Q==,type:str]
+    hosts:
+        - ENC[AES256_GCM,data:rg==,iv:N1RRo9Mi5gpePVRxahVc6dQUe26ZIplzEl4hQrCTgd8=,tag:Pzy/4bBVr9KfKVBq92SIhw==,type:str]
+        - ENC[AES256_GCM,data:6Q==,iv:VEJ55sEr4PT1vvwk+H75uAtwE65OeHkI96V5UTCzzec=,tag:Tfb0mWHUh62CHDg7PnmpuA==,type:str]
+sops:
+    age:
+        - enc: |
+            -----BEGIN AGE ENCRYPTED FILE-----
+            YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBtVXA3TVdLdThyN1MvVVMr
+            YUFuMlBBSkJQTG9xMmFRemJOelpqQVZtczMwCmpZWG44ZVRSTlVZYXVJRGE4SDVY
+            cTFvN0JHYkFINEhTT21mdWFQODlrQjAKLS0tIFlWc3AzRHZxVVl5N2RLODNzK3d6
+            WlBBWTU0dEpBNEoyWjh3a05lWWZsT1kKH0yaX+zP/h+RE9TVinSqPk4jjTTQ8jh/
+            WrW0evl6p3JKIy+efKlqjP2apyXxKEbeAqMOFeuFV6JgsbMevugFjQ==
+            -----END AGE ENCRYPTED FILE-----
+          recipient: age1myxvzltuxpdlnjnxzvqzwewnk49maunheu0kszc9ke24mv8txcfqwragph
+    lastmodified: "2026-10-19T06:05:22Z"
+    mac: ENC[AES256_GCM,data:x3i6MkmgzPIDSoJnJU8xecmt/w9FU1RkpvOrPbOZwKpxVOpKAixgl9qoXnQmoZ4vGXTOlq+y4I7OJGnz87LmkruQjyPJiEKd9Cq5q22t4ndJnQm/UPCR4RKW+J3FVZP6LfTETtWQEGN6byJs61HaXpZHbNa7gnUxzvp9KFGf08I=,iv:FMrH5SCVh1vCq2hRoBOuzFWCh+3rg3Vfs101L3JJUJs=,tag:zU8DSl6Ys5kQu1jNO62aWA==,type:str]
+    unencrypted_suffix: _unencrypted
+    version: 3.13.3
+`
+
+// testSOPSJSON encrypted by `sops encrypt --age` from {"DB_PASS": "s3cr3t", "PORT": 5432, "ENABLED": false}
+const testSOPSJSON = `{
+	"DB_PASS": "ENC[AES256_GCM,data:r73J8GnA,iv:rDFZ7eR2GQP1aJYVkfinFSn6kNdg3cZgBPR9zblN+60=,tag:I/smjTuqH6T0C/yCBPcB0A==,type:str]",
+	"PORT": "ENC[AES256_GCM,data:DaGZVg==,iv:QCKU3VRV6Q/PF0phjR0v9h+zTkDT/DWNJ9MTKXW5uP8=,tag:jxfCvbHQFLA91gblZhjsWw==,type:int]",
+	"ENABLED": "ENC[AES256_GCM,data:yd53MYI=,iv:0F6+lnmeGEK7OJFVqJD9h/UWvjfc1AIPWz4pkSwyXb8=,tag:8XvXud2tusfZsKhgOnFyJQ==,type:bool]",
+	"sops": {
+		"age": [
+			{
+				"enc": "-----BEGIN AGE ENCRYPTED FILE-----\nYWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSB2YW9iOUptSmFtVWNGQzJU\nREYzVnVObUZLSkFFempOS04xNVltUGNCVFZvCkFJMXZWcHFJL0ZyYnRyY0pBcTNs\nVmlwRk5YVnhQVG1vcFF3MzFwRmFSamMKLS0tIGhwbUNmeVV0MmVYSVE2THVpOWdB\nSVgyTGcvOThGTGllbCs0OVZlbVAxS0kKaPt0QaBW8D8l1ZVmIUWsDwUtCGj8RHXn\nw+MCeturXnT9GEuGhA+1REeoscAFDHpIt1wCobySIKqsMkkOsoIGIQ==\n-----END AGE ENCRYPTED FILE-----\n",
+				"recipient": "age1myxvzltuxpdlnjnxzvqzwewnk49maunheu0kszc9ke24mv8txcfqwragph"
+			}
+		],
+		"lastmodified": "2026-10-19T06:05:22Z",
+		"mac": "ENC[AES256_GCM,data:7nplBYWefTOzDaHzdQTj5lqv7xZdlwG8of02XC2kexwXky4C8g1FlPqlk3NLia8YkZrIT7klEWMNs7LcwLkljxknSm4RDQVNr7NgsqrrnIigNrdZjC9vgkC1p1RT+oqtl+BzQWGXjILTBJEModqdtV/d/fxQqZJEGVmxhvnq5Mg=,iv:E39YirqETIUUN6ml0bBEaFTHDSI9lanqShv1orLHbRE=,tag:wpKLWyfJL0EvAhetEQesAQ==,type:str]",
+		"unencrypted_suffix": "_unencrypted",
+		"version": "3.13.3"
+	}
+}
+`
+
+// writeSOPSAgeKey writes the test age identity into a temp file
+func writeSOPSAgeKey(t *testing.T) string {
+	keyFile := filepath.Join(t.TempDir(), "keys.txt")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(testSOPSAgeKey), 0600))
+	return keyFile
+}
+
+func TestDecryptSOPS(t *testing.T) {
+	_, _, svc := setupTest()
+	config := &PiggyConfig{SOPSAgeKeyFile: writeSOPSAgeKey(t)}
+
+	// Case 1: YAML document, nested values are skipped
+	secrets, err := svc.decryptSOPS(config, []byte(testSOPSYAML))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"DB_PASS":          "s3cr3t",
+		"PORT":             "5432",
+		"RATIO":            "1.5",
+		"ENABLED":          "true",
+		"EMPTY":            "",
+		"NOTE_unencrypted": "plain text",
+	}, secrets)
+
+	// Case 2: JSON document
+	secrets, err = svc.decryptSOPS(config, []byte(testSOPSJSON))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"DB_PASS": "s3cr3t", "PORT": "5432", "ENABLED": "false"}, secrets)
+
+	// Case 3: Tampered unencrypted value
+	tampered := strings.Replace(testSOPSYAML, "NOTE_unencrypted: plain text", "NOTE_unencrypted: changed", 1)
+	_, err = svc.decryptSOPS(config, []byte(tampered))
+	assert.ErrorContains(t, err, "mac mismatch")
+
+	// Case 4: Encrypted value moved to another key
+	lines := strings.Split(testSOPSYAML, "\n")
+	dbPass := strings.TrimPrefix(lines[1], "DB_PASS: ")
+	tampered = strings.Replace(testSOPSYAML, lines[2], "PORT: "+dbPass, 1)
+	_, err = svc.decryptSOPS(config, []byte(tampered))
+	assert.Error(t, err)
+
+	// Case 5: Value should be encrypted
+	tampered = strings.Replace(testSOPSYAML, "EMPTY: \"\"", "EMPTY: plain", 1)
+	_, err = svc.decryptSOPS(config, []byte(tampered))
+	assert.Error(t, err)
+
+	// Case 6: No key can decrypt the document
+	_, err = svc.decryptSOPS(&PiggyConfig{}, []byte(testSOPSYAML))
+	assert.Error(t, err)
+
+	// Case 7: Not a SOPS document
+	_, err = svc.decryptSOPS(config, []byte("DB_PASS: s3cr3t\n"))
+	assert.ErrorContains(t, err, "not encrypted")
+}
+
+func TestDecryptSOPS_KMS(t *testing.T) {
+	_, _, svc := setupTest()
+	_, metadata, err := parseSOPSDocument([]byte(testSOPSYAML))
+	assert.NoError(t, err)
+	dataKey, err := svc.sopsDataKey(&PiggyConfig{SOPSAgeKeyFile: writeSOPSAgeKey(t)}, metadata)
+	assert.NoError(t, err)
+
+	// replace the age recipient with a KMS key wrapping the same data key
+	keyARN := "arn:aws:kms:eu-west-1:123456789012:key/test-key"
+	start := strings.Index(testSOPSYAML, "    age:\n")
+	end := strings.Index(testSOPSYAML, "    lastmodified:")
+	document := testSOPSYAML[:start] + `    kms:
+        - arn: ` + keyARN + `
+          enc: ` + base64.StdEncoding.EncodeToString([]byte("wrapped-key")) + `
+          aws_profile: ""
+          context:
+            app: myapp
+` + testSOPSYAML[end:]
+	var region string
+	svc.awsFactory = &MockAWSClientFactory{
+		GetKMSClientFunc: func(ctx context.Context, r string) (KMSClient, error) {
+			region = r
+			return &MockKMSClient{
+				DecryptFunc: func(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+					assert.Equal(t, keyARN, *params.KeyId)
+					assert.Equal(t, []byte("wrapped-key"), params.CiphertextBlob)
+					assert.Equal(t, map[string]string{"app": "myapp"}, params.EncryptionContext)
+					return &kms.DecryptOutput{Plaintext: dataKey}, nil
+				},
+			}, nil
+		},
+	}
+	secrets, err := svc.decryptSOPS(&PiggyConfig{}, []byte(document))
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1", region)
+	assert.Equal(t, "s3cr3t", secrets["DB_PASS"])
+}
+
+func TestGetSecret_SOPS(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`,
+		Namespace + SOPSConfigMap:  "myapp-secrets",
+	})
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-secrets", Namespace: ns},
+		Data:       map[string]string{"secrets.enc.yaml": testSOPSYAML},
+	}
+	other := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-secrets", Namespace: "other"},
+		Data:       map[string]string{"secrets.enc.json": testSOPSJSON},
+	}
+	_, client, svc := setupTest(pod, configMap, other)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	t.Setenv("SOPS_AGE_KEY_FILE", writeSOPSAgeKey(t))
+	payload := &GetSecretPayload{
+		Name:      name,
+		Token:     "valid-token",
+		UID:       uid,
+		Signature: "correct-signature",
+	}
+	update := func(key, value string) {
+		pod.Annotations = map[string]string{Namespace + ConfigPiggyUID: `{"test-uid": "correct-signature"}`, Namespace + key: value}
+		_, err := client.CoreV1().Pods(ns).Update(svc.context, pod, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+	}
+
+	// Case 1: ConfigMap with a single key in the pod namespace
+	env, info, err := svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "myapp-secrets", info.SecretName)
+	assert.Equal(t, "s3cr3t", (*env)["DB_PASS"])
+	assert.Equal(t, "5432", (*env)["PORT"])
+
+	// Case 2: Key not found in the ConfigMap
+	update(SOPSConfigMap, "myapp-secrets/secrets.enc.json")
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorNotFound)
+
+	// Case 3: SOPS_FILE_DIR is not set
+	update(SOPSFile, "myapp.enc.json")
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorContains(t, err, "SOPS_FILE_DIR")
+
+	// Case 4: File in SOPS_FILE_DIR
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "myapp.enc.json"), []byte(testSOPSJSON), 0600))
+	t.Setenv("SOPS_FILE_DIR", dir)
+	env, info, err = svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "myapp.enc.json", info.SecretName)
+	assert.Equal(t, SanitizedEnv{"DB_PASS": "s3cr3t", "PORT": "5432", "ENABLED": "false"}, *env)
+
+	// Case 5: File outside SOPS_FILE_DIR
+	update(SOPSFile, "../myapp.enc.json")
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorContains(t, err, "not in SOPS_FILE_DIR")
+
+	// Case 6: File not found
+	update(SOPSFile, "unknown.enc.json")
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorNotFound)
+}
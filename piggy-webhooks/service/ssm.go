@@ -0,0 +1,111 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxSSMGetParameters the maximum number of names of a GetParameters request
+const maxSSMGetParameters = 10
+
+// SplitSSMReferences splits references into SSM parameter references and secret keys
+func SplitSSMReferences(references []string) ([]string, []string) {
+	var parameters, keys []string
+	for _, reference := range references {
+		if strings.HasPrefix(reference, PrefixSSM) {
+			parameters = append(parameters, reference)
+		} else {
+			keys = append(keys, reference)
+		}
+	}
+	return parameters, keys
+}
+
+// SSMParameterName returns the parameter name of an SSM reference without the version or label selector
+func SSMParameterName(reference string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(reference, PrefixSSM), ":")
+	return name
+}
+
+// SSMIndexedKey returns the secret key of an element of a StringList parameter reference e.g. `ssm:/app/hosts[0]`
+func SSMIndexedKey(reference string, index int) string {
+	return fmt.Sprintf("%s[%d]", reference, index)
+}
+
+// ssmReference returns the reference of a parameter read by GetParameters
+func ssmReference(param types.Parameter) string {
+	selector := aws.ToString(param.Selector)
+	if selector != "" && !strings.HasPrefix(selector, ":") {
+		selector = ":" + selector
+	}
+	return PrefixSSM + aws.ToString(param.Name) + selector
+}
+
+// authorizeSSMParameter authorizes the pod to read a parameter with the AWS role of piggy-webhooks.
+// A parameter has no PIGGY_ALLOWED_SA and any pod can reference any parameter, so a SecretAccessPolicy must always grant it
+func (s *Service) authorizeSSMParameter(pod *corev1.Pod, name string) error {
+	if s.policies == nil {
+		return fmt.Errorf("%w: SSM parameter [%s] requires SecretAccessPolicy, which is not enabled", ErrorAuthorized, name)
+	}
+	policies, err := s.policies.List()
+	if err != nil {
+		return err
+	}
+	if decision := EvaluatePolicies(policies, pod, name); decision != nil {
+		log.Debug().Msgf("Decision [true] by SecretAccessPolicy [%s] for [%s]", decision.Policy, name)
+		return nil
+	}
+	log.Debug().Msgf("No SecretAccessPolicy grants [pod=%s/%s] access to [%s]", pod.Namespace, pod.Name, name)
+	return fmt.Errorf("%w: no SecretAccessPolicy grants SSM parameter [%s]", ErrorAuthorized, name)
+}
+
+// injectSSMParameters reads the SSM parameters referenced by the container in batches of GetParameters.
+// StringList parameters are also split into indexed keys when AWSSSMSplitStringList is enabled
+func (s *Service) injectSSMParameters(config *PiggyConfig, pod *corev1.Pod, references []string, env *SanitizedEnv) error {
+	var names []string
+	for _, reference := range references {
+		if config.ContainerKeys != nil && !config.ContainerKeys[reference] {
+			continue
+		}
+		if err := s.authorizeSSMParameter(pod, SSMParameterName(reference)); err != nil {
+			return err
+		}
+		names = append(names, strings.TrimPrefix(reference, PrefixSSM))
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	pm, err := s.awsFactory.GetSSMClient(s.context, config.AWSRegion)
+	if err != nil {
+		return err
+	}
+	for batch := range slices.Chunk(names, maxSSMGetParameters) {
+		output, err := pm.GetParameters(s.context, &ssm.GetParametersInput{
+			Names:          batch,
+			WithDecryption: aws.Bool(true),
+		})
+		if awsErr(err) {
+			return err
+		}
+		if len(output.InvalidParameters) > 0 {
+			log.Debug().Msgf("SSM parameters not found %v", output.InvalidParameters)
+		}
+		for _, param := range output.Parameters {
+			reference := ssmReference(param)
+			env.append(reference, aws.ToString(param.Value))
+			if config.AWSSSMSplitStringList && param.Type == types.ParameterTypeStringList {
+				for i, value := range strings.Split(aws.ToString(param.Value), ",") {
+					env.append(SSMIndexedKey(reference, i), value)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMockGetParameters returns parameters of the given `name` or `name:selector` and counts the requests
+func newMockGetParameters(parameters map[string]types.Parameter, requests *int) func(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+	return func(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+		*requests++
+		if len(params.Names) > maxSSMGetParameters {
+			return nil, fmt.Errorf("too many names %d", len(params.Names))
+		}
+		output := &ssm.GetParametersOutput{}
+		for _, name := range params.Names {
+			param, ok := parameters[name]
+			if !ok {
+				output.InvalidParameters = append(output.InvalidParameters, name)
+				continue
+			}
+			if _, selector, ok := strings.Cut(name, ":"); ok {
+				param.Selector = aws.String(":" + selector)
+			}
+			output.Parameters = append(output.Parameters, param)
+		}
+		return output, nil
+	}
+}
+
+func TestSSMReferences(t *testing.T) {
+	parameters, keys := SplitSSMReferences([]string{"DB_PASS", "ssm:/shared/api-key:3", "kms:AQID"})
+	assert.Equal(t, []string{"ssm:/shared/api-key:3"}, parameters)
+	assert.Equal(t, []string{"DB_PASS", "kms:AQID"}, keys)
+	assert.Equal(t, "/shared/api-key", SSMParameterName("ssm:/shared/api-key:prod"))
+	assert.Equal(t, "/shared/api-key", SSMParameterName("ssm:/shared/api-key"))
+	assert.Equal(t, "ssm:/shared/hosts[1]", SSMIndexedKey("ssm:/shared/hosts", 1))
+	assert.Equal(t, "ssm:/shared/api-key:3", ssmReference(types.Parameter{Name: aws.String("/shared/api-key"), Selector: aws.String(":3")}))
+	assert.Equal(t, "ssm:/shared/api-key:3", ssmReference(types.Parameter{Name: aws.String("/shared/api-key"), Selector: aws.String("3")}))
+}
+
+func TestGetSecret_SSMReferences(t *testing.T) {
+	ns, name, sa, uid := "default", "test-pod", "test-sa", "test-uid"
+	pod := newPod(ns, name, sa, map[string]string{
+		Namespace + ConfigPiggyUID:        `{"test-uid": "correct-signature"}`,
+		Namespace + AWSSSMSplitStringList: "true",
+	})
+	_, client, svc := setupTest(pod)
+	mockTokenReview(client, "system:serviceaccount:"+ns+":"+sa, true)
+	parameters := map[string]types.Parameter{
+		"/shared/api-key:3":    {Name: aws.String("/shared/api-key"), Value: aws.String("v3"), Type: types.ParameterTypeSecureString},
+		"/shared/api-key:prod": {Name: aws.String("/shared/api-key"), Value: aws.String("v4"), Type: types.ParameterTypeSecureString},
+		"/shared/hosts":        {Name: aws.String("/shared/hosts"), Value: aws.String("a,b"), Type: types.ParameterTypeStringList},
+	}
+	references := []string{"ssm:/shared/api-key:3", "ssm:/shared/api-key:prod", "ssm:/shared/hosts", "ssm:/shared/missing"}
+	for i := range 10 {
+		name := fmt.Sprintf("/shared/p%d", i)
+		parameters[name] = types.Parameter{Name: aws.String(name), Value: aws.String(name), Type: types.ParameterTypeString}
+		references = append(references, PrefixSSM+name)
+	}
+	requests := 0
+	readSecret := false
+	svc.awsFactory = &MockAWSClientFactory{
+		GetSecretsManagerClientFunc: func(ctx context.Context, region string) (SecretsManagerClient, error) {
+			return &MockSecretsManagerClient{
+				GetSecretValueFunc: func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+					readSecret = true
+					return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(`{"DB_PASS": "secret"}`)}, nil
+				},
+			}, nil
+		},
+		GetSSMClientFunc: func(ctx context.Context, region string) (SSMClient, error) {
+			return &MockSSMClient{GetParametersFunc: newMockGetParameters(parameters, &requests)}, nil
+		},
+	}
+	payload := &GetSecretPayload{
+		Name:       name,
+		Token:      "valid-token",
+		UID:        uid,
+		Signature:  "correct-signature",
+		References: references,
+	}
+
+	// Case 1: Parameters are denied while SecretAccessPolicy is not enabled
+	env, _, err := svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorAuthorized)
+	assert.ErrorContains(t, err, "requires SecretAccessPolicy, which is not enabled")
+	assert.Empty(t, *env)
+	assert.Zero(t, requests)
+
+	// Case 2: Parameters are read in batches without reading the secret
+	svc.SetPolicyLister(staticPolicyLister{
+		newPolicy("shared", PolicySubject{Namespaces: []string{ns}}, PolicySecret{Name: "/shared/*"}),
+	})
+	env, _, err = svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.False(t, readSecret)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, "v3", (*env)["ssm:/shared/api-key:3"])
+	assert.Equal(t, "v4", (*env)["ssm:/shared/api-key:prod"])
+	assert.Equal(t, "a,b", (*env)["ssm:/shared/hosts"])
+	assert.Equal(t, "a", (*env)["ssm:/shared/hosts[0]"])
+	assert.Equal(t, "b", (*env)["ssm:/shared/hosts[1]"])
+	assert.Equal(t, "/shared/p9", (*env)["ssm:/shared/p9"])
+	assert.NotContains(t, *env, "ssm:/shared/missing")
+
+	// Case 3: Secret keys and parameters
+	payload.References = []string{"DB_PASS", "ssm:/shared/hosts"}
+	env, _, err = svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.True(t, readSecret)
+	assert.Equal(t, "secret", (*env)["DB_PASS"])
+	assert.Equal(t, "a,b", (*env)["ssm:/shared/hosts"])
+
+	// Case 4: Parameters must be granted by a SecretAccessPolicy
+	payload.References = []string{"ssm:/shared/api-key:3"}
+	svc.SetPolicyLister(staticPolicyLister{
+		newPolicy("other", PolicySubject{Namespaces: []string{ns}}, PolicySecret{Name: "/other/*"}),
+	})
+	_, _, err = svc.GetSecret(payload)
+	assert.ErrorIs(t, err, ErrorAuthorized)
+	assert.ErrorContains(t, err, "no SecretAccessPolicy grants SSM parameter [/shared/api-key]")
+
+	svc.SetPolicyLister(staticPolicyLister{
+		newPolicy("shared", PolicySubject{Namespaces: []string{ns}}, PolicySecret{Name: "/shared/*"}),
+	})
+	env, _, err = svc.GetSecret(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, SanitizedEnv{"ssm:/shared/api-key:3": "v3"}, *env)
+}